@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fiwippi/spotify-sync/pkg/server"
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"time"
+)
+
+var auditSince, auditUntil, auditActor, auditOutput string
+
+func init() {
+	auditCmd.Flags().StringVarP(&dbPath, "path", "p", "", "path to dir where db located (default $DATA_DIR or \".\")")
+	auditCmd.Flags().StringVar(&dbDriver, "driver", store.Bolt, "driver the db is stored with from \"bolt\", \"sqlite\"")
+	auditCmd.Flags().StringVar(&auditSince, "since", "", "only export entries at or after this RFC3339 time, e.g. 2021-03-01T00:00:00Z")
+	auditCmd.Flags().StringVar(&auditUntil, "until", "", "only export entries before this RFC3339 time")
+	auditCmd.Flags().StringVar(&auditActor, "actor", "", "only export entries performed by this actor, e.g. an admin token's name")
+	auditCmd.Flags().StringVarP(&auditOutput, "output", "o", "", "file to write the entries to (default stdout)")
+	rootCmd.AddCommand(auditCmd)
+}
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Exports the server audit log",
+	Long: `Exports the audit log of privileged actions as JSON lines, one entry per line in the order they happened.
+The server must not be running when this is running unless the db is stored with sqlite`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var since, until time.Time
+		var err error
+		if auditSince != "" {
+			since, err = time.Parse(time.RFC3339, auditSince)
+			if err != nil {
+				return errors.New("since must be an RFC3339 time")
+			}
+		}
+		if auditUntil != "" {
+			until, err = time.Parse(time.RFC3339, auditUntil)
+			if err != nil {
+				return errors.New("until must be an RFC3339 time")
+			}
+		}
+
+		var w io.Writer = os.Stdout
+		if auditOutput != "" {
+			f, err := os.OpenFile(auditOutput, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+
+		n, err := server.ExportAudit(dbDriver, dbFilePath(dbDriver), w, since, until, auditActor)
+		if err != nil {
+			return err
+		}
+		if auditOutput != "" {
+			fmt.Printf("Exported %d audit entries to %s\n", n, auditOutput)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fiwippi/spotify-sync/pkg/server"
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"github.com/spf13/cobra"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var backupAddress, backupToken, backupOutput, backupCAFile string
+
+func init() {
+	backupCmd.Flags().StringVarP(&backupAddress, "address", "a", "http://localhost:8096", "address of the running server")
+	backupCmd.Flags().StringVarP(&backupToken, "token", "t", "", "admin token with the db:backup scope (default $ADMIN_TOKEN)")
+	backupCmd.Flags().StringVarP(&backupOutput, "output", "o", "", "file to save the backup to (default spotify-<time>.db or .sqlite)")
+	backupCmd.Flags().StringVar(&backupCAFile, "ca-file", "", "PEM file of extra certificate authorities to trust, e.g. for a self-signed server")
+	rootCmd.AddCommand(backupCmd)
+}
+
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Backs up the database of a running server",
+	Long: `Downloads a consistent snapshot of the database from a running server and checks it can be restored.
+The backup includes password hashes and tokens so it should be kept somewhere safe`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if backupToken == "" {
+			backupToken = os.Getenv("ADMIN_TOKEN")
+		}
+		if backupToken == "" {
+			return errors.New("An admin token with the db:backup scope is required")
+		}
+
+		client := &http.Client{}
+		if backupCAFile != "" {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			pem, err := ioutil.ReadFile(backupCAFile)
+			if err != nil {
+				return err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return errors.New("No certificates found in the CA file")
+			}
+			client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+		}
+
+		req, err := http.NewRequest("GET", strings.TrimSuffix(backupAddress, "/")+"/api/backup", nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+backupToken)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			var r ws.Response
+			if json.NewDecoder(resp.Body).Decode(&r) != nil || r.Error == "" {
+				return errors.New("Backup failed: " + resp.Status)
+			}
+			return errors.New("Backup failed: " + r.Error)
+		}
+
+		// The server names the backup unless an output is given
+		driver := resp.Header.Get("X-DB-Driver")
+		if backupOutput == "" {
+			_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+			if err != nil || params["filename"] == "" {
+				return errors.New("Server did not name the backup, an output file must be given")
+			}
+			backupOutput = filepath.Base(params["filename"])
+		}
+
+		// Download next to the output and only keep it once it's validated
+		part := backupOutput + ".part"
+		f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(part)
+		n, err := io.Copy(f, resp.Body)
+		if err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		version, err := server.ValidateBackup(driver, part)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(part, backupOutput)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Backed up the db (%s, schema v%d, %d bytes) to %s\n", driver, version, n, backupOutput)
+		return nil
+	},
+}
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fiwippi/spotify-sync/pkg/conformance"
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"github.com/spf13/cobra"
+)
+
+var conformanceAddress, conformanceAdminKey, conformanceEncoding, conformanceDriver string
+
+func init() {
+	conformanceCmd.Flags().StringVarP(&conformanceAddress, "address", "a", "", "replay against a running server at this address instead of in-process")
+	conformanceCmd.Flags().StringVarP(&conformanceAdminKey, "admin-key", "k", "", "admin key of the running server, used to create a temporary admin token which creates users")
+	conformanceCmd.Flags().StringVar(&conformanceEncoding, "encoding", "all", "message encoding from \"json\", \"msgpack\", \"cbor\", \"all\"")
+	conformanceCmd.Flags().StringVar(&conformanceDriver, "driver", store.Memory, "driver the in-process server stores its db with from \"bolt\", \"sqlite\", \"memory\"")
+	rootCmd.AddCommand(conformanceCmd)
+}
+
+var conformanceCmd = &cobra.Command{
+	Use:   "conformance [transcript files]",
+	Short: "Replays protocol transcripts against a server",
+	Long: `Replays protocol transcripts against an in-process server with fake spotify players, or against a 
+running server if an address is given. If no transcript files are given the built-in transcripts are used`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		encodings := []string{conformanceEncoding}
+		if conformanceEncoding == "all" {
+			encodings = []string{"json", "msgpack", "cbor"}
+		}
+
+		// Load the transcripts
+		var transcripts []*conformance.Transcript
+		if len(args) == 0 {
+			var err error
+			transcripts, err = conformance.Builtin()
+			if err != nil {
+				return err
+			}
+		}
+		for _, p := range args {
+			t, err := conformance.Load(p)
+			if err != nil {
+				return fmt.Errorf("%s: %s", p, err)
+			}
+			transcripts = append(transcripts, t)
+		}
+
+		// Replay each one with each encoding
+		failed := 0
+		for _, t := range transcripts {
+			for _, e := range encodings {
+				var err error
+				if conformanceAddress == "" {
+					err = conformance.ReplayInProcess(t, e, conformanceDriver)
+				} else {
+					err = conformance.Replay(t, conformance.Options{Address: conformanceAddress, AdminKey: conformanceAdminKey, Encoding: e})
+				}
+
+				if err != nil {
+					failed++
+					fmt.Printf("FAIL %s (%s): %s\n", t.Name, e, err)
+				} else {
+					fmt.Printf("PASS %s (%s)\n", t.Name, e)
+				}
+			}
+		}
+
+		if failed > 0 {
+			return errors.New(fmt.Sprintf("%d replays failed", failed))
+		}
+		return nil
+	},
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"github.com/spf13/cobra"
+)
+
+var convertFrom, convertTo string
+
+func init() {
+	convertCmd.Flags().StringVarP(&dbPath, "path", "p", "", "path to dir where db located (default $DATA_DIR or \".\")")
+	convertCmd.Flags().StringVar(&convertFrom, "from", store.Bolt, "driver the db is currently stored with from \"bolt\", \"sqlite\"")
+	convertCmd.Flags().StringVar(&convertTo, "to", store.SQLite, "driver to store the db with from \"bolt\", \"sqlite\"")
+	rootCmd.AddCommand(convertCmd)
+}
+
+var convertCmd = &cobra.Command{
+	Use:   "convert",
+	Short: "Copies the server database to another driver",
+	Long: `Copies every bucket of the server database into a db stored with another driver, in the same dir.
+Values already in the other db are overwritten. The server must not be running when this is running`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if convertFrom == convertTo {
+			return errors.New("The drivers must be different")
+		}
+		if convertFrom == store.Memory || convertTo == store.Memory {
+			return errors.New("The memory driver can't be converted to or from")
+		}
+
+		src, err := store.Open(convertFrom, store.Path(convertFrom, dbDir()), true)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		dstPath := store.Path(convertTo, dbDir())
+		dst, err := store.Open(convertTo, dstPath, false)
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+
+		err = store.Copy(dst, src)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Copied the db to %s, start the server with DB_DRIVER=%s to use it\n", dstPath, convertTo)
+		return nil
+	},
+}
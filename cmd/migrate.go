@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/fiwippi/spotify-sync/pkg/server"
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"github.com/spf13/cobra"
+)
+
+var dryRun, backup bool
+
+func init() {
+	migrateCmd.Flags().StringVarP(&dbPath, "path", "p", "", "path to dir where db located (default $DATA_DIR or \".\")")
+	migrateCmd.Flags().StringVar(&dbDriver, "driver", store.Bolt, "driver the db is stored with from \"bolt\", \"sqlite\"")
+	migrateCmd.Flags().BoolVar(&dryRun, "dry-run", false, "show what the migrations would change without changing the db")
+	migrateCmd.Flags().BoolVar(&backup, "backup", true, "back up the db next to it before migrating")
+	rootCmd.AddCommand(migrateCmd)
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Migrates the server database to the current schema",
+	Long: `Applies the migrations the server database hasn't had yet, the server also does this when it starts.
+Use --dry-run to see what would change first. The server must not be running when this is running`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		results, err := server.Migrate(dbDriver, dbFilePath(dbDriver), dryRun, backup)
+		if err != nil {
+			return err
+		}
+		if len(results) == 0 {
+			fmt.Println("The db is already up to date")
+			return nil
+		}
+
+		if dryRun {
+			fmt.Println("Would apply:")
+		} else {
+			fmt.Println("Applied:")
+		}
+		for _, r := range results {
+			fmt.Println(" ", r)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/fiwippi/spotify-sync/pkg/server"
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"github.com/joho/godotenv"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+func init() {
+	rekeyCmd.Flags().StringVarP(&dbPath, "path", "p", "", "path to dir where db located (default $DATA_DIR or \".\")")
+	rekeyCmd.Flags().StringVar(&dbDriver, "driver", store.Bolt, "driver the db is stored with from \"bolt\", \"sqlite\"")
+	rekeyCmd.Flags().StringVarP(&envPath, "env-path", "e", ".env", "path to load env file from")
+	rootCmd.AddCommand(rekeyCmd)
+}
+
+var rekeyCmd = &cobra.Command{
+	Use:   "rekey",
+	Short: "Re-encrypts the tokens in the server database",
+	Long: `Re-encrypts every token in the server database with the first key in TOKEN_KEYS or TOKEN_KEY_FILE,
+use this after adding a new key to rotate keys. The server must not be running when this is running`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Load the env file
+		godotenv.Load(envPath)
+
+		err := server.LoadTokenKeys(os.Getenv("TOKEN_KEYS"), os.Getenv("TOKEN_KEY_FILE"))
+		if err != nil {
+			return err
+		}
+
+		n, err := server.Rekey(dbDriver, dbFilePath(dbDriver))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Re-encrypted %d tokens\n", n)
+		return nil
+	},
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fiwippi/spotify-sync/pkg/server"
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	restoreCmd.Flags().StringVarP(&dbPath, "path", "p", "", "path to dir where db located (default $DATA_DIR or \".\")")
+	restoreCmd.Flags().StringVar(&dbDriver, "driver", store.Bolt, "driver the db is stored with from \"bolt\", \"sqlite\"")
+	rootCmd.AddCommand(restoreCmd)
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore [backup file]",
+	Short: "Restores the server database from a backup",
+	Long: `Replaces the server database with a backup once its schema version is checked, the current database is 
+kept next to it as a .bak file. Older backups are migrated when the server next starts. The server must not be 
+running when this is running`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if dbDriver == store.Memory {
+			return errors.New("The memory driver has nothing to restore")
+		}
+
+		path := dbFilePath(dbDriver)
+		version, err := server.Restore(dbDriver, path, args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Restored %s from %s (schema v%d)\n", path, args[0], version)
+		return nil
+	},
+}
@@ -7,11 +7,15 @@ import (
 	"github.com/joho/godotenv"
 	"github.com/spf13/cobra"
 	"os"
+	"strconv"
 	"time"
 )
 
 var refresh time.Duration
 var id, secret, redirect, serverKey, adminKey, port, envPath, ssl, mode, logLevel string
+var tlsCert, tlsKey string
+var selfSigned bool
+var serverDBDriver, dataDir, serverDBPath string
 
 var validLogLevels = map[string]bool{
 	"trace": true,
@@ -30,6 +34,12 @@ func init() {
 	serverCmd.Flags().StringVarP(&envPath, "env-path", "e", ".env", "path to load env file from")
 	serverCmd.Flags().StringVarP(&mode, "mode", "m", "", "runs the server from available modes \"debug\", \"release\" (default \"debug\")")
 	serverCmd.Flags().StringVarP(&logLevel, "log-level", "l", "", "log level from \"trace\", \"debug\", \"info\", \"warn\", \"error\", \"fatal\", \"panic\" (default \"debug\")")
+	serverCmd.Flags().StringVar(&tlsCert, "tls-cert", "", "certificate file to serve https/wss with, reloaded on SIGHUP")
+	serverCmd.Flags().StringVar(&tlsKey, "tls-key", "", "key file of the tls certificate")
+	serverCmd.Flags().BoolVar(&selfSigned, "self-signed", false, "serve https/wss with a generated self-signed certificate for local development")
+	serverCmd.Flags().StringVar(&serverDBDriver, "db-driver", "", "driver the db is stored with from \"bolt\", \"sqlite\", \"memory\" (default \"bolt\")")
+	serverCmd.Flags().StringVar(&dataDir, "data-dir", "", "dir the server keeps the db, logs and other state in (default \"data\")")
+	serverCmd.Flags().StringVar(&serverDBPath, "db-path", "", "path of the db file (default spotify.db or spotify.sqlite in the data dir)")
 	serverCmd.Flags().DurationVarP(&refresh, "refresh-interval", "r", 0, "how often should the server attempt to sync the session (default 10s)")
 
 	rootCmd.AddCommand(serverCmd)
@@ -52,8 +62,84 @@ var serverCmd = &cobra.Command{
 		id = os.Getenv("SPOTIFY_ID")
 		secret = os.Getenv("SPOTIFY_SECRET")
 
+		// Select where the server keeps its state, this must happen before anything is loaded from it
+		if dataDir == "" {
+			dataDir = os.Getenv("DATA_DIR")
+		}
+		if serverDBPath == "" {
+			serverDBPath = os.Getenv("DB_PATH")
+		}
+		server.SetDataDir(dataDir)
+		server.SetDBPath(serverDBPath)
+
 		// Get server secrets
 		adminKey = os.Getenv("ADMIN_KEY")
+		err := server.LoadTokenKeys(os.Getenv("TOKEN_KEYS"), os.Getenv("TOKEN_KEY_FILE"))
+		if err != nil {
+			return err
+		}
+
+		// Load the tls certificate
+		if tlsCert == "" {
+			tlsCert = os.Getenv("TLS_CERT_FILE")
+		}
+		if tlsKey == "" {
+			tlsKey = os.Getenv("TLS_KEY_FILE")
+		}
+		if !selfSigned {
+			selfSigned = os.Getenv("TLS_SELF_SIGNED") == "true"
+		}
+		err = server.LoadTLS(tlsCert, tlsKey, selfSigned, os.Getenv("DOMAIN"))
+		if err != nil {
+			return err
+		}
+
+		// Select how the db is stored
+		if serverDBDriver == "" {
+			serverDBDriver = os.Getenv("DB_DRIVER")
+		}
+		err = server.SetDBDriver(serverDBDriver)
+		if err != nil {
+			return err
+		}
+
+		// Snapshot the db periodically if enabled
+		keep, err := envInt("SNAPSHOT_KEEP", 7)
+		if err != nil {
+			return err
+		}
+		var interval time.Duration
+		if v := os.Getenv("SNAPSHOT_INTERVAL"); v != "" {
+			interval, err = time.ParseDuration(v)
+			if err != nil {
+				return errors.New("SNAPSHOT_INTERVAL must be a duration, e.g. 24h")
+			}
+		}
+		err = server.SetSnapshots(os.Getenv("SNAPSHOT_DIR"), interval, keep)
+		if err != nil {
+			return err
+		}
+
+		// The db is backed up before being migrated unless disabled
+		server.SetMigrationBackup(os.Getenv("MIGRATE_BACKUP") != "false")
+
+		// Load the websocket limits
+		messageSize, err := envInt("MAX_MESSAGE_SIZE", 16384)
+		if err != nil {
+			return err
+		}
+		perIP, err := envInt("MAX_CONNS_PER_IP", 10)
+		if err != nil {
+			return err
+		}
+		total, err := envInt("MAX_CONNS", 1000)
+		if err != nil {
+			return err
+		}
+		err = server.SetWebsocketLimits(os.Getenv("ALLOWED_ORIGINS"), int64(messageSize), perIP, total)
+		if err != nil {
+			return err
+		}
 
 		// Load the rest
 		if redirect == "" {
@@ -110,3 +196,16 @@ var serverCmd = &cobra.Command{
 		return server.Run(adminKey, id, secret, redirect, port, mode, logLevel, refresh)
 	},
 }
+
+// Returns the integer value of the env variable, or the default if it isn't set
+func envInt(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, errors.New(key + " must be a whole number")
+	}
+	return i, nil
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fiwippi/spotify-sync/pkg/server"
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"github.com/joho/godotenv"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var usersFormat, usersOutput, usersConflict string
+var usersHashes, usersTokens, usersDryRun bool
+
+func init() {
+	usersCmd.PersistentFlags().StringVarP(&dbPath, "path", "p", "", "path to dir where db located (default $DATA_DIR or \".\")")
+	usersCmd.PersistentFlags().StringVar(&dbDriver, "driver", store.Bolt, "driver the db is stored with from \"bolt\", \"sqlite\"")
+	usersCmd.PersistentFlags().StringVar(&usersFormat, "format", "", "format of the users from \"json\", \"csv\" (default from the file extension, else json)")
+
+	usersExportCmd.Flags().StringVarP(&usersOutput, "output", "o", "", "file to write the users to (default stdout)")
+	usersExportCmd.Flags().BoolVar(&usersHashes, "hashes", false, "include password hashes, so the users can log in after being imported elsewhere")
+	usersExportCmd.Flags().BoolVar(&usersTokens, "tokens", false, "include spotify tokens, encrypted ones can only be imported with the same token keys")
+
+	usersImportCmd.Flags().StringVar(&usersConflict, "conflict", "skip", "what to do with users which already exist from \"skip\", \"overwrite\", \"fail\"")
+	usersImportCmd.Flags().BoolVar(&usersDryRun, "dry-run", false, "report what would be imported without changing the db")
+	usersImportCmd.Flags().StringVarP(&envPath, "env-path", "e", ".env", "path to load env file from, its token keys are used to check imported tokens")
+
+	usersCmd.AddCommand(usersExportCmd, usersImportCmd)
+	rootCmd.AddCommand(usersCmd)
+}
+
+// Returns the format given by the flag, or by the file's extension if the flag isn't set
+func usersFileFormat(path string) string {
+	if usersFormat != "" {
+		return usersFormat
+	}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return "csv"
+	}
+	return "json"
+}
+
+var usersCmd = &cobra.Command{
+	Use:   "users",
+	Short: "Exports and imports the server's users",
+	Long: `Exports and imports the server's users as JSON or CSV. The server must not be running when this is
+running unless the db is stored with sqlite and only users are being exported`,
+}
+
+var usersExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Exports the users",
+	Long: `Exports the users as JSON or CSV, only their names are exported unless --hashes or --tokens are given.
+Exports including them should be kept somewhere safe`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var w io.Writer = os.Stdout
+		if usersOutput != "" {
+			f, err := os.OpenFile(usersOutput, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+
+		n, err := server.ExportUsers(dbDriver, dbFilePath(dbDriver), w, usersFileFormat(usersOutput), usersHashes, usersTokens)
+		if err != nil {
+			return err
+		}
+		if usersOutput != "" {
+			fmt.Printf("Exported %d users to %s\n", n, usersOutput)
+		}
+		return nil
+	},
+}
+
+var usersImportCmd = &cobra.Command{
+	Use:   "import [file]",
+	Short: "Imports users",
+	Long: `Imports users from a JSON array or a CSV file whose header names its columns from "name", "password",
+"password_hash" and "token". Each user needs either a password or a password hash exported from another server.
+Nothing is imported if any user is invalid, use --dry-run to check the file first`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Load the token keys so imported tokens can be checked
+		godotenv.Load(envPath)
+		err := server.LoadTokenKeys(os.Getenv("TOKEN_KEYS"), os.Getenv("TOKEN_KEY_FILE"))
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		report, err := server.ImportUsers(dbDriver, dbFilePath(dbDriver), f, usersFileFormat(args[0]), usersConflict, usersDryRun)
+		if report != nil {
+			for _, r := range report.Results {
+				if r.Error != "" {
+					fmt.Printf("  %-9s %s: %s\n", r.Action, r.Name, r.Error)
+				} else {
+					fmt.Printf("  %-9s %s\n", r.Action, r.Name)
+				}
+			}
+			if report.DryRun {
+				fmt.Println("Would import:", report)
+			} else if err == nil {
+				fmt.Println("Imported:", report)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if report.Invalid > 0 {
+			return errors.New("Some users are invalid, nothing would be imported")
+		}
+		return nil
+	},
+}
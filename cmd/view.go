@@ -1,57 +1,53 @@
 package cmd
 
 import (
-	"fmt"
+	"github.com/fiwippi/spotify-sync/pkg/server"
+	"github.com/fiwippi/spotify-sync/pkg/store"
 	"github.com/spf13/cobra"
-	bolt "go.etcd.io/bbolt"
-	"strings"
-	"time"
+	"os"
 )
 
-var dbPath string
+var dbPath, dbDriver string
+var viewFormat string
+var viewFilter server.ViewFilter
 
 func init() {
-	viewCmd.Flags().StringVarP(&dbPath, "path", "p", ".", "path to dir where db located")
+	viewCmd.Flags().StringVarP(&dbPath, "path", "p", "", "path to dir where db located (default $DATA_DIR or \".\")")
+	viewCmd.Flags().StringVar(&dbDriver, "driver", store.Bolt, "driver the db is stored with from \"bolt\", \"sqlite\"")
+	viewCmd.Flags().StringVarP(&viewFilter.Bucket, "bucket", "b", "", "only show values in this bucket, e.g. users")
+	viewCmd.Flags().StringVarP(&viewFilter.Key, "key", "k", "", "only show values with this key, e.g. a username")
+	viewCmd.Flags().StringVarP(&viewFormat, "format", "f", "table", "output format from \"table\", \"json\"")
+	viewCmd.Flags().BoolVar(&viewFilter.Unsafe, "unsafe", false, "show secrets such as password hashes and tokens instead of redacting them")
 	rootCmd.AddCommand(viewCmd)
 }
 
 var viewCmd = &cobra.Command{
 	Use:   "view",
 	Short: "Views the server database",
-	Long:  `Views the server database, the server must not be running when this is running`,
+	Long: `Views the values in the server database with secrets such as tokens redacted unless --unsafe is given. The 
+server must not be running when this is running unless the db is stored with sqlite, which can be read while the 
+server writes to it`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		db, err := bolt.Open(strings.TrimSuffix(dbPath, "/")+"/spotify.db", 0666, &bolt.Options{Timeout: 1 * time.Second})
-		if err != nil {
-			return err
-		}
-		defer db.Close()
-
-		err = db.View(func(tx *bolt.Tx) error {
-			c := tx.Cursor()
-			dumpCursor(tx, c, 0)
-			return nil
-		})
-		if err != nil {
-			return err
-		}
-
-		return nil
+		return server.ViewDB(dbDriver, dbFilePath(dbDriver), os.Stdout, viewFilter, viewFormat)
 	},
 }
 
-func dumpCursor(tx *bolt.Tx, c *bolt.Cursor, indent int) {
-	for k, v := c.First(); k != nil; k, v = c.Next() {
-		if v == nil {
-			fmt.Printf(strings.Repeat("\t", indent)+"[%s]\n", k)
-			newBucket := c.Bucket().Bucket(k)
-			if newBucket == nil {
-				newBucket = tx.Bucket(k)
-			}
-			newCursor := newBucket.Cursor()
-			dumpCursor(tx, newCursor, indent+1)
-		} else {
-			fmt.Printf(strings.Repeat("\t", indent)+"%s\n", k)
-			fmt.Printf(strings.Repeat("\t", indent+1)+"%s\n", v)
-		}
+// Returns the dir the offline commands find the db in, the -p flag or else $DATA_DIR or else the current dir
+func dbDir() string {
+	if dbPath != "" {
+		return dbPath
+	}
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		return dir
+	}
+	return "."
+}
+
+// Returns the path of the db stored with the driver which the offline commands use,
+// $DB_PATH is used like the server does unless a dir is given with the -p flag
+func dbFilePath(driver string) string {
+	if path := os.Getenv("DB_PATH"); path != "" && dbPath == "" {
+		return path
 	}
+	return store.Path(driver, dbDir())
 }
@@ -1,12 +1,11 @@
 package client
 
 import (
-	"github.com/gorilla/websocket"
+	"context"
+	"github.com/fiwippi/spotify-sync/pkg/sdk"
 	"github.com/rivo/tview"
-	"net/url"
 	"os"
 	"os/signal"
-	"time"
 )
 
 // The gui app object (this is the root object of the gui)
@@ -14,10 +13,9 @@ var app *tview.Application
 
 // Client used to connect to the spotify sync server
 type Client struct {
-	done      chan struct{}   // Channel for notifying the client is done reading messages from the shared conn
-	url       url.URL         // URL the client will connect to via HTTP and then upgrade to websocket
-	conn      *websocket.Conn // Websocket connection used to connect to the server
-	interrupt chan os.Signal  // Channel to signal the client to close the socket connection
+	conn      *sdk.Conn      // Connection to the server, handles the protocol for the gui
+	interrupt chan os.Signal // Channel to signal the client to close the socket connection
+	showTime  bool           // Whether the user asked to see the server's time
 }
 
 // Create the client object with its respective channels
@@ -26,13 +24,18 @@ func NewClient() *Client {
 	signal.Notify(interrupt, os.Interrupt)
 
 	return &Client{
-		done:      make(chan struct{}),
 		interrupt: interrupt,
 	}
 }
 
 // Builds the gui and then runs it, returns an error on failure
 func (c *Client) Run() error {
+	var err error
+	Log, err = CreateLogger()
+	if err != nil {
+		return err
+	}
+
 	app = c.createGUI()
 	if err := app.Run(); err != nil {
 		return err
@@ -40,83 +43,68 @@ func (c *Client) Run() error {
 	return nil
 }
 
-// Changes the address the client will attempt to connect to via websocket
-func (c *Client) changeAddress(addr string) {
-	scheme := "wss"
-	if !useSSL {
-		scheme = "ws"
-	}
-
-	c.url = url.URL{Scheme: scheme, Host: addr, Path: "/shared"}
-}
-
-// Dials the shared connection and connects to the sync server
-func (c *Client) connect() error {
-	var err error
-	Log.Println("Dialing to:", c.url.String())
-	c.conn, _, err = websocket.DefaultDialer.Dial(c.url.String(), nil)
+// Dials the shared connection, connects to the sync server and starts handling its
+// events, logging in (or registering if an invite code is given) happens in the background
+func (c *Client) connect(inviteCode string) error {
+	conn, err := sdk.Dial(sdk.Options{
+		Address:  details.Address,
+		UseSSL:   details.UseSSL != "false",
+		Encoding: details.Encoding,
+		CAFile:   details.CAFile,
+		Logger:   Log,
+	})
 	if err != nil {
 		return err
 	}
+	c.conn = conn
+
+	// Listen for incoming events
+	events, _ := conn.Subscribe()
+	go c.readPump(events)
+
+	// Handle shutdown
+	go c.handleShutdown(conn)
+
+	go func() {
+		var err error
+		if inviteCode != "" {
+			err = conn.Register(context.Background(), details.Username, details.Password, inviteCode)
+		} else {
+			err = conn.Login(context.Background(), details.Username, details.Password)
+		}
+		if err != nil {
+			Log.Println("Login failed:", err)
+		}
+	}()
 	return nil
 }
 
 // Close the client's websocket connection to the server
-func (c *Client) disconnect() error {
-	Log.Println("Closing websocket connection")
+func (c *Client) disconnect() {
 	err := c.conn.Close()
 	if err != nil {
-		return err
+		Log.Println("Error closing websocket conn: " + err.Error())
 	}
 	Log.Println("Websocket connection closed")
-	return nil
 }
 
-// Sends an empty struct to the done channel to cause a shutdown
-func (c *Client) notifyDone() {
-	select {
-	case c.done <- struct{}{}:
-	default:
-		Log.Println("Done channel full. Discarding value")
-	}
-}
-
-// Wait for client to stop waiting for read messages (signified by
-// closing of done channel) or due to an external interrupt i.e. Ctrl+C
-func (c *Client) handleShutdown() {
-	defer func() {
-		c.done = make(chan struct{})
-		err := c.disconnect()
-		if err != nil {
-			Log.Println("Error closing websocket conn: " + err.Error())
-		}
-	}()
-
+// Waits for an external interrupt i.e. Ctrl+C and closes the connection, if the
+// connection closes first (manually or it couldn't be resumed) then the gui is reset
+func (c *Client) handleShutdown(conn *sdk.Conn) {
 	select {
 	// Manual shutdown by user or through (unexpected) closed websocket connection
-	case <-c.done:
-		Log.Println("Manual shutdown / Websocket err")
+	case <-conn.Done():
+		Log.Println("Manual shutdown / Websocket err:", conn.Err())
 		// Clean up the old text boxes
 		gCtx.users.Clear().SetText("USERS")
 		gCtx.chatlog.Clear()
 
 		// Go back to home screen if not shutting down
 		gCtx.pages.SwitchToPage("disconnected")
-
-		return
+		gCtx.app.Draw()
 	// Shutdown through interrupt
 	case <-c.interrupt:
 		Log.Println("Shutdown through interrupt")
-		// Cleanly close the connection by sending a close message and then waiting (with timeout) for the server to close the connection.
-		err := c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-		if err != nil {
-			Log.Printf("write close: %s", err.Error())
-			return
-		}
-		select {
-		case <-c.done:
-		case <-time.After(time.Second):
-		}
-		return
+		c.disconnect()
 	}
 }
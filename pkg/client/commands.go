@@ -1,10 +1,12 @@
 package client
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/atotto/clipboard"
 	ws "github.com/fiwippi/spotify-sync/pkg/shared"
 	"strings"
+	"time"
 )
 
 //// SERVER to CLIENT opcodes
@@ -16,7 +18,7 @@ func (c *Client) cmdAuth(m *ws.Message) error {
 
 	// Writes the auth url to the chatlog
 	text := fmt.Sprintf("The authentication URL should be copied to the clipboard, it might not be. Please authenticate the client through: %s\n", m.Body)
-	_, err := gCtx.chatlog.Write([]byte(fmt.Sprintf("[red]%s <SERVER> %s", m.Timestamp, text)))
+	_, err := gCtx.chatlog.Write([]byte(fmt.Sprintf("[red]%s <SERVER> %s", ws.LocalTime(m.Timestamp), text)))
 	Log.Println("Auth error: ", err)
 
 	return err
@@ -26,8 +28,26 @@ func (c *Client) cmdAuth(m *ws.Message) error {
 func (c *Client) cmdInfo(m *ws.Message) error {
 	// Writes the info text to the chatlog
 	text := fmt.Sprintf("INFO: %s\n", m.Body)
-	gCtx.chatlog.Write([]byte(fmt.Sprintf("[red]%s <SERVER> %s", m.Timestamp, text)))
+	gCtx.chatlog.Write([]byte(fmt.Sprintf("[red]%s <SERVER> %s", ws.LocalTime(m.Timestamp), text)))
 
+	// Replies to account requests are INFO messages when they fail, so they're shown on the account page too
+	if name, _ := gCtx.pages.GetFrontPage(); name == "account" {
+		gCtx.account.SetText(m.Body)
+	}
+	return nil
+}
+
+// Processes the PASSWD opcode, the password was changed successfully
+func (c *Client) cmdPasswd(m *ws.Message) error {
+	gCtx.account.SetText(m.Body)
+	gCtx.chatlog.Write([]byte(fmt.Sprintf("[red]%s <SERVER> INFO: %s\n", ws.LocalTime(m.Timestamp), m.Body)))
+	return nil
+}
+
+// Processes the WHOAMI opcode
+func (c *Client) cmdWhoami(m *ws.Message) error {
+	gCtx.account.SetText(m.Body)
+	gCtx.chatlog.Write([]byte(fmt.Sprintf("[red]%s <SERVER> INFO: %s\n", ws.LocalTime(m.Timestamp), m.Body)))
 	return nil
 }
 
@@ -40,7 +60,7 @@ func (c *Client) cmdMsg(m *ws.Message) error {
 	}
 
 	// Write the user message to the chatlog
-	gCtx.chatlog.Write([]byte(fmt.Sprintf("[teal]%s <%s>: %s", m.Timestamp, name, m.Body)))
+	gCtx.chatlog.Write([]byte(fmt.Sprintf("[teal]%s <%s>: %s", ws.LocalTime(m.Timestamp), name, m.Body)))
 	return nil
 }
 
@@ -57,9 +77,84 @@ func (c *Client) cmdUsers(m *ws.Message) error {
 	return nil
 }
 
-// Processes the LOGIN opcode, this means the server is asking for the user's login details
-func (c *Client) cmdLogin() error {
-	c.writeMsg(fmt.Sprintf("login,%s,%s", details.Username, details.Password))
+// Processes the TIME opcode, the connection has already updated its clock
+// offset so it's only written to the chatlog if the user asked for it
+func (c *Client) cmdTime(m *ws.Message) error {
+	if !c.showTime {
+		return nil
+	}
+	c.showTime = false
+
+	offset, rtt := c.conn.ClockOffset()
+	text := fmt.Sprintf("INFO: Server time is %s, your clock is off by %s (round trip %s)\n",
+		c.conn.ServerTime().Format("15:04:05.000"), offset, rtt)
+	gCtx.chatlog.Write([]byte(fmt.Sprintf("[red]%s <SERVER> %s", ws.LocalTime(m.Timestamp), text)))
+
+	return nil
+}
+
+// Processes the HISTORY opcode, the tracks are written to the chatlog oldest first
+func (c *Client) cmdHistory(m *ws.Message) error {
+	var tracks []ws.HistoryEntry
+	err := json.Unmarshal([]byte(m.Body), &tracks)
+	if err != nil {
+		return err
+	}
+
+	if len(tracks) == 0 {
+		gCtx.chatlog.Write([]byte(fmt.Sprintf("[red]%s <SERVER> INFO: No tracks played yet\n", ws.LocalTime(m.Timestamp))))
+		return nil
+	}
 
+	text := "HISTORY:\n"
+	for i := len(tracks) - 1; i >= 0; i-- {
+		t := tracks[i]
+		text += fmt.Sprintf("  %s %s", ws.LocalTime(t.StartedAt), t.Name)
+		if len(t.Artists) > 0 {
+			text += " - " + strings.Join(t.Artists, ", ")
+		}
+		text += fmt.Sprintf(" (%s's session)\n", t.Session)
+	}
+	gCtx.chatlog.Write([]byte(fmt.Sprintf("[red]%s <SERVER> %s", ws.LocalTime(m.Timestamp), text)))
+	return nil
+}
+
+// Processes the STATS opcode, the user's stats are written to the chatlog
+func (c *Client) cmdStats(m *ws.Message) error {
+	var s ws.Stats
+	err := json.Unmarshal([]byte(m.Body), &s)
+	if err != nil {
+		return err
+	}
+
+	listened := (time.Duration(s.Listened) * time.Millisecond).Round(time.Minute)
+	text := fmt.Sprintf("STATS:\n  Listened for %s across %d tracks\n  Hosted %d sessions and joined %d\n",
+		listened, s.Tracks, s.SessionsHosted, s.SessionsJoined)
+	text += statsList("Top artists", s.TopArtists)
+	text += statsList("Top tracks", s.TopTracks)
+	text += statsList("Listened most with", s.TopListeners)
+	gCtx.chatlog.Write([]byte(fmt.Sprintf("[red]%s <SERVER> %s", ws.LocalTime(m.Timestamp), text)))
+	return nil
+}
+
+// Formats the counts as a list under the title, nothing is returned if there aren't any
+func statsList(title string, counts []ws.StatsCount) string {
+	if len(counts) == 0 {
+		return ""
+	}
+	text := "  " + title + ":\n"
+	for i, c := range counts {
+		text += fmt.Sprintf("    %d. %s (%d)\n", i+1, c.Name, c.Count)
+	}
+	return text
+}
+
+// Processes the SAVE opcode, the session's tracks were saved to a playlist
+func (c *Client) cmdSave(m *ws.Message) error {
+	text := fmt.Sprintf("INFO: %s\n", m.Body)
+	if len(m.Args) > 0 {
+		text = fmt.Sprintf("INFO: %s (%s)\n", m.Body, m.Args[0])
+	}
+	gCtx.chatlog.Write([]byte(fmt.Sprintf("[red]%s <SERVER> %s", ws.LocalTime(m.Timestamp), text)))
 	return nil
 }
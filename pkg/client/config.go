@@ -3,6 +3,7 @@ package client
 import (
 	"encoding/json"
 	"os"
+	"path/filepath"
 )
 
 // Global config var to be passed around
@@ -11,29 +12,67 @@ var details *Config
 // Config details used to connect to the server which are saved to become persistent
 type Config struct {
 	Username string `json:"username"`
-	Password string `json:"password"`
+	Password string `json:"-"` // Never saved to the config file
 	Address  string `json:"address"`
 	AdminKey string `json:"admin_key"`
 	UseSSL   string `json:"use_ssl"`
+	Encoding string `json:"encoding"` // Message encoding, one of "msgpack", "cbor", "json" or blank to let the server choose
+	CAFile   string `json:"ca_file"`  // Certificate authorities to trust when using SSL, e.g. the server's self-signed certificate
 }
 
-// Saves the config file
+// Returns the path of the config file in the config dir
+func configPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.json"), nil
+}
+
+// Saves the config file, it's only readable by the user since it can hold the admin key
 func saveConfig(c *Config) error {
-	file, err := os.OpenFile("config.json", os.O_CREATE|os.O_RDWR, os.ModePerm)
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	return json.NewEncoder(file).Encode(c)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(file).Encode(c)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
 }
 
-// Loads the config file
+// Loads the config file, the config file the client used to keep in the working dir
+// is moved to the config dir first if it exists. An empty config is returned if there
+// isn't a config file yet
 func openConfig() (*Config, error) {
-	file, err := os.OpenFile("config.json", os.O_CREATE|os.O_RDWR, os.ModePerm)
+	path, err := configPath()
 	if err != nil {
 		return nil, err
 	}
+	moved, err := migrateFile(legacyConfigFile, path)
+	if err != nil {
+		Log.Printf("Failed moving %s to %s: %s", legacyConfigFile, path, err)
+	} else if moved {
+		Log.Printf("Moved %s to %s", legacyConfigFile, path)
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &Config{}, nil
+	} else if err != nil {
+		return nil, err
+	}
 	defer file.Close()
 
 	var config Config
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// Name of the client's dirs within the config and state dirs
+const appDir = "spotify-sync"
+
+// Files the client used to keep in the working dir, they're moved into the new dirs
+const (
+	legacyConfigFile = "config.json"
+	legacyLogFile    = "client.log"
+)
+
+// Returns the dir the client's config is kept in, $XDG_CONFIG_HOME/spotify-sync (~/.config/spotify-sync)
+// on linux and the platform's equivalent elsewhere, e.g. %AppData%\spotify-sync on windows
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, appDir), nil
+}
+
+// Returns the dir the client's logs are kept in, $XDG_STATE_HOME/spotify-sync (~/.local/state/spotify-sync)
+// on linux. Windows and macOS have no state dir so the platform's cache dir is used instead
+func stateDir() (string, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, appDir), nil
+	}
+
+	switch runtime.GOOS {
+	case "windows", "darwin", "ios", "plan9":
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, appDir), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "state", appDir), nil
+}
+
+// Moves a file the client used to keep in the working dir to its new path, nothing is moved if there's
+// no old file or the new file already exists. The moved file is only readable by the user since the
+// config can hold the admin key. Returns whether the file was moved
+func migrateFile(oldPath, newPath string) (bool, error) {
+	_, err := os.Stat(newPath)
+	if err == nil || !os.IsNotExist(err) {
+		return false, err
+	}
+	_, err = os.Stat(oldPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(newPath), 0700)
+	if err != nil {
+		return false, err
+	}
+	if os.Rename(oldPath, newPath) == nil {
+		return true, os.Chmod(newPath, 0600)
+	}
+
+	// Renaming fails across filesystems so the file is copied instead
+	err = copyFile(oldPath, newPath)
+	if err != nil {
+		return false, err
+	}
+	return true, os.Remove(oldPath)
+}
+
+// Copies the file to the new path, which is only readable by the user
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
@@ -3,10 +3,14 @@ package client
 import (
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
+	"strings"
 	"sync"
 )
 
-var useSSL bool
+// Message encodings the user can choose from and their labels in the
+// login form, a blank encoding lets the server choose its preferred one
+var encodings = []string{"", "msgpack", "cbor", "json"}
+var encodingLabels = []string{"Auto", "MessagePack", "CBOR", "JSON"}
 
 var gMtx = sync.Mutex{} // Mutex used to sync the gui (mainly for writing to the textview)
 var gCtx *guiCtx        // Gui context used by the client (to avoid passing it around everywhere)
@@ -14,6 +18,7 @@ var gCtx *guiCtx        // Gui context used by the client (to avoid passing it a
 // Gui context used by the client
 type guiCtx struct {
 	chatlog, users *tview.TextView
+	account        *tview.TextView // Shows the server's replies on the account settings page
 	pages          *tview.Pages
 	app            *tview.Application
 }
@@ -41,6 +46,7 @@ func (c *Client) createGUI() *tview.Application {
 	text.SetDynamicColors(true)
 	input := tview.NewInputField()
 	input.SetFieldBackgroundColor(tcell.ColorBlack)
+	input.SetPlaceholder("Type help for commands, F2 for account settings")
 
 	grid := tview.NewGrid().
 		SetRows(9, 0, 1).
@@ -75,6 +81,14 @@ func (c *Client) createGUI() *tview.Application {
 			pages.SwitchToPage("login")
 		})
 
+	// Registering without an invite code modal
+	noInviteCodeModal := tview.NewModal().
+		SetText("An invite code from the server's admin is needed to register").
+		AddButtons([]string{"Ok"}).
+		SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+			pages.SwitchToPage("login")
+		})
+
 	// Request successful
 	requestSuccededModal := tview.NewModal().
 		SetText("Request succeded").
@@ -83,6 +97,93 @@ func (c *Client) createGUI() *tview.Application {
 			pages.SwitchToPage("login")
 		})
 
+	// The account settings page, replies from the server are shown below the form
+	var currentPassword, newPassword, confirmPassword string
+	accountStatus := tview.NewTextView().SetDynamicColors(true)
+	accountStatus.SetBorder(true).SetTitle("Account")
+	accountForm := tview.NewForm().
+		AddPasswordField("Current Password:", "", 20, '*', func(text string) { currentPassword = text }).
+		AddPasswordField("New Password:", "", 20, '*', func(text string) { newPassword = text }).
+		AddPasswordField("Confirm Password:", "", 20, '*', func(text string) { confirmPassword = text })
+	accountForm.SetBorder(true)
+	account := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(accountForm, 0, 1, true).
+		AddItem(accountStatus, 5, 0, false)
+
+	// Clears the password fields so they don't linger once used
+	clearPasswords := func() {
+		for _, label := range []string{"Current Password:", "New Password:", "Confirm Password:"} {
+			accountForm.GetFormItemByLabel(label).(*tview.InputField).SetText("")
+		}
+	}
+
+	// Button for changing the user's password, the server replies with PASSWD on success
+	accountForm.AddButton("Change Password", func() {
+		if newPassword != confirmPassword {
+			accountStatus.SetText("New passwords don't match")
+			return
+		}
+		if currentPassword == "" || newPassword == "" {
+			accountStatus.SetText("Enter your current and new password")
+			return
+		}
+		err := c.conn.ChangePassword(currentPassword, newPassword)
+		clearPasswords()
+		if err != nil {
+			Log.Println("Failed to change password:", err)
+			accountStatus.SetText("Failed to change password")
+		}
+	})
+
+	// Button for asking the server who the user is logged in as
+	accountForm.AddButton("Who Am I", func() {
+		err := c.conn.WhoAmI()
+		if err != nil {
+			Log.Println("Failed to send WHOAMI:", err)
+		}
+	})
+
+	// Button for unlinking the user's spotify account, confirmed first since the user is disconnected
+	accountForm.AddButton("Unlink Spotify", func() {
+		pages.SwitchToPage("unlinkConfirm")
+	})
+
+	// Button for going back to the chat screen
+	accountForm.AddButton("Back", func() {
+		clearPasswords()
+		pages.SwitchToPage("spotify")
+	})
+
+	// Unlink spotify confirmation modal
+	unlinkConfirmModal := tview.NewModal().
+		SetText("Unlink your spotify account? You'll be disconnected and asked to authorise spotify again the next time you connect").
+		AddButtons([]string{"Unlink", "Cancel"}).
+		SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+			if buttonLabel != "Unlink" {
+				pages.SwitchToPage("account")
+				return
+			}
+			err := c.conn.Unlink()
+			if err != nil {
+				Log.Println("Failed to unlink spotify:", err)
+				pages.SwitchToPage("account")
+			}
+		})
+
+	// Opens the account settings page from the chat screen
+	input.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() != tcell.KeyF2 {
+			return event
+		}
+		accountStatus.Clear()
+		pages.SwitchToPage("account")
+		err := c.conn.WhoAmI()
+		if err != nil {
+			Log.Println("Failed to send WHOAMI:", err)
+		}
+		return nil
+	})
+
 	// Load the config
 	var err error
 	details, err = openConfig()
@@ -93,24 +194,23 @@ func (c *Client) createGUI() *tview.Application {
 		details = &Config{}
 	}
 
-	// The login page
-	var address string
-	var username string
-	var password string
+	// The login page, the invite code is only used when registering
+	var password, inviteCode string
 
 	form := tview.NewForm().
-		AddInputField("Username:", "", 20, nil, func(text string) { username = text; details.Username = text }).
+		AddInputField("Username:", "", 20, nil, func(text string) { details.Username = text }).
 		AddInputField("Password:", "", 20, nil, func(text string) { password = text; details.Password = password }).
-		AddInputField("Address:", "", 20, nil, func(text string) { address = text; details.Address = text; c.changeAddress(address) }).
+		AddInputField("Address:", "", 20, nil, func(text string) { details.Address = text }).
 		AddCheckbox("Use SSL:", true, func(checked bool) {
-			useSSL = checked
 			if checked {
 				details.UseSSL = "true"
 			} else {
 				details.UseSSL = "false"
 			}
-			c.changeAddress(address)
-		})
+		}).
+		AddDropDown("Encoding:", encodingLabels, 0, func(option string, index int) { details.Encoding = encodings[index] }).
+		AddInputField("CA File:", "", 20, nil, func(text string) { details.CAFile = text }).
+		AddInputField("Invite Code:", "", 20, nil, func(text string) { inviteCode = text })
 	form.GetFormItemByLabel("Password:").(*tview.InputField).SetMaskCharacter('*')
 	form.SetBorder(true)
 
@@ -131,19 +231,51 @@ func (c *Client) createGUI() *tview.Application {
 	inputField = form.GetFormItemByLabel("Address:").(*tview.InputField)
 	if details.Address != "" {
 		inputField.SetText(details.Address)
-		c.changeAddress(details.Address)
+	}
+	inputField = form.GetFormItemByLabel("CA File:").(*tview.InputField)
+	if details.CAFile != "" {
+		inputField.SetText(details.CAFile)
+	}
+	inputDropDown := form.GetFormItemByLabel("Encoding:").(*tview.DropDown)
+	for i, e := range encodings {
+		if e == details.Encoding {
+			inputDropDown.SetCurrentOption(i)
+		}
 	}
 
-	// Button for connecting the user to the server
-	form.AddButton("Connect", func() {
+	// Connects the user to the server, registering them first if the invite code is given
+	connect := func(inviteCode string) {
 		// Save the config when connecting
 		err := saveConfig(details)
 		if err != nil {
 			Log.Println("Failed to save config:", err)
 		}
 
+		// Creates the gui context used by the client
+		gCtx = &guiCtx{
+			chatlog: text,
+			users:   users,
+			account: accountStatus,
+			app:     app,
+			pages:   pages,
+		}
+
+		// Binds the input bar to send messages to the server on "Enter" keypress
+		input.SetDoneFunc(func(key tcell.Key) {
+			if key == tcell.KeyEnter {
+				// Passwords aren't echoed to the chatlog
+				echo := input.GetText()
+				if strings.HasPrefix(strings.ToUpper(echo), "PASSWD,") {
+					echo = echo[:len("PASSWD,")] + "***"
+				}
+				writeText("[#343434]>> " + echo + "\n")
+				c.writeMsg(input.GetText())
+				input.SetText("")
+			}
+		})
+
 		// Attempt to connect
-		err = c.connect()
+		err = c.connect(inviteCode)
 		if err != nil {
 			// Show it failed on the GUI
 			Log.Println("Failed to connect:", err)
@@ -152,30 +284,19 @@ func (c *Client) createGUI() *tview.Application {
 			// On success the user is moved to the chat screen
 			Log.Println("Successful connection")
 			pages.SwitchToPage("spotify")
+		}
+	}
 
-			// Binds the input bar to send messages to the server on "Enter" keypress
-			input.SetDoneFunc(func(key tcell.Key) {
-				if key == tcell.KeyEnter {
-					writeText("[#343434]>> " + input.GetText() + "\n")
-					c.writeMsg(input.GetText())
-					input.SetText("")
-				}
-			})
-
-			// Creates the gui context used by the client
-			gCtx = &guiCtx{
-				chatlog: text,
-				users:   users,
-				app:     app,
-				pages:   pages,
-			}
-
-			// Listen for incoming messages
-			go c.readPump()
+	// Button for connecting the user to the server
+	form.AddButton("Connect", func() { connect("") })
 
-			// Handle shutdown
-			go c.handleShutdown()
+	// Button for registering a new account with an invite code and connecting to the server
+	form.AddButton("Register", func() {
+		if inviteCode == "" {
+			pages.SwitchToPage("noInviteCode")
+			return
 		}
+		connect(inviteCode)
 	})
 
 	// Button for quitting the app
@@ -192,8 +313,11 @@ func (c *Client) createGUI() *tview.Application {
 	// Add each page to the pages object to enable switching to different screens
 	pages.AddPage("login", form, true, true)
 	pages.AddPage("spotify", grid, true, false)
+	pages.AddPage("account", account, true, false)
+	pages.AddPage("unlinkConfirm", unlinkConfirmModal, true, false)
 	pages.AddPage("badConnection", badConnectionModal, true, false)
 	pages.AddPage("requestFailed", requestFailedModal, true, false)
+	pages.AddPage("noInviteCode", noInviteCodeModal, true, false)
 	pages.AddPage("requestSucceded", requestSuccededModal, true, false)
 	pages.AddPage("disconnected", disconnectedModal, true, false)
 	app.SetRoot(pages, true).EnableMouse(true)
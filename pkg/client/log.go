@@ -1,18 +1,39 @@
 package client
 
 import (
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 )
 
-var Log *log.Logger = CreateLogger()
+// Logs of the client, nothing is logged until the client runs and creates its log file
+var Log = log.New(ioutil.Discard, "", 0)
 
-// Creates the logger which writes to a log file
-func CreateLogger() *log.Logger {
-	f, err := os.OpenFile("client.log", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+// Creates the logger which writes to client.log in the state dir, the log file
+// the client used to keep in the working dir is moved there if it exists
+func CreateLogger() (*log.Logger, error) {
+	dir, err := stateDir()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	path := filepath.Join(dir, "client.log")
+	moved, migrateErr := migrateFile(legacyLogFile, path)
 
-	return log.New(f, "", log.Ldate|log.Ltime|log.Lshortfile)
-}
\ No newline at end of file
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	l := log.New(f, "", log.Ldate|log.Ltime|log.Lshortfile)
+	if migrateErr != nil {
+		l.Printf("Failed moving %s to %s: %s", legacyLogFile, path, migrateErr)
+	} else if moved {
+		l.Printf("Moved %s to %s", legacyLogFile, path)
+	}
+	return l, nil
+}
@@ -3,34 +3,22 @@ package client
 import (
 	"errors"
 	"fmt"
+	"github.com/fiwippi/spotify-sync/pkg/sdk"
 	ws "github.com/fiwippi/spotify-sync/pkg/shared"
 	"strings"
+	"time"
 )
 
 //// READING MESSAGES
 
-// Reads messages from the connection and processes them
-func (c *Client) readPump() {
-	var msg ws.Message
-	for {
-		// Retrieve the ws.Message struct from the connection
-		err := c.conn.ReadJSON(&msg)
-		Log.Printf("Incoming Message: %+v\n", msg)
-		if err != nil {
-			// Error here means the connection is closed
-			Log.Println(fmt.Sprintf("read: %s", err.Error()))
-
-			// Causes disconnect handling to occur
-			c.notifyDone()
-
-			return
-		}
-
-		// Process the struct and call the appropriate command
-		err = c.processMsg(msg)
+// Reads events from the connection and processes them,
+// the channel is closed once the connection closes
+func (c *Client) readPump(events <-chan sdk.Event) {
+	for e := range events {
+		// Process the event and call the appropriate command
+		err := c.processEvent(e)
 		if err != nil {
 			Log.Printf("processing: %s", err.Error())
-			return
 		}
 
 		// Redraws the gui to show changes
@@ -38,31 +26,39 @@ func (c *Client) readPump() {
 	}
 }
 
-// Processes messages and calls the relevant function
-func (c *Client) processMsg(m ws.Message) error {
-	var err error
+// Processes events and calls the relevant function
+func (c *Client) processEvent(e sdk.Event) error {
+	m := e.Message
 
-	if !ws.OPCODES.Has(m.Op) {
-		return errors.New("Opcode doesn't exist")
-	}
-
-	switch cmd := m.Op; cmd {
+	switch e.Type {
 	case "AUTH":
-		err = c.cmdAuth(&m)
+		return c.cmdAuth(&m)
 	case "INFO":
-		err = c.cmdInfo(&m)
-	case "LOGIN":
-		err = c.cmdLogin()
+		return c.cmdInfo(&m)
 	case "USERS":
-		err = c.cmdUsers(&m)
+		return c.cmdUsers(&m)
 	case "MSG":
-		err = c.cmdMsg(&m)
+		return c.cmdMsg(&m)
+	case "TIME":
+		return c.cmdTime(&m)
+	case "HISTORY":
+		return c.cmdHistory(&m)
+	case "SAVE":
+		return c.cmdSave(&m)
+	case "STATS":
+		return c.cmdStats(&m)
+	case "PASSWD":
+		return c.cmdPasswd(&m)
+	case "WHOAMI":
+		return c.cmdWhoami(&m)
+	case sdk.EventReconnecting:
+		writeText(fmt.Sprintf("[red]%s <CLIENT> %s\n", time.Now().Format("15:04:05"), m.Body))
+	case sdk.EventReconnected:
+		writeText(fmt.Sprintf("[red]%s <CLIENT> Reconnected, resuming connection\n", time.Now().Format("15:04:05")))
+	case "LOGIN", "RESUME", sdk.EventClosed:
+		// Handled by the connection
 	default:
-		Log.Printf("Could not process msg: %+v\n", m)
-	}
-
-	if err != nil {
-		return err
+		Log.Printf("Could not process event: %+v\n", e)
 	}
 	return nil
 }
@@ -87,45 +83,33 @@ func (c *Client) writeMsg(text string) {
 	}
 
 	// Generate the message and send it
-	msg, err := c.buildMsg(sections)
-	if err != nil {
-		Log.Printf("write: %s", err.Error())
-		return
-	}
-
-	// Sends the message over the websocket connection
-	err = c.conn.WriteJSON(msg)
+	err := c.sendMsg(sections)
 	if err != nil {
 		Log.Printf("write: %s", err.Error())
 		return
 	}
 }
 
-// Converts the input text from the end user into the message struct
-// for sending to the server. Also processes client-side opcodes, i.e. exit/quit
-func (c *Client) buildMsg(sections []string) (ws.Message, error) {
+// Converts the input text from the end user into a message and sends it to
+// the server. Also processes client-side opcodes, i.e. exit/quit
+func (c *Client) sendMsg(sections []string) error {
 	// Ensures the opcode is valid
 	op := strings.ToUpper(sections[0])
 	if !ws.OPCODES.Has(op) {
-		return ws.Message{}, errors.New("Opcode doesn't exist")
-	}
-
-	// Builds the message
-	msg := ws.Message{
-		Op:        op,
-		Args:      nil,
-		Body:      strings.Join(sections[1:], ","),
-		Timestamp: ws.CurrentTime(),
+		return errors.New("Opcode doesn't exist")
 	}
+	body := strings.Join(sections[1:], ",")
 
 	// Processes client side opcodes
 	switch op {
-	case "EXIT":
-		Log.Println("Sending struct to done channel due to EXIT opcode")
-		c.notifyDone()
-	case "QUIT":
-		Log.Println("Sending struct to done channel due to QUIT opcode")
-		c.notifyDone()
+	case "EXIT", "QUIT":
+		Log.Printf("Closing connection due to %s opcode\n", op)
+		c.disconnect()
+		return nil
+	case "TIME":
+		c.showTime = true
+		return c.conn.SyncClock()
 	}
-	return msg, nil
+
+	return c.conn.Send(op, body)
 }
@@ -0,0 +1,34 @@
+package conformance
+
+import (
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"testing"
+)
+
+// Replays the built-in transcripts against an in-process server with each encoding, the
+// server keeps its state in globals so the replays run one at a time rather than in parallel
+func TestBuiltin(t *testing.T) {
+	if testing.Short() {
+		t.Skip("replaying transcripts takes several seconds")
+	}
+
+	transcripts, err := Builtin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transcripts) == 0 {
+		t.Fatal("no built-in transcripts")
+	}
+
+	for _, tr := range transcripts {
+		for _, e := range []string{"json", "msgpack", "cbor"} {
+			tr, e := tr, e
+			t.Run(tr.Name+"/"+e, func(t *testing.T) {
+				err := ReplayInProcess(tr, e, store.Memory)
+				if err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
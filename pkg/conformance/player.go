@@ -0,0 +1,195 @@
+package conformance
+
+import (
+	"github.com/fiwippi/spotify-sync/pkg/server"
+	"github.com/zmb3/spotify"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Fake spotify player whose state is changed by the transcript and by the server
+type fakePlayer struct {
+	mutex     sync.Mutex
+	name      string                      // Name of the user who owns the player
+	state     spotify.PlayerState         // Current state of the player
+	catalog   *catalog                    // Names of the tracks seen so far
+	playlists map[spotify.ID][]spotify.ID // Tracks of the playlists created by the server
+}
+
+// Maps track URIs to their names, the server only sends URIs when changing
+// tracks so the names are remembered from the states set by the transcript
+type catalog struct {
+	mutex sync.Mutex
+	names map[spotify.URI]string
+}
+
+// Fake players for every user on an in-process server
+type fakePlayers struct {
+	mutex   sync.Mutex
+	players map[string]*fakePlayer
+	catalog *catalog
+}
+
+func newFakePlayers() *fakePlayers {
+	return &fakePlayers{
+		players: make(map[string]*fakePlayer),
+		catalog: &catalog{names: make(map[spotify.URI]string)},
+	}
+}
+
+// Returns the user's player, creating it with an active device if it doesn't exist
+func (f *fakePlayers) get(name string) *fakePlayer {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	p, ok := f.players[name]
+	if !ok {
+		p = &fakePlayer{name: name, catalog: f.catalog}
+		p.state.Device = activeDevice
+		f.players[name] = p
+	}
+	return p
+}
+
+// Used by the server to give users their player
+func (f *fakePlayers) player(name string) server.Player {
+	return f.get(name)
+}
+
+// Device all fake players play from
+var activeDevice = spotify.PlayerDevice{ID: "fake", Active: true, Name: "Fake Player", Type: "Computer"}
+
+// Creates the track for a URI
+func (c *catalog) track(uri spotify.URI) *spotify.FullTrack {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	id := string(uri)
+	if i := strings.LastIndex(id, ":"); i != -1 {
+		id = id[i+1:]
+	}
+
+	var t spotify.FullTrack
+	t.ID = spotify.ID(id)
+	t.URI = uri
+	t.Name = c.names[uri]
+	return &t
+}
+
+func (c *catalog) add(uri spotify.URI, name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.names[uri] = name
+}
+
+func (p *fakePlayer) CurrentUser() (*spotify.PrivateUser, error) {
+	var u spotify.PrivateUser
+	u.ID = p.name
+	u.DisplayName = p.name
+	return &u, nil
+}
+
+func (p *fakePlayer) PlayerState() (*spotify.PlayerState, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	state := p.state
+	return &state, nil
+}
+
+func (p *fakePlayer) Pause() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.state.Playing = false
+	return nil
+}
+
+func (p *fakePlayer) Seek(position int) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.state.Progress = position
+	return nil
+}
+
+func (p *fakePlayer) PlayOpt(opt *spotify.PlayOptions) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if opt != nil && len(opt.URIs) > 0 {
+		p.state.Item = p.catalog.track(opt.URIs[0])
+		p.state.Progress = opt.PositionMs
+	}
+	p.state.Playing = true
+	return nil
+}
+
+func (p *fakePlayer) CreatePlaylistForUser(userID, playlistName, description string, public bool) (*spotify.FullPlaylist, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.playlists == nil {
+		p.playlists = make(map[spotify.ID][]spotify.ID)
+	}
+	id := spotify.ID("playlist" + strconv.Itoa(len(p.playlists)+1))
+	p.playlists[id] = nil
+
+	var pl spotify.FullPlaylist
+	pl.ID = id
+	pl.URI = spotify.URI("spotify:playlist:" + string(id))
+	pl.Name = playlistName
+	return &pl, nil
+}
+
+func (p *fakePlayer) AddTracksToPlaylist(playlistID spotify.ID, trackIDs ...spotify.ID) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, ok := p.playlists[playlistID]; !ok {
+		return "", spotify.Error{Message: "Playlist not found", Status: 404}
+	}
+	p.playlists[playlistID] = append(p.playlists[playlistID], trackIDs...)
+	return "snapshot", nil
+}
+
+// Changes the player's state, fields which aren't set are left as they are
+func (p *fakePlayer) set(s *PlayerState) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if s.Playing != nil {
+		p.state.Playing = *s.Playing
+	}
+	if s.URI != "" {
+		p.catalog.add(spotify.URI(s.URI), s.Name)
+		p.state.Item = p.catalog.track(spotify.URI(s.URI))
+	}
+	if s.Progress != nil {
+		p.state.Progress = *s.Progress
+	}
+	if s.NoDevice {
+		p.state.Device = spotify.PlayerDevice{}
+	} else {
+		p.state.Device = activeDevice
+	}
+}
+
+// Whether the player's state matches the expected state, only the set fields are checked
+func (p *fakePlayer) matches(s *PlayerState) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if s.Playing != nil && p.state.Playing != *s.Playing {
+		return false
+	}
+	if s.URI != "" && (p.state.Item == nil || string(p.state.Item.URI) != s.URI) {
+		return false
+	}
+	if s.Progress != nil && p.state.Progress != *s.Progress {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,425 @@
+package conformance
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fiwippi/spotify-sync/pkg/server"
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// How long to wait for the server to send an expected message or reach an expected state
+var Timeout = 5 * time.Second
+
+// Options used when replaying a transcript
+type Options struct {
+	Address  string // Address of the server e.g. localhost:8096
+	AdminKey string // Admin key used to create a temporary admin token which creates the transcript's users
+	Encoding string // Message encoding, one of "msgpack", "cbor" or "json"
+}
+
+// Matches references to captured values
+var captureRef = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// Replays a transcript against a server
+type replayer struct {
+	t       *Transcript
+	opts    Options
+	conns   map[string]*websocket.Conn // Open connections by name
+	codecs  map[string]ws.Codec        // Codecs of the open connections by name
+	vars    map[string]string          // Values captured from messages
+	players *fakePlayers               // Fake players, nil if the server isn't in-process
+	token   string                     // Admin token used to create users
+}
+
+// Replays the transcript against the running server at the address, player steps
+// are not supported since the server's spotify players can't be controlled
+func Replay(t *Transcript, opts Options) error {
+	r := &replayer{
+		t:      t,
+		opts:   opts,
+		conns:  make(map[string]*websocket.Conn),
+		codecs: make(map[string]ws.Codec),
+		vars:   make(map[string]string),
+	}
+	return r.run()
+}
+
+// Replays the transcript against a fresh in-process server whose users have fake spotify players,
+// the server's db is stored with the driver in a temporary dir which is removed afterwards
+func ReplayInProcess(t *Transcript, encoding, driver string) error {
+	dir, err := ioutil.TempDir("", "spotify-sync-conformance")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	players := newFakePlayers()
+	handler, shutdown, err := server.NewHandler(server.Options{
+		AdminKey: "conformance",
+		DBDriver: driver,
+		DBPath:   store.Path(driver, dir),
+		Refresh:  50 * time.Millisecond,
+		Players:  players.player,
+	})
+	if err != nil {
+		return err
+	}
+	defer shutdown()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	r := &replayer{
+		t:       t,
+		opts:    Options{Address: l.Addr().String(), AdminKey: "conformance", Encoding: encoding},
+		conns:   make(map[string]*websocket.Conn),
+		codecs:  make(map[string]ws.Codec),
+		vars:    make(map[string]string),
+		players: players,
+	}
+	return r.run()
+}
+
+// Creates the users and replays each step, all connections are closed once finished
+func (r *replayer) run() error {
+	defer func() {
+		for _, conn := range r.conns {
+			conn.Close()
+		}
+	}()
+
+	if len(r.t.Users) > 0 || len(r.t.Invites) > 0 {
+		name, err := r.createToken()
+		if err != nil {
+			return fmt.Errorf("creating admin token: %s", err)
+		}
+		defer r.revokeToken(name)
+	}
+	for _, u := range r.t.Users {
+		err := r.createUser(u)
+		if err != nil {
+			return fmt.Errorf("creating user %s: %s", u.Name, err)
+		}
+	}
+	for _, i := range r.t.Invites {
+		err := r.createInvite(i)
+		if err != nil {
+			return fmt.Errorf("creating invite %s: %s", i.Capture, err)
+		}
+	}
+
+	for i, s := range r.t.Steps {
+		err := r.step(&s)
+		if err != nil {
+			return fmt.Errorf("step %d: %s", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Sends a request to the admin api authorised with the bearer token
+func (r *replayer) post(route, bearer string, req interface{}, res interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest("POST", "http://"+r.opts.Address+route, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+bearer)
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+// Creates a short lived admin token which can create users and invites and returns its name
+func (r *replayer) createToken() (string, error) {
+	name, err := randomName()
+	if err != nil {
+		return "", err
+	}
+
+	var res struct {
+		ws.Response
+		Token string `json:"token"`
+	}
+	req := ws.TokenRequest{Name: name, Scopes: []string{"users:write"}, Expires: "10m"}
+	err = r.post("/api/create-token", r.opts.AdminKey, req, &res)
+	if err != nil {
+		return "", err
+	}
+	if !res.Success {
+		return "", errors.New(res.Error)
+	}
+	r.token = res.Token
+	return name, nil
+}
+
+// Revokes the admin token
+func (r *replayer) revokeToken(name string) {
+	var res ws.Response
+	_ = r.post("/api/revoke-token", r.opts.AdminKey, ws.TokenRequest{Name: name}, &res)
+}
+
+// Creates a user through the admin api
+func (r *replayer) createUser(u User) error {
+	var res ws.Response
+	err := r.post("/api/create-user", r.token, ws.Request{NewName: u.Name, NewPassword: u.Password}, &res)
+	if err != nil {
+		return err
+	}
+	if !res.Success {
+		return errors.New(res.Error)
+	}
+	return nil
+}
+
+// Creates an invite code through the admin api and captures it
+func (r *replayer) createInvite(i Invite) error {
+	var res struct {
+		ws.Response
+		Code string `json:"code"`
+	}
+	err := r.post("/api/create-invite", r.token, ws.InviteRequest{MaxUses: i.MaxUses, Expires: "10m"}, &res)
+	if err != nil {
+		return err
+	}
+	if !res.Success {
+		return errors.New(res.Error)
+	}
+	r.vars[i.Capture] = res.Code
+	return nil
+}
+
+// Generates a random name for the admin token
+func randomName() (string, error) {
+	b := make([]byte, 6)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return "conformance-" + hex.EncodeToString(b), nil
+}
+
+// Performs a single step
+func (r *replayer) step(s *Step) error {
+	switch {
+	case s.Action != "":
+		return r.action(s.Conn, s.Action)
+	case s.Send != nil:
+		return r.send(s.Conn, s.Send)
+	case len(s.Expect) > 0:
+		return r.expect(s.Conn, s.Expect)
+	case s.SetState != nil:
+		p, err := r.player(s.Player)
+		if err != nil {
+			return err
+		}
+		p.set(s.SetState)
+		return nil
+	case s.ExpectState != nil:
+		p, err := r.player(s.Player)
+		if err != nil {
+			return err
+		}
+		deadline := time.Now().Add(Timeout)
+		for !p.matches(s.ExpectState) {
+			if time.Now().After(deadline) {
+				state, _ := p.PlayerState()
+				return fmt.Errorf("player %s did not reach state %+v, state is %+v", s.Player, s.ExpectState, state)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil
+	default:
+		return errors.New("step has no action")
+	}
+}
+
+// Returns the fake player of a user
+func (r *replayer) player(name string) (*fakePlayer, error) {
+	if r.players == nil {
+		return nil, errors.New("player steps need an in-process server")
+	}
+	return r.players.get(name), nil
+}
+
+// Returns the subprotocols to offer the server for the encoding
+func subprotocols(encoding string) []string {
+	switch encoding {
+	case "msgpack":
+		return []string{ws.ProtocolMsgpack}
+	case "cbor":
+		return []string{ws.ProtocolCBOR}
+	default:
+		return []string{ws.ProtocolJSON}
+	}
+}
+
+// Performs an action on a connection
+func (r *replayer) action(name, action string) error {
+	conn, open := r.conns[name]
+	if action != "connect" && !open {
+		return fmt.Errorf("connection %s is not open", name)
+	}
+
+	switch action {
+	case "connect":
+		if open {
+			return fmt.Errorf("connection %s is already open", name)
+		}
+		dialer := *websocket.DefaultDialer
+		dialer.EnableCompression = true
+		dialer.Subprotocols = subprotocols(r.opts.Encoding)
+		conn, _, err := dialer.Dial("ws://"+r.opts.Address+"/shared", nil)
+		if err != nil {
+			return err
+		}
+		r.conns[name] = conn
+		r.codecs[name] = ws.CodecFor(conn)
+	case "close":
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		delete(r.conns, name)
+		return conn.Close()
+	case "drop":
+		delete(r.conns, name)
+		return conn.Close()
+	case "closed":
+		var msg ws.Message
+		_ = conn.SetReadDeadline(time.Now().Add(Timeout))
+		err := r.codecs[name].ReadMessage(conn, &msg)
+		if err == nil {
+			return fmt.Errorf("connection %s should be closed, received %+v", name, msg)
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return fmt.Errorf("connection %s should be closed but is still open", name)
+		}
+		delete(r.conns, name)
+		return conn.Close()
+	default:
+		return fmt.Errorf("unknown action %s", action)
+	}
+	return nil
+}
+
+// Sends a message over a connection
+func (r *replayer) send(name string, m *ws.Message) error {
+	conn, open := r.conns[name]
+	if !open {
+		return fmt.Errorf("connection %s is not open", name)
+	}
+
+	msg := ws.Message{
+		Op:        m.Op,
+		Body:      r.expand(m.Body),
+		Timestamp: ws.CurrentTime(),
+	}
+	for _, a := range m.Args {
+		msg.Args = append(msg.Args, r.expand(a))
+	}
+	return r.codecs[name].WriteMessage(conn, &msg)
+}
+
+// Replaces references to captured values with the values
+func (r *replayer) expand(s string) string {
+	return captureRef.ReplaceAllStringFunc(s, func(ref string) string {
+		return r.vars[captureRef.FindStringSubmatch(ref)[1]]
+	})
+}
+
+// Reads the next messages from the connection, each one must match a different expectation
+func (r *replayer) expect(name string, expected []Expectation) error {
+	conn, open := r.conns[name]
+	if !open {
+		return fmt.Errorf("connection %s is not open", name)
+	}
+
+	remaining := append([]Expectation(nil), expected...)
+	for len(remaining) > 0 {
+		var msg ws.Message
+		_ = conn.SetReadDeadline(time.Now().Add(Timeout))
+		err := r.codecs[name].ReadMessage(conn, &msg)
+		if err != nil {
+			return fmt.Errorf("waiting for %s on %s: %s", describe(remaining), name, err)
+		}
+
+		found := false
+		for i, e := range remaining {
+			if e.matches(&msg) {
+				if e.Capture != "" {
+					r.vars[e.Capture] = msg.Body
+				}
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unexpected message on %s %+v, expected %s", name, msg, describe(remaining))
+		}
+	}
+	return nil
+}
+
+// Whether the message matches the expectation
+func (e *Expectation) matches(m *ws.Message) bool {
+	if e.Op != m.Op {
+		return false
+	}
+	if e.Body != nil && *e.Body != m.Body {
+		return false
+	}
+	if e.Args != nil {
+		if len(e.Args) != len(m.Args) {
+			return false
+		}
+		for i, a := range e.Args {
+			if a != "*" && a != m.Args[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Describes the expectations for error messages
+func describe(expected []Expectation) string {
+	var s []string
+	for _, e := range expected {
+		d := e.Op
+		if e.Body != nil {
+			d += fmt.Sprintf(" %q", *e.Body)
+		}
+		if e.Args != nil {
+			d += fmt.Sprintf(" %v", e.Args)
+		}
+		s = append(s, d)
+	}
+	return "[" + strings.Join(s, ", ") + "]"
+}
@@ -0,0 +1,125 @@
+// Package conformance replays recorded transcripts of websocket messages against a server to
+// check it follows the spotify sync protocol. Transcripts are JSON files listing the messages
+// each client sends and the messages the server must reply with, they can be replayed against
+// an in-process server with fake spotify players or against any running server.
+package conformance
+
+import (
+	"embed"
+	"encoding/json"
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"io/fs"
+	"os"
+	"path"
+)
+
+// Transcripts which ship with the conformance suite
+//go:embed transcripts/*.json
+var builtin embed.FS
+
+// A recorded sequence of client->server and server->client messages
+type Transcript struct {
+	Name        string   `json:"name"`        // Name of the transcript, defaults to its file name
+	Description string   `json:"description"` // What the transcript checks
+	Users       []User   `json:"users"`       // Users created before the transcript is replayed
+	Invites     []Invite `json:"invites"`     // Invite codes created before the transcript is replayed
+	Steps       []Step   `json:"steps"`       // Steps replayed in order
+}
+
+// Account created on the server before replaying
+type User struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// Invite code created on the server before replaying, the code is captured
+// under the given name so steps can register with it using ${name}
+type Invite struct {
+	Capture string `json:"capture"`
+	MaxUses int    `json:"max_uses"` // How many users can register with the code, unlimited if 0
+}
+
+// A single step of a transcript, only one of its actions should be set. Message bodies
+// and arguments which are sent can reference values captured earlier using ${name}
+type Step struct {
+	Conn   string        `json:"conn,omitempty"`   // Name of the connection the step acts on
+	Action string        `json:"action,omitempty"` // "connect", "close" (normal closure), "drop" (abnormal closure) or "closed" (server closed the connection)
+	Send   *ws.Message   `json:"send,omitempty"`   // Message the client sends to the server
+	Expect []Expectation `json:"expect,omitempty"` // Messages the server sends next, these may arrive in any order
+
+	Player      string       `json:"player,omitempty"`       // Name of the user whose fake player the step acts on
+	SetState    *PlayerState `json:"set_state,omitempty"`    // Changes the state of the player
+	ExpectState *PlayerState `json:"expect_state,omitempty"` // The player must reach this state
+}
+
+// A message the server must send, the opcode is always checked while the body and
+// arguments are only checked if they are set. Arguments of "*" match any value
+type Expectation struct {
+	Op      string   `json:"op"`
+	Body    *string  `json:"body,omitempty"`
+	Args    []string `json:"args,omitempty"`
+	Capture string   `json:"capture,omitempty"` // Stores the body under this name so it can be sent later
+}
+
+// State of a fake spotify player, when expecting a state only the set fields are checked
+type PlayerState struct {
+	Playing  *bool  `json:"playing,omitempty"`
+	URI      string `json:"uri,omitempty"`      // URI of the current track
+	Name     string `json:"name,omitempty"`     // Name of the current track
+	Progress *int   `json:"progress,omitempty"` // Progress into the track in milliseconds
+	NoDevice bool   `json:"no_device,omitempty"`
+}
+
+// Parses a transcript
+func Parse(data []byte) (*Transcript, error) {
+	var t Transcript
+	err := json.Unmarshal(data, &t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Loads a transcript from a file
+func Load(p string) (*Transcript, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	return parseNamed(data, p)
+}
+
+// Loads the transcripts which ship with the conformance suite
+func Builtin() ([]*Transcript, error) {
+	entries, err := fs.ReadDir(builtin, "transcripts")
+	if err != nil {
+		return nil, err
+	}
+
+	var transcripts []*Transcript
+	for _, e := range entries {
+		p := path.Join("transcripts", e.Name())
+		data, err := fs.ReadFile(builtin, p)
+		if err != nil {
+			return nil, err
+		}
+		t, err := parseNamed(data, p)
+		if err != nil {
+			return nil, err
+		}
+		transcripts = append(transcripts, t)
+	}
+	return transcripts, nil
+}
+
+// Parses a transcript, naming it after its file if it has no name
+func parseNamed(data []byte, p string) (*Transcript, error) {
+	t, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if t.Name == "" {
+		t.Name = path.Base(p)
+	}
+	return t, nil
+}
@@ -0,0 +1,55 @@
+package sdk
+
+import (
+	"errors"
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"strconv"
+	"time"
+)
+
+// Asks the server for its time so the clock offset can be estimated, once the reply
+// arrives the offset is updated and a TIME event is sent to subscribers
+func (c *Conn) SyncClock() error {
+	return c.Send("TIME", "", strconv.FormatInt(ws.EpochMillis(time.Now()), 10))
+}
+
+// Estimates the server's current time using the clock offset
+func (c *Conn) ServerTime() time.Time {
+	offset, _ := c.ClockOffset()
+	return time.Now().Add(offset)
+}
+
+// Returns the estimated difference between the server's clock and the client's
+// along with the round trip time measured when it was estimated
+func (c *Conn) ClockOffset() (offset, roundTrip time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.clockOffset, c.roundTrip
+}
+
+// Processes the TIME opcode. The server echoes back when the client sent the request along with
+// its own time, assuming the request and reply took equally long to travel the clock offset is
+// estimated as server - (sent + received) / 2
+func (c *Conn) processTime(m *ws.Message) error {
+	received := ws.EpochMillis(time.Now())
+	if len(m.Args) < 2 {
+		return errors.New("TIME message missing arguments")
+	}
+	sent, err := strconv.ParseInt(m.Args[0], 10, 64)
+	if err != nil {
+		return err
+	}
+	server, err := strconv.ParseInt(m.Args[1], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.roundTrip = time.Duration(received-sent) * time.Millisecond
+	c.clockOffset = time.Duration(server-(sent+received)/2) * time.Millisecond
+	c.mutex.Unlock()
+	c.log.Printf("Clock offset: %s, round trip: %s\n", c.clockOffset, c.roundTrip)
+
+	return nil
+}
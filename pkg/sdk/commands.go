@@ -0,0 +1,84 @@
+package sdk
+
+import (
+	"strconv"
+)
+
+// Creates a new session hosted by the user
+func (c *Conn) Create() error {
+	return c.Send("CREATE", "")
+}
+
+// Joins the session hosted by the given user
+func (c *Conn) Join(host string) error {
+	return c.Send("JOIN", host)
+}
+
+// Leaves the current session, if the user is hosting it then the session is closed
+func (c *Conn) Leave() error {
+	return c.Send("DISCONNECT", "")
+}
+
+// Asks for the ID of the current session, the server replies with an INFO message
+func (c *Conn) ID() error {
+	return c.Send("ID", "")
+}
+
+// Asks for the help message, the server replies with an INFO message
+func (c *Conn) Help() error {
+	return c.Send("HELP", "")
+}
+
+// Sends a chat message to the other users in the session
+func (c *Conn) SendChat(text string) error {
+	return c.Send("MSG", text)
+}
+
+// Asks for the latest tracks played in sessions the user was in, the server replies with a
+// HISTORY message whose body is a JSON array of ws.HistoryEntry, latest first. If n is 0
+// then the server's default number of tracks are sent
+func (c *Conn) History(n int) error {
+	if n == 0 {
+		return c.Send("HISTORY", "")
+	}
+	return c.Send("HISTORY", strconv.Itoa(n))
+}
+
+// Asks for the user's listening stats, the server replies with a STATS message whose body is ws.Stats as JSON
+func (c *Conn) Stats() error {
+	return c.Send("STATS", "")
+}
+
+// Saves the tracks played in the current session to a new private playlist in the user's spotify account,
+// the server's default name is used if name is empty. On success the server replies with a SAVE message whose
+// args are the playlist's URI. If the user hasn't given access to their playlists they're sent an AUTH message first
+func (c *Conn) SavePlaylist(name string) error {
+	return c.Send("SAVE", name)
+}
+
+// Asks who the user is logged in as, the server replies with a WHOAMI message
+// whose args are the username, spotify ID and session host
+func (c *Conn) WhoAmI() error {
+	return c.Send("WHOAMI", "")
+}
+
+// Changes the user's password, the server replies with a PASSWD message on success
+// (after which the new password is used to login) or an INFO message explaining why not
+func (c *Conn) ChangePassword(current, password string) error {
+	c.mutex.Lock()
+	c.newPassword = password
+	c.mutex.Unlock()
+
+	return c.Send("PASSWD", current+","+password)
+}
+
+// Unlinks the user's spotify account, the server then closes the connection and the
+// user has to authorise spotify again the next time they login. The connection isn't
+// resumed since the server ends it on purpose
+func (c *Conn) Unlink() error {
+	c.mutex.Lock()
+	c.resumeToken = ""
+	c.mutex.Unlock()
+
+	return c.Send("UNLINK", "")
+}
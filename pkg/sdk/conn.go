@@ -0,0 +1,349 @@
+// Package sdk implements the spotify sync client protocol without any user
+// interface so that bots, integrations and the terminal client can share it.
+package sdk
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Returned when using a connection which has been closed
+var ErrClosed = errors.New("connection closed")
+
+// Options used to connect to a spotify sync server
+type Options struct {
+	Address  string      // Address of the server e.g. spotify.site.net or localhost:8096
+	UseSSL   bool        // Whether to connect over wss instead of ws
+	Encoding string      // Message encoding, one of "msgpack", "cbor", "json" or blank to let the server choose
+	CAFile   string      // PEM file of certificate authorities to trust as well as the system's, e.g. a self-signed certificate
+	Logger   *log.Logger // Logs the connection's activity, nothing is logged if nil
+}
+
+// Connection to a spotify sync server. Messages from the server are delivered to subscribers,
+// login requests from the server are answered automatically and if the connection drops it's
+// reconnected and resumed without having to login again
+type Conn struct {
+	opts Options
+	url  url.URL
+	log  *log.Logger
+	tls  *tls.Config // Used to verify the server's certificate, nil uses the system's certificate authorities
+
+	mutex       sync.Mutex      // Locks writing to the websocket conn and the fields below
+	conn        *websocket.Conn // Websocket connection to the server
+	codec       ws.Codec        // Encodes messages in the format negotiated with the server
+	username    string          // Username used to login
+	password    string          // Password used to login
+	inviteCode  string          // Invite code used to register, only sent once
+	newPassword string          // Password which replaces the current one once the server changes it
+	loginWanted bool            // Whether the server asked for login details before they were given
+	resumeToken string          // Token which lets the connection be resumed if it drops
+	resumeGrace time.Duration   // How long the server holds the user's place after the connection drops
+	clockOffset time.Duration   // Estimated difference between the server's clock and the client's
+	roundTrip   time.Duration   // Round trip time of the last clock sync
+	closing     bool            // Whether the connection is being closed on purpose
+
+	subsMtx sync.Mutex      // Locks the subscribers
+	subs    []*subscription // Subscribers which receive events
+
+	ready     chan struct{} // Closed once the first handshake completes
+	readyOnce sync.Once
+	done      chan struct{} // Closed once the connection is closed for good
+	doneOnce  sync.Once
+	err       error // Why the connection closed
+}
+
+// Connects to a spotify sync server and starts reading messages from it,
+// the connection must be closed with Close once it's no longer needed
+func Dial(opts Options) (*Conn, error) {
+	scheme := "wss"
+	if !opts.UseSSL {
+		scheme = "ws"
+	}
+
+	c := &Conn{
+		opts:        opts,
+		url:         url.URL{Scheme: scheme, Host: opts.Address, Path: "/shared"},
+		log:         opts.Logger,
+		resumeGrace: 2 * time.Minute,
+		ready:       make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if c.log == nil {
+		c.log = log.New(ioutil.Discard, "", 0)
+	}
+	if opts.CAFile != "" {
+		var err error
+		c.tls, err = loadCAFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	go c.readPump()
+	return c, nil
+}
+
+// Returns a TLS config which trusts the certificate authorities in the
+// PEM file as well as the system's, this is used for self-signed certificates
+func loadCAFile(path string) (*tls.Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("no certificates found in CA file " + path)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// Returns the subprotocols to offer the server, if an encoding was chosen only that
+// one is offered, otherwise all of them are and the server picks its preferred one
+func (c *Conn) subprotocols() []string {
+	switch c.opts.Encoding {
+	case "msgpack":
+		return []string{ws.ProtocolMsgpack}
+	case "cbor":
+		return []string{ws.ProtocolCBOR}
+	case "json":
+		return []string{ws.ProtocolJSON}
+	default:
+		return ws.Subprotocols
+	}
+}
+
+// Dials the websocket connection to the server
+func (c *Conn) dial() error {
+	c.log.Println("Dialing to:", c.url.String())
+
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+	dialer.Subprotocols = c.subprotocols()
+	dialer.TLSClientConfig = c.tls
+	conn, _, err := dialer.Dial(c.url.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.conn = conn
+	c.codec = ws.CodecFor(conn)
+	c.mutex.Unlock()
+	c.log.Println("Negotiated subprotocol:", conn.Subprotocol())
+	return nil
+}
+
+// Logs in with the given credentials and waits until the handshake completes. If the server
+// needs the user to authorise spotify an AUTH event is sent to subscribers with the URL
+func (c *Conn) Login(ctx context.Context, username, password string) error {
+	return c.authenticate(ctx, username, password, "")
+}
+
+// Registers a new account using an invite code from the server's admin and waits until the
+// handshake completes, the user is then logged in as if Login was used. If registering fails
+// the server explains why in an INFO message before closing the connection
+func (c *Conn) Register(ctx context.Context, username, password, inviteCode string) error {
+	return c.authenticate(ctx, username, password, inviteCode)
+}
+
+// Sends the login details (and invite code if registering) and waits until the handshake completes
+func (c *Conn) authenticate(ctx context.Context, username, password, inviteCode string) error {
+	c.mutex.Lock()
+	c.username, c.password, c.inviteCode = username, password, inviteCode
+	wanted := c.loginWanted
+	c.loginWanted = false
+	c.mutex.Unlock()
+
+	// If the server already asked for the details then reply now, otherwise they're sent once it asks
+	if wanted {
+		err := c.sendLogin()
+		if err != nil {
+			return err
+		}
+	}
+
+	select {
+	case <-c.ready:
+		return nil
+	case <-c.done:
+		return c.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Sends the login details to the server or, if possible, the resume token instead.
+// Tokens are only valid once so it's discarded, if the resume fails the server
+// asks for the login details again. Invite codes are also only sent once since
+// the account exists after registering
+func (c *Conn) sendLogin() error {
+	c.mutex.Lock()
+	token := c.resumeToken
+	c.resumeToken = ""
+	username, password, code := c.username, c.password, c.inviteCode
+	c.inviteCode = ""
+	c.mutex.Unlock()
+
+	if token != "" {
+		return c.Send("RESUME", token)
+	}
+	if code != "" {
+		return c.Send("REGISTER", username+","+password+","+code)
+	}
+	return c.Send("LOGIN", username+","+password)
+}
+
+// Sends a message to the server
+func (c *Conn) Send(op, body string, args ...string) error {
+	msg := &ws.Message{
+		Op:        op,
+		Args:      args,
+		Body:      body,
+		Timestamp: ws.CurrentTime(),
+	}
+	return c.WriteMessage(msg)
+}
+
+// Writes a message over the connection and avoids concurrent writes
+func (c *Conn) WriteMessage(m *ws.Message) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.codec.WriteMessage(c.conn, m)
+}
+
+// Closes the connection, the server is told the disconnect is intentional
+// so it doesn't wait for the client to resume
+func (c *Conn) Close() error {
+	c.mutex.Lock()
+	c.closing = true
+	conn := c.conn
+	_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.mutex.Unlock()
+
+	c.log.Println("Closing websocket connection")
+	err := conn.Close()
+	c.finish(nil)
+	return err
+}
+
+// Marks the connection as closed for good and notifies subscribers
+func (c *Conn) finish(err error) {
+	c.doneOnce.Do(func() {
+		c.err = err
+		close(c.done)
+		c.closeSubscriptions(Event{Type: EventClosed, Err: err})
+	})
+}
+
+// Returns a channel which is closed once the connection is closed for good
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Returns why the connection closed, nil if it's open or was closed with Close
+func (c *Conn) Err() error {
+	select {
+	case <-c.done:
+		if c.err == nil {
+			return ErrClosed
+		}
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Whether the connection is being closed on purpose
+func (c *Conn) isClosing() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.closing
+}
+
+// Reads messages from the connection and processes them, if the connection
+// drops then it's reconnected, the pump exits once the connection is closed
+func (c *Conn) readPump() {
+	for {
+		c.mutex.Lock()
+		conn, codec := c.conn, c.codec
+		c.mutex.Unlock()
+
+		var msg ws.Message
+		err := codec.ReadMessage(conn, &msg)
+		if err != nil {
+			c.log.Printf("read: %s\n", err.Error())
+			if c.isClosing() {
+				c.finish(nil)
+				return
+			}
+
+			// Try and resume the connection, otherwise it's closed for good
+			err = c.reconnect(err)
+			if err != nil {
+				c.finish(err)
+				return
+			}
+			continue
+		}
+		c.log.Printf("Incoming Message: %+v\n", msg)
+
+		err = c.processMsg(&msg)
+		if err != nil {
+			c.log.Printf("processing: %s\n", err.Error())
+		}
+		c.publish(Event{Type: msg.Op, Message: msg})
+	}
+}
+
+// Processes the messages which are part of the protocol rather than for the user
+func (c *Conn) processMsg(m *ws.Message) error {
+	switch m.Op {
+	case "LOGIN":
+		c.mutex.Lock()
+		haveDetails := c.resumeToken != "" || c.username != ""
+		c.loginWanted = !haveDetails
+		c.mutex.Unlock()
+
+		if haveDetails {
+			return c.sendLogin()
+		}
+	case "RESUME":
+		return c.processResume(m)
+	case "TIME":
+		return c.processTime(m)
+	case "PASSWD":
+		// The password changed so it's used if the connection has to login again
+		c.mutex.Lock()
+		if c.newPassword != "" {
+			c.password = c.newPassword
+			c.newPassword = ""
+		}
+		c.mutex.Unlock()
+	}
+	return nil
+}
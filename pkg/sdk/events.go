@@ -0,0 +1,138 @@
+package sdk
+
+import (
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"sync"
+)
+
+// Event types which describe changes to the connection rather than messages from the server
+const (
+	EventReconnecting = "RECONNECTING" // The connection dropped and is being reconnected, the message body describes the attempt
+	EventReconnected  = "RECONNECTED"  // The connection was reconnected and is being resumed
+	EventClosed       = "CLOSED"       // The connection closed for good, Err is set if it wasn't closed on purpose
+)
+
+// Event received by subscribers, either a message from the server or a change to the connection
+type Event struct {
+	Type    string     // The opcode of the message or one of the connection event types
+	Message ws.Message // The message from the server, for connection events only the body may be set
+	Err     error      // The error which caused a connection event, if any
+}
+
+// Subscriber to the connection's events
+type subscription struct {
+	types     map[string]bool // Types of event to receive, all events are received if empty
+	ch        chan Event      // Channel events are sent to
+	cancelled chan struct{}   // Closed when the subscription is cancelled, unblocks pending sends
+	once      sync.Once
+	mutex     sync.Mutex // Held while sending so the channel isn't closed during a send
+	closed    bool       // Whether the channel is closed
+}
+
+// Whether the subscriber wants to receive events of the type
+func (s *subscription) wants(t string) bool {
+	return len(s.types) == 0 || s.types[t]
+}
+
+// Sends the event, waiting for the subscriber to receive it unless the subscription is cancelled
+func (s *subscription) send(e Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+	select {
+	case s.ch <- e:
+	case <-s.cancelled:
+	}
+}
+
+// Cancels the subscription and closes its channel, a pending send is abandoned. If last isn't
+// nil it's sent first if the channel has room, the channel closing tells the subscriber anyway
+func (s *subscription) close(last *Event) {
+	s.once.Do(func() { close(s.cancelled) })
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+	if last != nil && s.wants(last.Type) {
+		select {
+		case s.ch <- *last:
+		default:
+		}
+	}
+	s.closed = true
+	close(s.ch)
+}
+
+// Subscribes to events of the given types (opcodes or connection event types), if no types are
+// given then all events are received. Events are sent in order and the channel must be drained
+// or reading from the connection stalls. The returned function cancels the subscription, the
+// channel is closed once the subscription is cancelled or the connection is closed. The CLOSED
+// event is only sent if the channel has room for it so closing the connection never waits
+func (c *Conn) Subscribe(types ...string) (<-chan Event, func()) {
+	s := &subscription{
+		types:     make(map[string]bool),
+		ch:        make(chan Event, 64),
+		cancelled: make(chan struct{}),
+	}
+	for _, t := range types {
+		s.types[t] = true
+	}
+
+	c.subsMtx.Lock()
+	select {
+	case <-c.done:
+		s.close(nil)
+	default:
+		c.subs = append(c.subs, s)
+	}
+	c.subsMtx.Unlock()
+
+	cancel := func() {
+		c.subsMtx.Lock()
+		for i, sub := range c.subs {
+			if sub == s {
+				c.subs = append(c.subs[:i], c.subs[i+1:]...)
+				break
+			}
+		}
+		c.subsMtx.Unlock()
+
+		s.close(nil)
+	}
+	return s.ch, cancel
+}
+
+// Sends an event to every subscriber interested in it, the subscribers are copied so
+// one which is slow to receive doesn't stop others subscribing or cancelling meanwhile
+func (c *Conn) publish(e Event) {
+	c.subsMtx.Lock()
+	subs := make([]*subscription, 0, len(c.subs))
+	for _, s := range c.subs {
+		if s.wants(e.Type) {
+			subs = append(subs, s)
+		}
+	}
+	c.subsMtx.Unlock()
+
+	for _, s := range subs {
+		s.send(e)
+	}
+}
+
+// Closes every subscriber's channel, the last event is sent to them first if they have room for it
+func (c *Conn) closeSubscriptions(last Event) {
+	c.subsMtx.Lock()
+	subs := c.subs
+	c.subs = nil
+	c.subsMtx.Unlock()
+
+	for _, s := range subs {
+		s.close(&last)
+	}
+}
@@ -0,0 +1,82 @@
+package sdk
+
+import (
+	"errors"
+	"fmt"
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"strconv"
+	"time"
+)
+
+// Bounds for the delay between reconnection attempts
+const (
+	minBackoff = 1 * time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// Processes the RESUME opcode, the server sends a token which can be used to resume
+// the connection and how many seconds the server will wait for it. This is the last
+// message of the handshake so the clock offset is estimated once it arrives
+func (c *Conn) processResume(m *ws.Message) error {
+	c.mutex.Lock()
+	c.resumeToken = m.Body
+	if len(m.Args) > 0 {
+		seconds, err := strconv.Atoi(m.Args[0])
+		if err == nil {
+			c.resumeGrace = time.Duration(seconds) * time.Second
+		}
+	}
+	c.mutex.Unlock()
+
+	c.readyOnce.Do(func() { close(c.ready) })
+	return c.SyncClock()
+}
+
+// Attempts to reconnect to the server after the connection drops, the delay between attempts
+// doubles each time and the connection gives up once the server would no longer hold the user's
+// place. On reconnecting the server asks for the login details and the resume token is sent
+// instead (see sendLogin). Returns why reconnecting failed, nil if it succeeded
+func (c *Conn) reconnect(cause error) error {
+	c.mutex.Lock()
+	canResume := c.resumeToken != ""
+	grace := c.resumeGrace
+	_ = c.conn.Close()
+	c.mutex.Unlock()
+
+	// Without a token there is nothing to resume
+	if !canResume {
+		return cause
+	}
+
+	deadline := time.Now().Add(grace)
+	backoff := minBackoff
+	for attempt := 1; time.Now().Add(backoff).Before(deadline); attempt++ {
+		c.publish(Event{
+			Type:    EventReconnecting,
+			Message: ws.Message{Body: fmt.Sprintf("Connection lost, reconnecting in %s (attempt %d)", backoff, attempt)},
+			Err:     cause,
+		})
+		time.Sleep(backoff)
+
+		// The connection may have been closed while waiting
+		if c.isClosing() {
+			return nil
+		}
+
+		err := c.dial()
+		if err == nil {
+			c.log.Println("Reconnected to:", c.url.String())
+			c.publish(Event{Type: EventReconnected})
+			return nil
+		}
+		c.log.Println("Failed to reconnect:", err)
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+
+	c.log.Println("Gave up reconnecting")
+	return errors.New("gave up reconnecting: " + cause.Error())
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"strconv"
+	"strings"
+)
+
+// Changes the user's password, the body is "current password,new password". The
+// current password is checked like a login so it can't be brute forced over the
+// connection. On success the server replies with a PASSWD message
+func (u *user) cmdPasswd(m *ws.Message) error {
+	passwords := strings.Split(m.Body, ",")
+	if len(passwords) != 2 {
+		return u.sendInfo("Usage: passwd,current password,new password")
+	}
+	current, password := passwords[0], passwords[1]
+
+	if u.startAttempt(u.name) != nil {
+		return nil
+	}
+
+	e, err := dbViewUser(u.name)
+	if err != nil {
+		Log.Error().Err(err).Str("Username", u.name).Msg("Failed retrieving user to change password")
+		u.attemptFailed(u.name, "cannot retrieve user changing password")
+		return u.sendInfo("Failed changing password")
+	}
+	ok, _, err := verifyPassword(e.Password, current)
+	if err != nil {
+		Log.Error().Err(err).Str("Username", u.name).Msg("Cannot verify password")
+		u.attemptFailed(u.name, "cannot verify password changing password")
+		return u.sendInfo("Failed changing password")
+	}
+	if !ok {
+		u.attemptFailed(u.name, "wrong password changing password")
+		return u.sendInfo("Current password is incorrect")
+	}
+	u.attemptSucceeded(u.name)
+	if len(password) < minPasswordLength {
+		return u.sendInfo("Passwords must be at least " + strconv.Itoa(minPasswordLength) + " characters long")
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		Log.Error().Err(err).Str("Username", u.name).Msg("Cannot hash password")
+		return u.sendInfo("Failed changing password")
+	}
+	err = dbUpdateUser(&entry{Name: u.name, Password: hash})
+	if err != nil {
+		Log.Error().Err(err).Str("Username", u.name).Msg("Failed saving new password to db")
+		return u.sendInfo("Failed changing password")
+	}
+
+	Log.Info().Str("Username", u.name).Msg("Password changed")
+	dbAudit(auditEntry{Action: "user.password", Actor: u.name, Target: u.name, Remote: remoteIP(u.r)})
+
+	msg := &ws.Message{
+		Op:        "PASSWD",
+		Args:      nil,
+		Body:      "Password changed",
+		Timestamp: ws.CurrentTime(),
+	}
+	return u.WriteMessage(msg)
+}
+
+// Unlinks the user's spotify account by wiping their stored token, the user is then
+// disconnected and has to authorise spotify again the next time they connect
+func (u *user) cmdUnlink(m *ws.Message) error {
+	// Stop the current player from saving its token again when it refreshes, a token
+	// which is being refreshed is saved before stop returns so it's wiped below
+	u.mutex.Lock()
+	u.unlinked = true
+	u.token = nil
+	ts := u.tokenSource
+	u.mutex.Unlock()
+	if ts != nil {
+		ts.stop()
+	}
+
+	err := dbModifyUser(u.name, func(e *entry) error {
+		e.Token = ""
+		e.Scopes = ""
+		return nil
+	})
+	if err != nil {
+		Log.Error().Err(err).Str("Username", u.name).Msg("Failed wiping token from db")
+		return u.sendInfo("Failed unlinking spotify")
+	}
+
+	Log.Info().Str("Username", u.name).Msg("Spotify unlinked")
+	dbAudit(auditEntry{Action: "user.unlink", Actor: u.name, Target: u.name, Remote: remoteIP(u.r)})
+
+	_ = u.sendInfo("Spotify unlinked, you'll be asked to authorise spotify again when you next connect")
+	u.disconnect()
+	return nil
+}
+
+// Tells the user who they're logged in as. The reply is a WHOAMI message whose args
+// are the username, spotify ID and session host (blank if not in a session)
+func (u *user) cmdWhoami(m *ws.Message) error {
+	text := "Logged in as " + u.name
+
+	var spotifyID string
+	if u.spotifyData != nil {
+		spotifyID = u.spotifyData.ID
+		text += ", spotify account " + u.spotifyData.DisplayName + " (" + spotifyID + ")"
+	}
+
+	var host string
+	if u.s != nil {
+		host = u.s.host.name
+		text += ", in session " + host
+	} else {
+		text += ", not in a session"
+	}
+
+	msg := &ws.Message{
+		Op:        "WHOAMI",
+		Args:      []string{u.name, spotifyID, host},
+		Body:      text,
+		Timestamp: ws.CurrentTime(),
+	}
+	return u.WriteMessage(msg)
+}
+
+// Whether the user unlinked spotify
+func (u *user) isUnlinked() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.unlinked
+}
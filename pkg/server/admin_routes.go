@@ -3,6 +3,8 @@ package server
 import (
 	ws "github.com/fiwippi/spotify-sync/pkg/shared"
 	"github.com/gin-gonic/gin"
+	"sort"
+	"strings"
 )
 
 // Route for creating a new user in the database
@@ -21,20 +23,22 @@ func createUser(c *gin.Context) {
 		return
 	}
 
-	// Ensures keys are valid
-	if !(r.AdminKey == adminKey) {
-		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Must include valid admin key"})
+	hash, err := hashPassword(r.NewPassword)
+	if err != nil {
+		Log.Error().Err(err).Msg("Error hashing password")
+		c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error creating user"})
 		return
 	}
 
-	err = dbSaveUser(&entry{Name: r.NewName, Password: ws.HashPassword(r.NewPassword)}, false)
+	err = dbSaveUser(&entry{Name: r.NewName, Password: hash}, false)
 	if err != nil {
 		Log.Error().Err(err).Msg("Error creating user")
 		c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error creating user"})
 		return
 	}
 
-	Log.Debug().Str("Username", r.NewName).Msg("Created user")
+	Log.Info().Str("Username", r.NewName).Str("Admin", c.GetString("admin")).Msg("Created user")
+	adminAudit(c, "user.create", r.NewName, "")
 	c.JSON(200, ws.Response{Success: true, Error: ""})
 }
 
@@ -54,12 +58,6 @@ func deleteUser(c *gin.Context) {
 		return
 	}
 
-	// Ensures keys are valid
-	if r.AdminKey != adminKey {
-		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Must include valid admin key"})
-		return
-	}
-
 	err = dbDeleteUser(&entry{Name: r.CurrentName})
 	if err != nil {
 		Log.Error().Err(err).Msg("Error deleting user")
@@ -67,7 +65,8 @@ func deleteUser(c *gin.Context) {
 		return
 	}
 
-	Log.Debug().Str("Username", r.NewName).Msg("Deleted user")
+	Log.Info().Str("Username", r.CurrentName).Str("Admin", c.GetString("admin")).Msg("Deleted user")
+	adminAudit(c, "user.delete", r.CurrentName, "")
 	c.JSON(200, ws.Response{Success: true, Error: ""})
 }
 
@@ -87,45 +86,140 @@ func updateUser(c *gin.Context) {
 		return
 	}
 
-	// Ensures keys are valid
-	if r.AdminKey != adminKey {
-		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Must include valid admin key"})
-		return
+	// Only hash the new password if one was given, an empty password leaves it unchanged
+	var hash string
+	if len(r.NewPassword) != 0 {
+		hash, err = hashPassword(r.NewPassword)
+		if err != nil {
+			Log.Error().Err(err).Msg("Error hashing password")
+			c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error updating user"})
+			return
+		}
 	}
 
-	err = dbUpdateUser(&entry{Name: r.CurrentName, NewName: r.NewName, Password: ws.HashPassword(r.NewPassword)})
+	err = dbUpdateUser(&entry{Name: r.CurrentName, NewName: r.NewName, Password: hash})
 	if err != nil {
 		Log.Error().Err(err).Msg("Error updating user")
-		c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error deleting user"})
+		c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error updating user"})
 		return
 	}
 
-	Log.Debug().Str("Old Username", r.CurrentName).Str("Username", r.NewName).Msg("Updated username data")
+	// Record what changed without the password itself
+	var changes []string
+	if len(r.NewName) != 0 && r.NewName != r.CurrentName {
+		changes = append(changes, "renamed to "+r.NewName)
+	}
+	if len(r.NewPassword) != 0 {
+		changes = append(changes, "password changed")
+	}
+	Log.Info().Str("Old Username", r.CurrentName).Str("Username", r.NewName).Str("Admin", c.GetString("admin")).Msg("Updated username data")
+	adminAudit(c, "user.update", r.CurrentName, strings.Join(changes, ", "))
 	c.JSON(200, ws.Response{Success: true, Error: ""})
 }
 
-// Route for creating a new user in the database
+// Route for viewing the values in the db as records and as a table, the bucket and key queries filter them.
+// Secrets are redacted unless the unsafe query is true and the token has the db:backup scope
 func viewDB(c *gin.Context) {
-	var r ws.Request
-	err := c.BindJSON(&r)
-	if err != nil {
-		// If the JSON cannot be unmarshaled then bad request
-		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Request incorrect"})
+	f := ViewFilter{Bucket: c.Query("bucket"), Key: c.Query("key"), Unsafe: c.Query("unsafe") == "true"}
+	if f.Unsafe && !requestHasScope(c, "db:backup") {
+		adminAudit(c, "admin.denied", c.Request.URL.Path, "missing scope db:backup to view secrets")
+		c.AbortWithStatusJSON(403, ws.Response{Success: false, Error: "Viewing secrets needs the db:backup scope"})
 		return
 	}
 
-	// Ensures keys are valid
-	if !(r.AdminKey == adminKey) {
-		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Must include valid admin key"})
+	records, err := dbViewRecords(f)
+	if err == errUnknownBucket {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: err.Error()})
+		return
+	} else if err != nil {
+		Log.Error().Err(err).Msg("Error viewing db")
+		c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error viewing db"})
 		return
 	}
-
-	s, err := dbViewAll()
+	var table strings.Builder
+	err = writeDBTable(&table, records)
 	if err != nil {
 		Log.Error().Err(err).Msg("Error viewing db")
 		c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error viewing db"})
 		return
 	}
 
-	c.JSON(200, gin.H{"success": true, "error": "", "db": s})
+	var detail []string
+	if f.Bucket != "" {
+		detail = append(detail, "bucket "+f.Bucket)
+	}
+	if f.Key != "" {
+		detail = append(detail, "key "+f.Key)
+	}
+	if f.Unsafe {
+		detail = append(detail, "unsafe")
+	}
+	adminAudit(c, "db.view", "", strings.Join(detail, ", "))
+
+	c.JSON(200, gin.H{"success": true, "error": "", "records": records, "db": table.String()})
+}
+
+// Summary of a user returned by the admin api
+type userInfo struct {
+	Name      string `json:"name"`
+	Linked    bool   `json:"linked"`    // Whether the user has authorised spotify
+	Connected bool   `json:"connected"` // Whether the user is connected to the server
+}
+
+// Route for listing the users in the database
+func viewUsers(c *gin.Context) {
+	entries, err := dbViewUsers()
+	if err != nil {
+		Log.Error().Err(err).Msg("Error viewing users")
+		c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error viewing users"})
+		return
+	}
+
+	users := make([]userInfo, 0, len(entries))
+	for _, e := range entries {
+		users = append(users, userInfo{Name: e.Name, Linked: e.Token != "" && e.Token != "null", Connected: isConnected(e.Name)})
+	}
+	c.JSON(200, gin.H{"success": true, "error": "", "users": users})
+}
+
+// Summary of a session returned by the admin api
+type sessionInfo struct {
+	Host  string   `json:"host"`
+	Users []string `json:"users"` // Users in the session including the host
+}
+
+// Route for listing the sessions
+func viewSessions(c *gin.Context) {
+	infos := make([]sessionInfo, 0, len(sessions))
+	for host, s := range sessions {
+		if s == nil {
+			continue
+		}
+		infos = append(infos, sessionInfo{Host: host, Users: strings.Split(s.getUsers(), ",")})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Host < infos[j].Host })
+	c.JSON(200, gin.H{"success": true, "error": "", "sessions": infos})
+}
+
+// Route for ending a session, the session is identified by its host's name
+func endSession(c *gin.Context) {
+	var r ws.Request
+	err := c.BindJSON(&r)
+	if err != nil {
+		// If the JSON cannot be unmarshaled then bad request
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Request incorrect"})
+		return
+	}
+
+	s, ok := sessions[r.CurrentName]
+	if !ok || s == nil {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Session does not exist"})
+		return
+	}
+	s.close()
+	delete(sessions, r.CurrentName)
+
+	Log.Info().Str("Host", r.CurrentName).Str("Admin", c.GetString("admin")).Msg("Session ended by admin")
+	adminAudit(c, "session.end", r.CurrentName, "")
+	c.JSON(200, ws.Response{Success: true, Error: ""})
 }
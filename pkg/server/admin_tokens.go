@@ -0,0 +1,360 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"github.com/gin-gonic/gin"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Scopes which can be given to admin API tokens
+var adminScopes = map[string]bool{
+	"users:read":      true, // List the users
+	"users:write":     true, // Create, update and delete users
+	"sessions:manage": true, // List and end sessions
+	"db:read":         true, // View the db
+	"db:backup":       true, // Download backups of the db, which include password hashes and tokens
+	"audit:read":      true, // Query the audit log
+}
+
+// How often a token's last use is saved, saving it on every request would make
+// read only requests wait for each other to write to the db
+var adminTokenUseInterval = time.Minute
+
+// Valid names of admin API tokens
+var tokenNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Admin API token stored in the db, the token itself is never stored, only its hash.
+// Tokens are given to the holder as "<name>.<secret>" so they can be looked up by name
+type adminToken struct {
+	Name     string   `json:"name"`
+	Hash     string   `json:"hash,omitempty"`      // SHA-256 of the token, the secret is random so it doesn't need a slow hash
+	Scopes   []string `json:"scopes"`              // What the token can access
+	Created  string   `json:"created"`             // When the token was created
+	Expires  string   `json:"expires,omitempty"`   // When the token expires, it never expires if empty
+	LastUsed string   `json:"last_used,omitempty"` // When the token was last used
+}
+
+// Whether the token has the scope
+func (t *adminToken) hasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the token has expired
+func (t *adminToken) expired() bool {
+	if t.Expires == "" {
+		return false
+	}
+	expiry, err := time.Parse(ws.TimeLayout, t.Expires)
+	return err != nil || time.Now().After(expiry)
+}
+
+// Hashes a randomly generated token so it can be stored and compared without storing the token
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return base64.RawStdEncoding.EncodeToString(h[:])
+}
+
+// Creates an admin API token and returns the token which should be given to its holder
+func dbCreateAdminToken(name string, scopes []string, expires time.Duration) (string, error) {
+	if !tokenNameRegex.MatchString(name) {
+		return "", errors.New("Token name must be 1-64 letters, numbers, underscores or hyphens")
+	}
+	if len(scopes) == 0 {
+		return "", errors.New("Token must have at least one scope")
+	}
+	for _, s := range scopes {
+		if !adminScopes[s] {
+			return "", errors.New("Unknown scope " + s)
+		}
+	}
+
+	secret, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	token := name + "." + secret
+
+	t := adminToken{
+		Name:    name,
+		Hash:    hashToken(token),
+		Scopes:  scopes,
+		Created: ws.CurrentTime(),
+	}
+	if expires > 0 {
+		t.Expires = time.Now().Add(expires).UTC().Format(ws.TimeLayout)
+	}
+
+	err = db.Update(func(tx store.Tx) error {
+		b := tx.Bucket("admin_tokens")
+		if b.Get([]byte(name)) != nil {
+			return errors.New("Token already exists")
+		}
+
+		v, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), v)
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Deletes an admin API token
+func dbRevokeAdminToken(name string) error {
+	return db.Update(func(tx store.Tx) error {
+		b := tx.Bucket("admin_tokens")
+		if b.Get([]byte(name)) == nil {
+			return errors.New("Token does not exist")
+		}
+		return b.Delete([]byte(name))
+	})
+}
+
+// Returns every admin API token without their hashes
+func dbViewAdminTokens() ([]adminToken, error) {
+	tokens := make([]adminToken, 0)
+	err := db.View(func(tx store.Tx) error {
+		return tx.Bucket("admin_tokens").ForEach(func(k, v []byte) error {
+			var t adminToken
+			err := json.Unmarshal(v, &t)
+			if err != nil {
+				return err
+			}
+			t.Hash = ""
+			tokens = append(tokens, t)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Whether the token's last use was long enough ago that it should be saved again
+func (t *adminToken) useStale(now time.Time) bool {
+	last, err := time.Parse(ws.TimeLayout, t.LastUsed)
+	return err != nil || now.Sub(last) >= adminTokenUseInterval
+}
+
+// Verifies an admin API token and records that it was used, the last use is
+// only saved if the one before it was over adminTokenUseInterval ago
+func dbUseAdminToken(token string) (*adminToken, error) {
+	name := token
+	if i := strings.Index(token, "."); i != -1 {
+		name = token[:i]
+	}
+	hash := []byte(hashToken(token))
+
+	var t adminToken
+	err := db.View(func(tx store.Tx) error {
+		v := tx.Bucket("admin_tokens").Get([]byte(name))
+		if v == nil {
+			// Compare anyway so unknown names take as long as wrong secrets
+			subtle.ConstantTimeCompare(hash, []byte(hashToken("")))
+			return errors.New("Invalid admin token")
+		}
+
+		err := json.Unmarshal(v, &t)
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare(hash, []byte(t.Hash)) != 1 {
+			return errors.New("Invalid admin token")
+		}
+		if t.expired() {
+			return errors.New("Admin token has expired")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if t.useStale(now) {
+		t.LastUsed = now.UTC().Format(ws.TimeLayout)
+		err = dbSaveAdminTokenUse(name, t.Hash, t.LastUsed)
+		if err != nil {
+			// The token is still valid so the request isn't refused
+			Log.Error().Err(err).Str("Token", name).Msg("Failed saving admin token use")
+		}
+	}
+	return &t, nil
+}
+
+// Saves when the token was last used, nothing is saved if the token was revoked or replaced meanwhile
+func dbSaveAdminTokenUse(name, hash, lastUsed string) error {
+	return db.Update(func(tx store.Tx) error {
+		b := tx.Bucket("admin_tokens")
+		v := b.Get([]byte(name))
+		if v == nil {
+			return nil
+		}
+
+		var t adminToken
+		err := json.Unmarshal(v, &t)
+		if err != nil {
+			return err
+		}
+		if t.Hash != hash {
+			return nil
+		}
+		t.LastUsed = lastUsed
+		v, err = json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), v)
+	})
+}
+
+// Returns the bearer token from the request's Authorization header
+func bearerToken(c *gin.Context) string {
+	h := c.GetHeader("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
+
+// Whether the token is the bootstrap admin key, which is disabled if no admin key is set
+func isBootstrapKey(token string) bool {
+	return adminKey != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminKey)) == 1
+}
+
+// Rejects a request which isn't authorised
+func abortUnauthorised(c *gin.Context, code int, msg string) {
+	if code == 401 {
+		c.Header("WWW-Authenticate", `Bearer realm="spotify-sync"`)
+	}
+	c.AbortWithStatusJSON(code, ws.Response{Success: false, Error: msg})
+}
+
+// Middleware which only allows requests with an admin API token that has the scope
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if token == "" {
+			abortUnauthorised(c, 401, "Must include admin token")
+			return
+		}
+		if isBootstrapKey(token) {
+			abortUnauthorised(c, 403, "The admin key can only be used to manage admin tokens")
+			return
+		}
+
+		t, err := dbUseAdminToken(token)
+		if err != nil {
+			Log.Debug().Err(err).Str("Remote", c.Request.RemoteAddr).Msg("Admin token rejected")
+			abortUnauthorised(c, 401, "Must include valid admin token")
+			return
+		}
+		if !t.hasScope(scope) {
+			dbAudit(auditEntry{Action: "admin.denied", Actor: t.Name, Target: c.Request.URL.Path, Remote: remoteIP(c.Request), Detail: "missing scope " + scope})
+			abortUnauthorised(c, 403, "Admin token does not have the "+scope+" scope")
+			return
+		}
+
+		c.Set("admin", t.Name)
+		c.Set("adminToken", t)
+		c.Next()
+	}
+}
+
+// Whether the admin token which authorised the request also has the scope
+func requestHasScope(c *gin.Context, scope string) bool {
+	t, ok := c.Get("adminToken")
+	return ok && t.(*adminToken).hasScope(scope)
+}
+
+// Middleware which only allows requests with the bootstrap admin key
+func requireAdminKey() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isBootstrapKey(bearerToken(c)) {
+			abortUnauthorised(c, 401, "Must include valid admin key")
+			return
+		}
+
+		c.Set("admin", "admin key")
+		c.Next()
+	}
+}
+
+// Route for creating an admin API token
+func createAdminToken(c *gin.Context) {
+	var r ws.TokenRequest
+	err := c.BindJSON(&r)
+	if err != nil {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Request incorrect"})
+		return
+	}
+
+	var expires time.Duration
+	if r.Expires != "" {
+		expires, err = time.ParseDuration(r.Expires)
+		if err != nil || expires <= 0 {
+			c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Expiry must be a positive duration e.g. 720h"})
+			return
+		}
+	}
+
+	token, err := dbCreateAdminToken(r.Name, r.Scopes, expires)
+	if err != nil {
+		Log.Debug().Err(err).Msg("Error creating admin token")
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	Log.Info().Str("Name", r.Name).Strs("Scopes", r.Scopes).Msg("Created admin token")
+	adminAudit(c, "token.create", r.Name, "scopes "+strings.Join(r.Scopes, ","))
+	c.JSON(200, gin.H{"success": true, "error": "", "token": token})
+}
+
+// Route for revoking an admin API token
+func revokeAdminToken(c *gin.Context) {
+	var r ws.TokenRequest
+	err := c.BindJSON(&r)
+	if err != nil {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Request incorrect"})
+		return
+	}
+
+	err = dbRevokeAdminToken(r.Name)
+	if err != nil {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	Log.Info().Str("Name", r.Name).Msg("Revoked admin token")
+	adminAudit(c, "token.revoke", r.Name, "")
+	c.JSON(200, ws.Response{Success: true, Error: ""})
+}
+
+// Route for listing the admin API tokens
+func viewAdminTokens(c *gin.Context) {
+	tokens, err := dbViewAdminTokens()
+	if err != nil {
+		Log.Error().Err(err).Msg("Error viewing admin tokens")
+		c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error viewing admin tokens"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "error": "", "tokens": tokens})
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"testing"
+	"time"
+)
+
+// Returns the token's last use as it's saved in the db
+func testLastUsed(t *testing.T, name string) string {
+	t.Helper()
+	tokens, err := dbViewAdminTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tkn := range tokens {
+		if tkn.Name == name {
+			return tkn.LastUsed
+		}
+	}
+	t.Fatalf("token %s not found", name)
+	return ""
+}
+
+func TestUseAdminToken(t *testing.T) {
+	openTestDB(t)
+	token, err := dbCreateAdminToken("reader", []string{"users:read"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"valid", token, false},
+		{"wrong secret", "reader.wrong", true},
+		{"unknown name", "writer.secret", true},
+		{"no name", "", true},
+	}
+	for _, tt := range tests {
+		tkn, err := dbUseAdminToken(tt.token)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: use = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && !tkn.hasScope("users:read") {
+			t.Errorf("%s: scopes = %v, want users:read", tt.name, tkn.Scopes)
+		}
+	}
+
+	// The last use is only saved again once the interval passes
+	first := testLastUsed(t, "reader")
+	if first == "" {
+		t.Fatal("last use wasn't saved")
+	}
+	_, err = dbUseAdminToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := testLastUsed(t, "reader"); last != first {
+		t.Errorf("last use = %s, want it unchanged within the interval (%s)", last, first)
+	}
+
+	old := time.Now().Add(-2 * adminTokenUseInterval).UTC().Format(ws.TimeLayout)
+	tkn, err := dbUseAdminToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dbSaveAdminTokenUse("reader", tkn.Hash, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dbUseAdminToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := testLastUsed(t, "reader"); last == old {
+		t.Error("last use wasn't saved once the interval passed")
+	}
+
+	err = dbRevokeAdminToken("reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dbUseAdminToken(token); err == nil {
+		t.Error("revoked token was accepted")
+	}
+}
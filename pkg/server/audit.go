@@ -0,0 +1,202 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"github.com/gin-gonic/gin"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Most audit entries returned by the admin api at once if no limit is given
+var defaultAuditLimit = 1000
+
+// Entry in the audit log, these are stored in the order they happened
+type auditEntry struct {
+	Time   string `json:"time"`
+	Action string `json:"action"`           // What happened, e.g. "login.failed"
+	Actor  string `json:"actor,omitempty"`  // Who performed the action
+	Target string `json:"target,omitempty"` // What the action was performed on
+	Remote string `json:"remote,omitempty"` // IP address the action came from
+	Detail string `json:"detail,omitempty"` // Extra information about the action
+}
+
+// Which audit entries to return, zero values match everything
+type auditFilter struct {
+	Since time.Time // Entries at or after this time
+	Until time.Time // Entries before this time
+	Actor string    // Entries performed by this actor
+	Limit int       // Most entries to return, the latest ones are kept
+}
+
+// Whether the entry matches the filter
+func (f *auditFilter) matches(e *auditEntry, t time.Time) bool {
+	if !f.Since.IsZero() && t.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !t.Before(f.Until) {
+		return false
+	}
+	return f.Actor == "" || f.Actor == e.Actor
+}
+
+// Adds an entry to the audit log, failures are logged rather than returned so auditing never
+// stops the action from happening. Entries are keyed by a sequence number so they stay in order
+func dbAudit(e auditEntry) {
+	if e.Time == "" {
+		e.Time = ws.CurrentTime()
+	}
+
+	err := db.Update(func(tx store.Tx) error {
+		b := tx.Bucket("audit")
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		v, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, seq)
+		return b.Put(k, v)
+	})
+	if err != nil {
+		Log.Error().Err(err).Str("Action", e.Action).Msg("Failed writing audit entry")
+	}
+}
+
+// Records a privileged action performed through the admin api, the actor is the admin token's name
+func adminAudit(c *gin.Context, action, target, detail string) {
+	dbAudit(auditEntry{Action: action, Actor: c.GetString("admin"), Target: target, Remote: remoteIP(c.Request), Detail: detail})
+}
+
+// Returns the audit entries matching the filter in the order they happened
+func dbViewAudit(f auditFilter) ([]auditEntry, error) {
+	entries := make([]auditEntry, 0)
+	err := db.View(func(tx store.Tx) error {
+		// Walk backwards from the latest entry so the limit keeps the latest ones
+		err := tx.Bucket("audit").ForEachReverse(func(k, v []byte) error {
+			var e auditEntry
+			err := json.Unmarshal(v, &e)
+			if err != nil {
+				return err
+			}
+			t, err := time.Parse(ws.TimeLayout, e.Time)
+			if err != nil {
+				return err
+			}
+
+			// Entries are in time order so none of the earlier ones can match
+			if !f.Since.IsZero() && t.Before(f.Since) {
+				return errStop
+			}
+			if !f.matches(&e, t) {
+				return nil
+			}
+			entries = append(entries, e)
+			if f.Limit > 0 && len(entries) >= f.Limit {
+				return errStop
+			}
+			return nil
+		})
+		if err == errStop {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// Writes every audit entry matching the filter to the writer as JSON lines, the db is opened read only
+// from its path so the server must not be running unless the driver allows it. Returns how many entries were written
+func ExportAudit(driver, dbPath string, w io.Writer, since, until time.Time, actor string) (int, error) {
+	var err error
+	db, err = store.Open(driver, dbPath, true)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	err = db.View(func(tx store.Tx) error {
+		if tx.Bucket("audit") == nil {
+			return errors.New("The db has no audit log")
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	entries, err := dbViewAudit(auditFilter{Since: since, Until: until, Actor: actor})
+	if err != nil {
+		return 0, err
+	}
+
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		err = enc.Encode(e)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(entries), nil
+}
+
+// Parses the time given to filter the audit log, blank times are zero
+func parseAuditTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// Route for querying the audit log, the entries can be filtered with the "since" and "until"
+// RFC3339 times, the "actor" who performed them and "limit" which keeps the latest entries
+func viewAudit(c *gin.Context) {
+	var f auditFilter
+	var err error
+
+	f.Since, err = parseAuditTime(c.Query("since"))
+	if err != nil {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Since must be an RFC3339 time"})
+		return
+	}
+	f.Until, err = parseAuditTime(c.Query("until"))
+	if err != nil {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Until must be an RFC3339 time"})
+		return
+	}
+	f.Actor = c.Query("actor")
+
+	f.Limit = defaultAuditLimit
+	if l := c.Query("limit"); l != "" {
+		f.Limit, err = strconv.Atoi(l)
+		if err != nil || f.Limit <= 0 {
+			c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Limit must be a positive number"})
+			return
+		}
+	}
+
+	entries, err := dbViewAudit(f)
+	if err != nil {
+		Log.Error().Err(err).Msg("Error viewing audit log")
+		c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error viewing audit log"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "error": "", "audit": entries})
+}
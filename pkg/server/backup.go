@@ -0,0 +1,254 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"github.com/gin-gonic/gin"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Layout of the time in the names of backups, it sorts in the order they were taken
+const backupTimeLayout = "20060102T150405Z"
+
+// Local snapshots of the db which the server takes periodically, disabled if the interval is 0
+var (
+	snapshotDir      string // Where snapshots are kept, "snapshots" in the data dir if empty
+	snapshotInterval time.Duration
+	snapshotKeep     = 7 // How many snapshots are kept, older ones are deleted. 0 keeps every snapshot
+)
+
+// Sets how often the server snapshots the db into the dir and how many snapshots it keeps,
+// if the dir is empty then they're kept in "snapshots" in the data dir
+func SetSnapshots(dir string, interval time.Duration, keep int) error {
+	if interval < 0 || keep < 0 {
+		return errors.New("Snapshot interval and retention can't be negative")
+	}
+	if interval > 0 && interval < time.Minute {
+		return errors.New("Snapshot interval must be at least a minute")
+	}
+	snapshotDir = dir
+	snapshotInterval = interval
+	snapshotKeep = keep
+	return nil
+}
+
+// Returns the dir snapshots are kept in
+func snapshotsDir() string {
+	if snapshotDir != "" {
+		return snapshotDir
+	}
+	return dataPath("snapshots")
+}
+
+// Returns the name a backup of the db taken now is given
+func backupName() string {
+	return "spotify-" + time.Now().UTC().Format(backupTimeLayout) + filepath.Ext(store.Path(dbDriver, ""))
+}
+
+// Route which streams a consistent snapshot of the db, the server keeps running while it's taken.
+// The driver and schema version of the snapshot are sent in the X-DB-Driver and X-Schema-Version headers
+func backupDB(c *gin.Context) {
+	if dbDriver == store.Memory {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "The db is kept in memory so it can't be backed up"})
+		return
+	}
+
+	var version int
+	err := db.View(func(tx store.Tx) error {
+		var err error
+		version, err = schemaVersion(tx)
+		return err
+	})
+	if err != nil {
+		Log.Error().Err(err).Msg("Error reading schema version for backup")
+		c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error backing up db"})
+		return
+	}
+
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Disposition", `attachment; filename="`+backupName()+`"`)
+	c.Header("X-DB-Driver", dbDriver)
+	c.Header("X-Schema-Version", strconv.Itoa(version))
+	c.Status(200)
+
+	n, err := db.WriteTo(c.Writer)
+	if err != nil {
+		Log.Error().Err(err).Msg("Error backing up db")
+		// Nothing may have been sent yet, if it has the backup is incomplete and fails validation
+		if !c.Writer.Written() {
+			c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error backing up db"})
+		}
+		return
+	}
+
+	Log.Info().Int64("Bytes", n).Str("Admin", c.GetString("admin")).Msg("Backed up db")
+	adminAudit(c, "db.backup", "", strconv.FormatInt(n, 10)+" bytes")
+}
+
+// Snapshots the db into the snapshot dir and deletes the oldest snapshots
+// past the retention limit, returns the path of the new snapshot
+func takeSnapshot() (string, error) {
+	err := os.MkdirAll(snapshotsDir(), 0700)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(snapshotsDir(), backupName())
+	err = db.Backup(path)
+	if err != nil {
+		return "", err
+	}
+	return path, pruneSnapshots()
+}
+
+// Deletes the oldest snapshots so only the latest ones are kept
+func pruneSnapshots() error {
+	if snapshotKeep == 0 {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(snapshotsDir())
+	if err != nil {
+		return err
+	}
+	var names []string
+	ext := filepath.Ext(store.Path(dbDriver, ""))
+	for _, f := range files {
+		if !f.IsDir() && strings.HasPrefix(f.Name(), "spotify-") && filepath.Ext(f.Name()) == ext {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for i := 0; i < len(names)-snapshotKeep; i++ {
+		err = os.Remove(filepath.Join(snapshotsDir(), names[i]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshots the db every interval, failures are logged and tried again at the next interval
+func runSnapshots() {
+	Log.Info().Str("Dir", snapshotsDir()).Str("Interval", snapshotInterval.String()).Int("Keep", snapshotKeep).Msg("Snapshotting db")
+
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		path, err := takeSnapshot()
+		if err != nil {
+			Log.Error().Err(err).Msg("Failed snapshotting db")
+			continue
+		}
+		Log.Debug().Str("Path", path).Msg("Snapshotted db")
+	}
+}
+
+// Checks the file is a backup of a db stored with the driver and returns its schema
+// version. Backups from newer versions are rejected since they can't be migrated
+func ValidateBackup(driver, path string) (int, error) {
+	if driver == store.Memory {
+		return 0, store.ErrNoBackup
+	}
+
+	s, err := store.Open(driver, path, true)
+	if err != nil {
+		return 0, errors.New("Cannot open backup: " + err.Error())
+	}
+	defer s.Close()
+
+	var version int
+	err = s.View(func(tx store.Tx) error {
+		if tx.Bucket("users") == nil {
+			return errors.New("Backup has no users, it isn't a db")
+		}
+		var err error
+		version, err = schemaVersion(tx)
+		return err
+	})
+	if err != nil {
+		return 0, errors.New("Invalid backup: " + err.Error())
+	}
+	if version > len(migrations) {
+		return 0, fmt.Errorf("Backup schema version %d is newer than this version supports (%d)", version, len(migrations))
+	}
+	return version, nil
+}
+
+// Replaces the db at the path with the backup once it's validated, the current db is kept next to it
+// as "<db>.pre-restore-<time>.bak". Returns the backup's schema version, older versions are migrated
+// when the server next starts. The server must not be running
+func Restore(driver, dbPath, backupPath string) (int, error) {
+	version, err := ValidateBackup(driver, backupPath)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = os.Stat(dbPath)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if exists {
+		// Bolt can't be opened while the server has it open. Closing sqlite also moves
+		// its write-ahead log into the file so nothing is applied over the restored db
+		s, err := store.Open(driver, dbPath, false)
+		if err != nil {
+			return 0, errors.New("Cannot open db, the server must not be running: " + err.Error())
+		}
+		err = s.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Copy next to the db first so it's replaced in one step
+	tmp := dbPath + ".restore"
+	err = copyFile(tmp, backupPath)
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if exists {
+		err = os.Rename(dbPath, dbPath+".pre-restore-"+time.Now().UTC().Format(backupTimeLayout)+".bak")
+		if err != nil {
+			os.Remove(tmp)
+			return 0, err
+		}
+	}
+	return version, os.Rename(tmp, dbPath)
+}
+
+// Copies the file at src to dst, which is only readable by the owner
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	err = out.Sync()
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -3,7 +3,9 @@ package server
 import (
 	"errors"
 	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var helpMsg = `
@@ -13,17 +15,41 @@ JOIN = Join a session someone has created e.g. "join,username"
 EXIT/QUIT = Disconnect from the server
 DISCONNECT = Leave the session
 ID = Displays the ID of the current session
-MSG = Send a message to other users in the same session e.g. "msg,change the song?""`
+MSG = Send a message to other users in the same session e.g. "msg,change the song?"
+TIME = Displays the server's time and how far your clock is from it
+HISTORY = Displays the tracks played in sessions you were in e.g. "history,20"
+STATS = Displays your listening stats, e.g. the time you've listened and your top artists
+SAVE = Saves the tracks played in the session to a playlist in your spotify account e.g. "save,party mix"
+WHOAMI = Displays who you're logged in as
+PASSWD = Change your password e.g. "passwd,current password,new password"
+UNLINK = Unlink your spotify account, you'll be asked to authorise it again next time you connect"`
 
 // Sends a help message to the user
 func (u *user) cmdHelp(m *ws.Message) error {
 	return u.sendInfo(helpMsg)
 }
 
+// Sends the server's current time in milliseconds since the unix epoch so the client can
+// estimate its clock offset, the client's send time is echoed back to measure the round trip
+func (u *user) cmdTime(m *ws.Message) error {
+	var sent string
+	if len(m.Args) > 0 {
+		sent = m.Args[0]
+	}
+
+	msg := &ws.Message{
+		Op:        "TIME",
+		Args:      []string{sent, strconv.FormatInt(ws.EpochMillis(time.Now()), 10)},
+		Body:      "",
+		Timestamp: ws.CurrentTime(),
+	}
+	return u.WriteMessage(msg)
+}
+
 // Sends a message to all clients in the session
 func (u *user) cmdMsg(m *ws.Message) error {
 	if u.s != nil {
-		u.s.broadcast <- m.Body
+		u.s.broadcast <- chatMsg{from: u.name, text: m.Body}
 	} else {
 		_ = u.sendInfo("No session to send message to")
 	}
@@ -49,6 +75,9 @@ func (u *user) cmdCreate(m *ws.Message) error {
 
 	// Create the session
 	sessions[u.name] = newSession(u)
+	dbUpdateStats([]string{u.name}, func(name string, s *userStats) {
+		s.SessionsHosted++
+	})
 
 	// Notify of success
 	err := u.sendInfo("Session created for: " + u.name)
@@ -65,6 +94,7 @@ func (u *user) cmdCreate(m *ws.Message) error {
 	Log.Info().Str("Username", u.name).Msg("Session created")
 
 	// Start the session
+	serving.Add(2)
 	go sessions[u.name].handleChannels()
 	go sessions[u.name].handleSync()
 
@@ -92,6 +122,9 @@ func (u *user) cmdJoin(m *ws.Message) error {
 		text = "Session (" + id + ") joined by: " + u.name
 		sessions[id].register <- u
 		u.s = sessions[id]
+		dbUpdateStats([]string{u.name}, func(name string, s *userStats) {
+			s.SessionsJoined++
+		})
 	} else {
 		text = "Cannot join session (" + id + ") for: " + u.name
 	}
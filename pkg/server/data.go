@@ -0,0 +1,58 @@
+package server
+
+import (
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"os"
+	"path/filepath"
+)
+
+// Directory the server keeps its state in, i.e. the db, logs, snapshots and self-signed certificate
+var dataDir = "data"
+
+// Path of the db file, if empty it's kept in the data dir and named after the driver
+var dbFile string
+
+// Sets the directory the server keeps its state in, it's created when the server
+// starts if it doesn't exist. If dir is empty then "data" in the working dir is used
+func SetDataDir(dir string) {
+	if dir == "" {
+		dir = "data"
+	}
+	dataDir = filepath.Clean(dir)
+}
+
+// Sets the path of the db file, if path is empty then the db is kept in the data dir
+func SetDBPath(path string) {
+	dbFile = path
+}
+
+// Returns the path of the file within the data dir
+func dataPath(name ...string) string {
+	return filepath.Join(append([]string{dataDir}, name...)...)
+}
+
+// Returns the path of the db file the server uses
+func dbFilePath() string {
+	if dbFile != "" {
+		return dbFile
+	}
+	return store.Path(dbDriver, dataDir)
+}
+
+// Creates the data dir if it doesn't exist, it's only readable by the
+// server's user since it holds password hashes, tokens and private keys
+func createDataDir() error {
+	return os.MkdirAll(dataDir, 0700)
+}
+
+// Creates the data dir and the dir of the db file if they don't exist
+func createDataDirs() error {
+	err := createDataDir()
+	if err != nil {
+		return err
+	}
+	if dbDriver == store.Memory {
+		return nil
+	}
+	return os.MkdirAll(filepath.Dir(dbFilePath()), 0700)
+}
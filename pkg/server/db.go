@@ -1,22 +1,53 @@
 package server
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	bolt "go.etcd.io/bbolt"
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"io"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"unicode"
+	"unicode/utf8"
 )
 
 // The database
-var db *bolt.DB
+var db store.Store
+
+// Driver the server stores the database with
+var dbDriver = store.Bolt
+
+// Returned while iterating over a bucket to stop early
+var errStop = errors.New("stop")
+
+// Returned when viewing a bucket the db doesn't have
+var errUnknownBucket = errors.New("The db has no bucket with that name")
 
 // Entry in the db
 type entry struct {
-	Name     string `json:"name"`               // Current name of the entry
-	NewName  string `json:"new_name,omitempty"` // New name of the entry if is going to be updated
-	Password string `json:"password"`           // Password of the entry
-	Token    string `json:"token"`              // oauth2 token of the entry
+	Name     string `json:"name"`             // Current name of the entry
+	NewName  string `json:"-"`                // New name of the entry if is going to be updated, never stored
+	Password string `json:"password"`         // Password hash of the entry, a PHC string recording the hash parameters
+	Token    string `json:"token"`            // oauth2 token of the entry, encrypted if token keys are loaded
+	Scopes   string `json:"scopes,omitempty"` // Spotify scopes the token was granted separated by spaces, empty if unknown
+}
+
+// Sets the driver the server stores the database with, one of "bolt", "sqlite" or "memory"
+func SetDBDriver(driver string) error {
+	switch driver {
+	case "":
+		dbDriver = store.Bolt
+	case store.Bolt, store.SQLite, store.Memory:
+		dbDriver = driver
+	default:
+		return store.ErrUnknownDriver
+	}
+	return nil
 }
 
 // Saves an entry to the database. If overwrite is false then an
@@ -26,9 +57,9 @@ func dbSaveUser(e *entry, overwrite bool) error {
 		return errors.New("Entry must have a valid name")
 	}
 
-	return db.Update(func(tx *bolt.Tx) error {
+	return db.Update(func(tx store.Tx) error {
 		// Get the users bucket
-		b := tx.Bucket([]byte("users"))
+		b := tx.Bucket("users")
 
 		// Exit if key already exists and overwrite set to false
 		if !overwrite && b.Get([]byte(e.Name)) != nil {
@@ -48,20 +79,26 @@ func dbSaveUser(e *entry, overwrite bool) error {
 
 // Deletes a user entry from the database
 func dbDeleteUser(e *entry) error {
-	return db.Update(func(tx *bolt.Tx) error {
+	return db.Update(func(tx store.Tx) error {
 		// Get the users bucket
-		b := tx.Bucket([]byte("users"))
+		b := tx.Bucket("users")
+
+		err := b.Delete([]byte(e.Name))
+		if err != nil {
+			return err
+		}
 
-		return b.Delete([]byte(e.Name))
+		// Their stats go with them
+		return tx.Bucket("stats").Delete([]byte(e.Name))
 	})
 }
 
 // Updates a user's data within the database, this allows
 // the changing of both username and password
 func dbUpdateUser(newEntry *entry) error {
-	return db.Update(func(tx *bolt.Tx) error {
+	return db.Update(func(tx store.Tx) error {
 		// Get the users bucket
-		b := tx.Bucket([]byte("users"))
+		b := tx.Bucket("users")
 
 		// Deserialise the entry
 		var oldEntry entry
@@ -91,6 +128,16 @@ func dbUpdateUser(newEntry *entry) error {
 				if err != nil {
 					return err
 				}
+
+				// Move the user's stats and history to their new name
+				err = moveStats(tx, oldName, oldEntry.Name)
+				if err != nil {
+					return err
+				}
+				err = renameHistory(tx, oldName, oldEntry.Name)
+				if err != nil {
+					return err
+				}
 			} else {
 				return errors.New("Cannot switch name because new name already exists")
 			}
@@ -112,13 +159,42 @@ func dbUpdateUser(newEntry *entry) error {
 	})
 }
 
+// Reads, modifies and writes back a user's entry in one transaction so changes
+// made to the entry at the same time, e.g. a new password, aren't overwritten
+func dbModifyUser(name string, fn func(e *entry) error) error {
+	return db.Update(func(tx store.Tx) error {
+		b := tx.Bucket("users")
+
+		v := b.Get([]byte(name))
+		if v == nil {
+			return errors.New("User does not exist")
+		}
+		var e entry
+		err := json.Unmarshal(v, &e)
+		if err != nil {
+			return err
+		}
+
+		err = fn(&e)
+		if err != nil {
+			return err
+		}
+
+		v, err = json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), v)
+	})
+}
+
 // Returns the deserialised entry for a user from the database
 func dbViewUser(name string) (*entry, error) {
 	var e entry
 
-	err := db.View(func(tx *bolt.Tx) error {
+	err := db.View(func(tx store.Tx) error {
 		// Get the users bucket
-		b := tx.Bucket([]byte("users"))
+		b := tx.Bucket("users")
 
 		// Deserialise the entry
 		err := json.Unmarshal(b.Get([]byte(name)), &e)
@@ -134,34 +210,138 @@ func dbViewUser(name string) (*entry, error) {
 	return &e, nil
 }
 
-// Prints out db as a string
-func dbViewAll() (string, error) {
-	var s string
-	err := db.View(func(tx *bolt.Tx) error {
-		c := tx.Cursor()
-		dumpCursor(tx, c, 0, &s)
-		return nil
+// Returns the deserialised entries of every user
+func dbViewUsers() ([]entry, error) {
+	var entries []entry
+	err := db.View(func(tx store.Tx) error {
+		return tx.Bucket("users").ForEach(func(k, v []byte) error {
+			var e entry
+			err := json.Unmarshal(v, &e)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, e)
+			return nil
+		})
 	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return entries, nil
+}
 
-	return s, nil
+// Value in the db as it's shown when viewing the db
+type dbRecord struct {
+	Bucket string          `json:"bucket"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value"` // JSON values are kept as they are, other values are JSON strings
 }
 
-func dumpCursor(tx *bolt.Tx, c *bolt.Cursor, indent int, s *string) {
-	for k, v := c.First(); k != nil; k, v = c.Next() {
-		if v == nil {
-			*s += fmt.Sprintf(strings.Repeat("\t", indent)+"[%s]\n", k)
-			newBucket := c.Bucket().Bucket(k)
-			if newBucket == nil {
-				newBucket = tx.Bucket(k)
+// Which values are shown when viewing the db
+type ViewFilter struct {
+	Bucket string // Only show values in this bucket
+	Key    string // Only show values with this key, as it's shown
+	Unsafe bool   // Show secrets such as password hashes and tokens instead of redacting them
+}
+
+// Returns the key as text, the audit log's sequence numbers are shown as numbers and other keys which aren't text as hex
+func displayKey(bucket string, k []byte) string {
+	if bucket == "audit" && len(k) == 8 {
+		return strconv.FormatUint(binary.BigEndian.Uint64(k), 10)
+	}
+	if utf8.Valid(k) && strings.IndexFunc(string(k), func(r rune) bool { return !unicode.IsPrint(r) }) == -1 {
+		return string(k)
+	}
+	return hex.EncodeToString(k)
+}
+
+// Returns the values in the db matching the filter, in order of their buckets and keys
+func dbViewRecords(f ViewFilter) ([]dbRecord, error) {
+	records := make([]dbRecord, 0)
+	err := db.View(func(tx store.Tx) error {
+		if f.Bucket != "" && tx.Bucket(f.Bucket) == nil {
+			return errUnknownBucket
+		}
+
+		return tx.ForEach(func(name string, b store.Bucket) error {
+			if f.Bucket != "" && name != f.Bucket {
+				return nil
+			}
+			return b.ForEach(func(k, v []byte) error {
+				key := displayKey(name, k)
+				if f.Key != "" && key != f.Key {
+					return nil
+				}
+				if !f.Unsafe {
+					v = RedactValue(name, v)
+				}
+
+				value := json.RawMessage(append([]byte{}, v...))
+				if !json.Valid(v) {
+					var err error
+					value, err = json.Marshal(string(v))
+					if err != nil {
+						return err
+					}
+				}
+				records = append(records, dbRecord{Bucket: name, Key: key, Value: value})
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Writes the records as a table with a row for each value, values are compacted onto one line
+func writeDBTable(w io.Writer, records []dbRecord) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "BUCKET\tKEY\tVALUE")
+	for _, r := range records {
+		var s string
+		if json.Unmarshal(r.Value, &s) != nil {
+			var buf bytes.Buffer
+			if json.Compact(&buf, r.Value) == nil {
+				s = buf.String()
+			} else {
+				s = string(r.Value)
 			}
-			newCursor := newBucket.Cursor()
-			dumpCursor(tx, newCursor, indent+1, s)
-		} else {
-			*s += fmt.Sprintf(strings.Repeat("\t", indent)+"%s\n", k)
-			*s += fmt.Sprintf(strings.Repeat("\t", indent+1)+"%s\n", v)
 		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Bucket, r.Key, s)
+	}
+	return tw.Flush()
+}
+
+// Writes the records in the format, "table" or "json"
+func writeDBRecords(w io.Writer, records []dbRecord, format string) error {
+	switch format {
+	case "", "table":
+		return writeDBTable(w, records)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	default:
+		return errors.New("Format must be \"table\" or \"json\"")
+	}
+}
+
+// Writes the values in the db at the path matching the filter to the writer as a "table" or "json". The db
+// is opened read only so, if the driver allows it, the server can keep running. Secrets are redacted unless
+// the filter is unsafe
+func ViewDB(driver, dbPath string, w io.Writer, f ViewFilter, format string) error {
+	var err error
+	db, err = store.Open(driver, dbPath, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	records, err := dbViewRecords(f)
+	if err != nil {
+		return err
 	}
+	return writeDBRecords(w, records, format)
 }
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"testing"
+)
+
+// Opens an empty in-memory db with the server's buckets, it's closed when the test ends
+func openTestDB(t *testing.T) {
+	t.Helper()
+	err := openDB(store.Memory, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+}
+
+// Puts the value into the bucket
+func putTestValue(t *testing.T, bucket, key, value string) {
+	t.Helper()
+	err := db.Update(func(tx store.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), []byte(value))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Returns the value in the bucket, nil if it's missing
+func getTestValue(t *testing.T, bucket, key string) []byte {
+	t.Helper()
+	var v []byte
+	err := db.View(func(tx store.Tx) error {
+		if got := tx.Bucket(bucket).Get([]byte(key)); got != nil {
+			v = append([]byte{}, got...)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestModifyUser(t *testing.T) {
+	openTestDB(t)
+	err := dbSaveUser(&entry{Name: "alice", Password: "hash"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dbModifyUser("alice", func(e *entry) error {
+		e.Token = "token"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := dbViewUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Password != "hash" || e.Token != "token" {
+		t.Errorf("entry = %+v, want the password kept and the token set", e)
+	}
+
+	if dbModifyUser("bob", func(e *entry) error { return nil }) == nil {
+		t.Error("modifying a missing user succeeded")
+	}
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"encoding/json"
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"github.com/gin-gonic/gin"
+	"github.com/zmb3/spotify"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits on how many tracks are returned at once
+var (
+	defaultHistoryLimit = 100 // Tracks returned by the admin api if no limit is given
+	maxHistoryLimit     = 1000
+	defaultHistoryCount = 10 // Tracks sent by the HISTORY opcode if no count is given
+	maxHistoryCount     = 50
+)
+
+// Which tracks to return, zero values match everything
+type historyFilter struct {
+	Session string    // Tracks played in sessions hosted by this user
+	User    string    // Tracks this user was present for
+	Before  string    // Tracks recorded before this key, used to page through the history
+	Since   time.Time // Tracks recorded at or after this time
+	Until   time.Time // Tracks recorded before this time
+	Limit   int       // Most tracks to return, the latest ones are kept
+}
+
+// Whether the entry matches the filter
+func (f *historyFilter) matches(e *ws.HistoryEntry) bool {
+	if f.Session != "" && f.Session != e.Session {
+		return false
+	}
+	if f.User == "" {
+		return true
+	}
+	for _, m := range e.Members {
+		if m == f.User {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the key a track is stored under, the time it was recorded followed by the
+// session so keys sort in the order tracks were played and sessions can't collide
+func historyKey(t time.Time, session string) []byte {
+	return []byte(t.UTC().Format(ws.TimeLayout) + "/" + session)
+}
+
+// Creates the entry for the track the host started playing
+func newHistoryEntry(s *session, state *spotify.PlayerState) ws.HistoryEntry {
+	artists := make([]string, 0, len(state.Item.Artists))
+	for _, a := range state.Item.Artists {
+		artists = append(artists, a.Name)
+	}
+
+	members := strings.Split(s.getUsers(), ",")
+	started := time.Now().Add(-time.Duration(state.Progress) * time.Millisecond)
+
+	return ws.HistoryEntry{
+		Session:   s.host.name,
+		URI:       string(state.Item.URI),
+		Name:      state.Item.Name,
+		Artists:   artists,
+		StartedAt: started.UTC().Format(ws.TimeLayout),
+		Members:   members,
+	}
+}
+
+// Adds a track to the history and counts it in the stats of the users who heard it,
+// failures are logged rather than returned so syncing isn't interrupted
+func dbAddHistory(e ws.HistoryEntry) {
+	err := db.Update(func(tx store.Tx) error {
+		v, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket("history").Put(historyKey(time.Now(), e.Session), v)
+		if err != nil {
+			return err
+		}
+		return addTrackStats(tx, e)
+	})
+	if err != nil {
+		Log.Error().Err(err).Str("Session", e.Session).Msg("Failed writing history entry")
+	}
+}
+
+// Returns the tracks matching the filter latest first along with the key to page from
+// to get the tracks before them, the key is empty if there are no more tracks
+func dbViewHistory(f historyFilter) ([]ws.HistoryEntry, string, error) {
+	entries := make([]ws.HistoryEntry, 0)
+	var next string
+	err := db.View(func(tx store.Tx) error {
+		var last, since, until string
+		if !f.Since.IsZero() {
+			since = string(historyKey(f.Since, ""))
+		}
+		if !f.Until.IsZero() {
+			until = string(historyKey(f.Until, ""))
+		}
+
+		err := tx.Bucket("history").ForEachReverse(func(k, v []byte) error {
+			// Keys start with the time so none of the earlier ones can match
+			if since != "" && string(k) < since {
+				return errStop
+			}
+			if (f.Before != "" && string(k) >= f.Before) || (until != "" && string(k) >= until) {
+				return nil
+			}
+
+			var e ws.HistoryEntry
+			err := json.Unmarshal(v, &e)
+			if err != nil {
+				return err
+			}
+			if !f.matches(&e) {
+				return nil
+			}
+
+			// Another matching track means there's a page after this one
+			if f.Limit > 0 && len(entries) >= f.Limit {
+				next = last
+				return errStop
+			}
+			entries = append(entries, e)
+			last = string(k)
+			return nil
+		})
+		if err == errStop {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return entries, next, nil
+}
+
+// Renames the user in the tracks they hosted or were present for so their history follows them
+func renameHistory(tx store.Tx, oldName, newName string) error {
+	b := tx.Bucket("history")
+	renamed := make(map[string][]byte)
+	err := b.ForEach(func(k, v []byte) error {
+		var e ws.HistoryEntry
+		err := json.Unmarshal(v, &e)
+		if err != nil {
+			return err
+		}
+
+		changed := e.Session == oldName
+		if changed {
+			e.Session = newName
+		}
+		for i, m := range e.Members {
+			if m == oldName {
+				e.Members[i] = newName
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+
+		sort.Strings(e.Members)
+		v, err = json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		renamed[string(k)] = v
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The keys keep the old name since they only need to be unique
+	for k, v := range renamed {
+		err = b.Put([]byte(k), v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Records the host's track if it changed since the last one recorded for the session
+func (s *session) recordTrack(state *spotify.PlayerState) *ws.HistoryEntry {
+	if state.Item == nil || !state.Playing || state.Item.URI == s.lastTrack {
+		return nil
+	}
+	s.lastTrack = state.Item.URI
+	e := newHistoryEntry(s, state)
+	dbAddHistory(e)
+	return &e
+}
+
+// Sends the latest tracks the user was present for, the body is how many to send. The
+// server replies with a HISTORY message whose body is the tracks as a JSON array, latest first
+func (u *user) cmdHistory(m *ws.Message) error {
+	n := defaultHistoryCount
+	if body := strings.TrimSpace(m.Body); body != "" {
+		var err error
+		n, err = strconv.Atoi(body)
+		if err != nil || n <= 0 {
+			return u.sendInfo("Usage: history,number of tracks")
+		}
+		if n > maxHistoryCount {
+			n = maxHistoryCount
+		}
+	}
+
+	entries, _, err := dbViewHistory(historyFilter{User: u.name, Limit: n})
+	if err != nil {
+		Log.Error().Err(err).Str("Username", u.name).Msg("Failed viewing history")
+		return u.sendInfo("Failed retrieving history")
+	}
+	body, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	msg := &ws.Message{
+		Op:        "HISTORY",
+		Args:      nil,
+		Body:      string(body),
+		Timestamp: ws.CurrentTime(),
+	}
+	return u.WriteMessage(msg)
+}
+
+// Route for paging through the play history latest first, the tracks can be filtered by the
+// "session" host and a "user" who was present. Each page has the key of its last track as
+// "next", which is given as "before" to get the next page. "limit" is the size of the pages
+func viewHistory(c *gin.Context) {
+	f := historyFilter{
+		Session: c.Query("session"),
+		User:    c.Query("user"),
+		Before:  c.Query("before"),
+		Limit:   defaultHistoryLimit,
+	}
+	if l := c.Query("limit"); l != "" {
+		var err error
+		f.Limit, err = strconv.Atoi(l)
+		if err != nil || f.Limit <= 0 || f.Limit > maxHistoryLimit {
+			c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Limit must be a number from 1 to " + strconv.Itoa(maxHistoryLimit)})
+			return
+		}
+	}
+
+	entries, next, err := dbViewHistory(f)
+	if err != nil {
+		Log.Error().Err(err).Msg("Error viewing history")
+		c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error viewing history"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "error": "", "history": entries, "next": next})
+}
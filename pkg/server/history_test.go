@@ -0,0 +1,59 @@
+package server
+
+import (
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRenameKeepsHistory(t *testing.T) {
+	openTestDB(t)
+	for _, name := range []string{"alice", "bob"} {
+		err := dbSaveUser(&entry{Name: name, Password: "hash"}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// History keys are the time in milliseconds so the tracks are recorded apart
+	for _, e := range []ws.HistoryEntry{
+		{Session: "alice", URI: "spotify:track:1", Members: []string{"alice", "bob"}},
+		{Session: "bob", URI: "spotify:track:2", Members: []string{"alice", "bob"}},
+		{Session: "bob", URI: "spotify:track:3", Members: []string{"bob"}},
+	} {
+		dbAddHistory(e)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	err := dbUpdateUser(&entry{Name: "alice", NewName: "zoe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filter historyFilter
+		uris   []string
+	}{
+		{historyFilter{User: "zoe"}, []string{"spotify:track:2", "spotify:track:1"}},
+		{historyFilter{User: "alice"}, []string{}},
+		{historyFilter{Session: "zoe"}, []string{"spotify:track:1"}},
+		{historyFilter{User: "bob"}, []string{"spotify:track:3", "spotify:track:2", "spotify:track:1"}},
+	}
+	for _, tt := range tests {
+		entries, _, err := dbViewHistory(tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uris := make([]string, 0, len(entries))
+		for _, e := range entries {
+			uris = append(uris, e.URI)
+			if e.URI != "spotify:track:3" && !reflect.DeepEqual(e.Members, []string{"bob", "zoe"}) {
+				t.Errorf("%s: members = %v, want them renamed and sorted", e.URI, e.Members)
+			}
+		}
+		if !reflect.DeepEqual(uris, tt.uris) {
+			t.Errorf("%+v: tracks = %v, want %v", tt.filter, uris, tt.uris)
+		}
+	}
+}
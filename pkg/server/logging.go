@@ -30,12 +30,13 @@ func createLogger(logLevel string) (zerolog.Logger, error) {
 	}
 
 	// Create the data dir
-	if _, err := os.Stat("data"); os.IsNotExist(err) {
-		os.Mkdir("data", os.ModeDir)
+	err := createDataDirs()
+	if err != nil {
+		return zerolog.Logger{}, err
 	}
 
 	// Creates a file for writing logs to
-	logFile, err := os.OpenFile("data/server.log", os.O_APPEND|os.O_CREATE|os.O_RDWR, 0777)
+	logFile, err := os.OpenFile(dataPath("server.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
 		return zerolog.Logger{}, err
 	}
@@ -3,43 +3,77 @@ package server
 import (
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"github.com/zmb3/spotify"
 	"net/http"
 )
 
 // Accepts requests from a client and upgrades the connection to a
 // shared connection. The server and client perform an initial
 // handshake where the client is sent an authentication URL and is
-// given 5 minutes to sign in. If approved then begin serving the client
+// given 5 minutes to sign in. If approved then begin serving the client.
+// Clients holding a resume token skip straight to being served again
 func processIncomingUserWebsocket(c *gin.Context) {
-	// Create a new user
-	u := user{w: c.Writer, r: c.Request}
+	serving.Add(1)
+	defer serving.Done()
+
+	// Refuse the connection if the IP address or server already has too many open
+	ip := remoteIP(c.Request)
+	release, reason := acquireConn(ip)
+	if release == nil {
+		Log.Warn().Str("Remote", ip).Str("Reason", reason).Msg("Rejected websocket connection")
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"msg": "Too many connections"})
+		return
+	}
+
+	// Create a new user, the connection is counted until it closes
+	u := &user{w: &limitedWriter{ResponseWriter: c.Writer, release: release}, r: c.Request}
 
 	// Upgrade the user's connection to a shared connection
 	err := u.upgrade()
 	if err != nil {
+		release()
 		Log.Debug().Err(err).Msg("Cannot upgrade user to websocket connection")
 		return
 	}
 
-	Log.Trace().Interface("user", u).Msg("user handshake")
+	Log.Trace().Str("Remote", c.Request.RemoteAddr).Msg("user handshake")
 
 	// Perform the handshake to authenticate the user's spotify connection
-	err = u.handshake()
+	resumed, err := u.handshake()
 	if err != nil {
 		Log.Debug().Err(err).Msg("Cannot perform handshake with user")
-		u.disconnect()
+		if resumed != nil && resumed != u {
+			// The resumed user goes back to waiting for a connection
+			resumed.connectionLost(u.conn, err)
+		} else {
+			u.disconnect()
+		}
+		return
+	}
+
+	// If the user resumed a previous connection then keep serving them
+	if resumed != u {
+		serving.Add(1)
+		go resumed.readPump()
 		return
 	}
 
 	// Generate spotify user data
-	if u.spotifyClient == (spotify.Client{}) {
+	if u.spotifyClient == nil {
 		Log.Debug().Err(err).Str("Username", u.name).Msg("User handshake not successful since no spotify client")
 		u.disconnect()
 		return
 	}
 
+	// If the token saved in the db can no longer be refreshed then authorise again
 	u.spotifyData, err = u.spotifyClient.CurrentUser()
+	if err != nil && isTokenRevoked(err) {
+		Log.Debug().Err(err).Str("Username", u.name).Msg("Saved spotify token revoked")
+		_ = u.sendInfo("Spotify access expired, please authorise again")
+		err = u.authorise()
+		if err == nil {
+			u.spotifyData, err = u.spotifyClient.CurrentUser()
+		}
+	}
 	if err != nil {
 		Log.Debug().Err(err).Str("Username", u.name).Msg("Cannot get user's spotify data")
 		u.disconnect()
@@ -48,32 +82,42 @@ func processIncomingUserWebsocket(c *gin.Context) {
 
 	// Serve the user (in a new goroutine)
 	Log.Info().Str("Username", u.name).Str("Spotify Name", u.spotifyData.DisplayName).Msg("Serving user")
+	u.mutex.Lock()
+	u.served = true
+	u.mutex.Unlock()
+	serving.Add(1)
 	go u.readPump()
 }
 
 // When user's use the authentication url they are redirected to this
-// route where a spotify client to control their playback is created
+// route where the token used to control their playback is created
 func spotifyCallback(c *gin.Context) {
-	// If state is incorrect then return 404
+	// The state must belong to a pending authorisation, otherwise return 401
 	st := c.Query("state")
-	if !ids.Has(st) {
-		Log.Debug().Str("state", st).Msg("State mismatch")
+	p := takePendingAuth(st)
+	if p == nil {
+		Log.Debug().Msg("Unknown or expired state")
 		http.Error(c.Writer, "State mismatch", http.StatusUnauthorized)
 		return
 	}
 
-	// Authenticate the token
-	token, err := auth.Token(st, c.Request)
+	// The user may have denied access
+	if e := c.Query("error"); e != "" {
+		Log.Debug().Str("Username", p.u.name).Str("error", e).Msg("User did not authorise access")
+		p.token <- nil
+		http.Error(c.Writer, "Access was not authorised", http.StatusUnauthorized)
+		return
+	}
+
+	// Exchange the code for the token
+	token, err := p.exchange(c.Query("code"))
 	if err != nil {
-		Log.Debug().Str("state", st).Msg("Couldn't retrieve token")
+		Log.Debug().Err(err).Str("Username", p.u.name).Msg("Couldn't retrieve token")
+		p.token <- nil
 		http.Error(c.Writer, "Couldn't get token", http.StatusUnauthorized)
 		return
 	}
-	tokenChans[st] <- token
-
-	// Create a client using the specified token
-	clientChans[st] <- auth.NewClient(token)
-	Log.Debug().Str("state", st).Msg("Couldn't create spotify client")
+	p.token <- token
 
 	// Send a response back
 	fmt.Fprintf(c.Writer, "Return to the client")
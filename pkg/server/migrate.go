@@ -0,0 +1,223 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"strconv"
+	"time"
+)
+
+// Returned by the migration transaction when dry running so its changes are rolled back
+var errDryRun = errors.New("dry run")
+
+// Whether the db is backed up before migrations are applied by the server
+var migrateBackup = true
+
+// Change to the layout of the db, migrations are applied in order and each one is
+// only ever applied once. They must only be appended so the versions don't change
+type migration struct {
+	description string
+	apply       func(tx store.Tx) (int, error) // Applies the migration and returns how many values it changed
+}
+
+// Migrations which bring the db up to the current schema, the schema version
+// stored in the db is the number of migrations which have been applied
+var migrations = []migration{
+	{"Remove new_name from user entries", stripNewNames},
+	{"Clear null tokens from user entries", clearNullTokens},
+	{"Compute listening stats from the play history", backfillStats},
+}
+
+// Migration which was applied or, when dry running, would be applied
+type MigrationResult struct {
+	Version     int    // Schema version after the migration
+	Description string // What the migration does
+	Changed     int    // How many values it changed
+}
+
+func (r MigrationResult) String() string {
+	return fmt.Sprintf("v%d: %s (%d changed)", r.Version, r.Description, r.Changed)
+}
+
+// Sets whether the server backs up the db before applying migrations
+func SetMigrationBackup(enabled bool) {
+	migrateBackup = enabled
+}
+
+// Returns the schema version stored in the db, 0 if it has never been migrated
+func schemaVersion(tx store.Tx) (int, error) {
+	b := tx.Bucket("meta")
+	if b == nil {
+		return 0, nil
+	}
+	v := b.Get([]byte("schema_version"))
+	if v == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(v))
+}
+
+// Whether none of the db's buckets have any values, i.e. the db was just created
+func dbEmpty(tx store.Tx) bool {
+	empty := true
+	_ = tx.ForEach(func(name string, b store.Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			empty = false
+			return errStop
+		})
+	})
+	return empty
+}
+
+// Applies the migrations the db hasn't had yet. If dryRun is true the migrations are run but rolled
+// back so their results show what would change. If backupPath isn't empty the db is copied there
+// before anything changes, no backup is made if there's nothing to migrate or the db is empty
+func migrateDB(dryRun bool, backupPath string) ([]MigrationResult, error) {
+	var version int
+	var empty bool
+	err := db.View(func(tx store.Tx) error {
+		var err error
+		version, err = schemaVersion(tx)
+		empty = dbEmpty(tx)
+		return err
+	})
+	if err != nil {
+		return nil, errors.New("Cannot read schema version: " + err.Error())
+	}
+	if version > len(migrations) {
+		return nil, fmt.Errorf("db schema version %d is newer than this version supports (%d)", version, len(migrations))
+	}
+	if version == len(migrations) {
+		return nil, nil
+	}
+
+	if !dryRun && !empty && backupPath != "" {
+		err = db.Backup(backupPath)
+		if err != nil {
+			return nil, errors.New("Cannot back up db before migrating: " + err.Error())
+		}
+	}
+
+	// Every migration happens in one transaction so a failure leaves the db as it was
+	var results []MigrationResult
+	err = db.Update(func(tx store.Tx) error {
+		for i := version; i < len(migrations); i++ {
+			m := migrations[i]
+			n, err := m.apply(tx)
+			if err != nil {
+				return fmt.Errorf("migration v%d (%s) failed: %s", i+1, m.description, err)
+			}
+			results = append(results, MigrationResult{Version: i + 1, Description: m.description, Changed: n})
+		}
+
+		b, err := tx.CreateBucketIfNotExists("meta")
+		if err != nil {
+			return err
+		}
+		err = b.Put([]byte("schema_version"), []byte(strconv.Itoa(len(migrations))))
+		if err != nil {
+			return err
+		}
+
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && err != errDryRun {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Returns where the db is backed up to before being migrated from its current version
+func migrationBackupPath(dbPath string) (string, error) {
+	var version int
+	err := db.View(func(tx store.Tx) error {
+		var err error
+		version, err = schemaVersion(tx)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s.v%d-%s.bak", dbPath, version, time.Now().UTC().Format("20060102150405")), nil
+}
+
+// Migrates the db at the path to the current schema, see migrateDB. The server must not be running
+func Migrate(driver, dbPath string, dryRun, backup bool) ([]MigrationResult, error) {
+	var err error
+	db, err = store.Open(driver, dbPath, false)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var backupPath string
+	if backup {
+		backupPath, err = migrationBackupPath(dbPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return migrateDB(dryRun, backupPath)
+}
+
+// Rewrites every value in the bucket which the function changes, the function is given the value decoded
+// as a JSON object and returns whether it changed it. Values which aren't JSON objects are left alone
+func rewriteJSON(tx store.Tx, bucket string, fn func(v map[string]interface{}) bool) (int, error) {
+	b := tx.Bucket(bucket)
+	if b == nil {
+		return 0, nil
+	}
+
+	// Collect the changes first since the bucket can't be changed while it's iterated
+	changed := make(map[string][]byte)
+	err := b.ForEach(func(k, v []byte) error {
+		var obj map[string]interface{}
+		if json.Unmarshal(v, &obj) != nil || obj == nil || !fn(obj) {
+			return nil
+		}
+		nv, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		changed[string(k)] = nv
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for k, v := range changed {
+		err = b.Put([]byte(k), v)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(changed), nil
+}
+
+// Renaming users used to save their new name into their entry
+func stripNewNames(tx store.Tx) (int, error) {
+	return rewriteJSON(tx, "users", func(e map[string]interface{}) bool {
+		if _, ok := e["new_name"]; !ok {
+			return false
+		}
+		delete(e, "new_name")
+		return true
+	})
+}
+
+// Users who never authorised spotify used to have their missing token saved as "null"
+func clearNullTokens(tx store.Tx) (int, error) {
+	return rewriteJSON(tx, "users", func(e map[string]interface{}) bool {
+		if e["token"] != "null" {
+			return false
+		}
+		e["token"] = ""
+		return true
+	})
+}
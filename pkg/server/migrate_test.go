@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+func TestMigrateDB(t *testing.T) {
+	openTestDB(t)
+	putTestValue(t, "users", "alice", `{"name":"alice","new_name":"alicia","token":"null"}`)
+	putTestValue(t, "users", "bob", `{"name":"bob","token":""}`)
+	putTestValue(t, "history", "2021-03-01T20:00:00.000Z/alice",
+		`{"session":"alice","uri":"spotify:track:a","name":"A","artists":["X"],"members":["alice","bob"]}`)
+
+	// Dry runs report what would change without changing anything
+	results, err := migrateDB(true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{1, 1, 1}
+	if len(results) != len(migrations) || len(want) != len(migrations) {
+		t.Fatalf("results = %v, want %d migrations", results, len(migrations))
+	}
+	for i, r := range results {
+		if r.Version != i+1 || r.Changed != want[i] {
+			t.Errorf("result %d = %v, want v%d with %d changed", i, r, i+1, want[i])
+		}
+	}
+	if v := getTestValue(t, "users", "alice"); string(v) != `{"name":"alice","new_name":"alicia","token":"null"}` {
+		t.Errorf("dry run changed alice to %s", v)
+	}
+	if v := getTestValue(t, "meta", "schema_version"); v != nil {
+		t.Errorf("dry run set the schema version to %s", v)
+	}
+
+	results, err = migrateDB(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(migrations) {
+		t.Fatalf("results = %v, want %d migrations", results, len(migrations))
+	}
+	if v := getTestValue(t, "meta", "schema_version"); string(v) != strconv.Itoa(len(migrations)) {
+		t.Errorf("schema version = %s, want %d", v, len(migrations))
+	}
+
+	var alice map[string]interface{}
+	err = json.Unmarshal(getTestValue(t, "users", "alice"), &alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := alice["new_name"]; ok || alice["token"] != "" {
+		t.Errorf("alice = %v, want no new_name and an empty token", alice)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		s, err := dbViewStats(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Tracks != 1 || s.Artists["X"] != 1 {
+			t.Errorf("%s stats = %+v, want the history's track counted", name, s)
+		}
+	}
+
+	// Migrations are only applied once
+	results, err = migrateDB(false, "")
+	if err != nil || len(results) != 0 {
+		t.Errorf("migrating again = %v, %v, want nothing applied", results, err)
+	}
+}
+
+func TestMigrateNewerDB(t *testing.T) {
+	openTestDB(t)
+	putTestValue(t, "meta", "schema_version", strconv.Itoa(len(migrations)+1))
+
+	_, err := migrateDB(false, "")
+	if err == nil {
+		t.Error("migrating a db newer than the server succeeded")
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"golang.org/x/oauth2"
+	"sync"
+	"time"
+)
+
+// How long a user has to authorise spotify after being sent an auth URL
+var authTimeout = 5 * time.Minute
+
+// Authorisation waiting for the user to return through the spotify callback,
+// each one is identified by the random state sent in the user's auth URL
+type pendingAuth struct {
+	u        *user
+	verifier string             // PKCE code verifier, only its challenge is sent in the auth URL
+	expiry   time.Time          // When the state stops being accepted
+	token    chan *oauth2.Token // Receives the token (or nil if authorising failed)
+	cancel   chan struct{}      // Closed if the user disconnects while authorising
+}
+
+// Pending authorisations by their state
+var pendingAuths = make(map[string]*pendingAuth)
+var pendingMtx sync.Mutex
+
+// Creates a pending authorisation for the user and returns the auth URL they should visit
+func (u *user) newPendingAuth() (string, *pendingAuth, error) {
+	state, err := generateToken()
+	if err != nil {
+		return "", nil, err
+	}
+	verifier, err := generateToken()
+	if err != nil {
+		return "", nil, err
+	}
+	p := &pendingAuth{
+		u:        u,
+		verifier: verifier,
+		expiry:   time.Now().Add(authTimeout),
+		token:    make(chan *oauth2.Token, 1),
+		cancel:   make(chan struct{}),
+	}
+
+	pendingMtx.Lock()
+	for s, other := range pendingAuths {
+		if time.Now().After(other.expiry) {
+			delete(pendingAuths, s)
+		}
+	}
+	pendingAuths[state] = p
+	pendingMtx.Unlock()
+
+	// The challenge lets spotify check the token is exchanged by whoever made the auth URL
+	challenge := sha256.Sum256([]byte(verifier))
+	url := auth.AuthURLWithOpts(state,
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+	return url, p, nil
+}
+
+// Returns the pending authorisation for the state and removes it so the state can
+// only be used once, nil is returned if the state is unknown or has expired
+func takePendingAuth(state string) *pendingAuth {
+	pendingMtx.Lock()
+	defer pendingMtx.Unlock()
+
+	p, ok := pendingAuths[state]
+	if !ok {
+		return nil
+	}
+	delete(pendingAuths, state)
+	if time.Now().After(p.expiry) {
+		return nil
+	}
+	return p
+}
+
+// Removes the user's pending authorisations, any handshake waiting on them is cancelled
+func (u *user) cancelPendingAuths() {
+	pendingMtx.Lock()
+	defer pendingMtx.Unlock()
+
+	for s, p := range pendingAuths {
+		if p.u == u {
+			delete(pendingAuths, s)
+			close(p.cancel)
+		}
+	}
+}
+
+// Exchanges the authorisation code for a token, proving the exchange is
+// made by the server which created the auth URL with the PKCE verifier
+func (p *pendingAuth) exchange(code string) (*oauth2.Token, error) {
+	return auth.Exchange(code, oauth2.SetAuthURLParam("code_verifier", p.verifier))
+}
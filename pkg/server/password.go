@@ -0,0 +1,131 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"strings"
+)
+
+// Parameters used to hash passwords with argon2id, these follow the
+// second recommended option of RFC 9106. Hashes made with other
+// parameters are still verified but are rehashed on the next login
+var (
+	argonTime    uint32 = 3
+	argonMemory  uint32 = 64 * 1024 // In KiB
+	argonThreads uint8  = 4
+	argonKeyLen  uint32 = 32
+	argonSaltLen        = 16
+)
+
+// Limits on the parameters of stored hashes, hashes come from imports so they aren't trusted
+// and argon2 panics on zero rounds or threads while large costs would stall every login
+const (
+	maxArgonTime   = 32
+	maxArgonMemory = 1024 * 1024 // 1 GiB in KiB
+	maxArgonKeyLen = 1024
+)
+
+// Parsed argon2id PHC string
+type argonHash struct {
+	memory     uint32
+	iterations uint32
+	threads    uint8
+	salt       []byte
+	key        []byte
+}
+
+// Hashes a password with argon2id using a random salt, the result is encoded in the PHC
+// string format so the parameters used are recorded alongside the hash in the entry, i.e.
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+func hashPassword(pass string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(pass), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verifies a password against a stored hash. Hashes which aren't in the PHC format are the
+// legacy unsalted SHA-256 hashes, if these (or argon2id hashes made with outdated parameters)
+// match then rehash is true and the password should be hashed again with hashPassword
+func verifyPassword(hash, pass string) (ok, rehash bool, err error) {
+	if !strings.HasPrefix(hash, "$") {
+		ok = subtle.ConstantTimeCompare([]byte(hash), []byte(legacyHash(pass))) == 1
+		return ok, ok, nil
+	}
+
+	h, err := parseArgonHash(hash)
+	if err != nil {
+		return false, false, err
+	}
+
+	// Hash the password with the same parameters and compare
+	other := argon2.IDKey([]byte(pass), h.salt, h.iterations, h.memory, h.threads, uint32(len(h.key)))
+	if subtle.ConstantTimeCompare(h.key, other) != 1 {
+		return false, false, nil
+	}
+
+	rehash = h.memory != argonMemory || h.iterations != argonTime || h.threads != argonThreads || uint32(len(h.key)) != argonKeyLen
+	return true, rehash, nil
+}
+
+// Parses an argon2id PHC string, fails if its version isn't supported or its parameters are out of range
+func parseArgonHash(hash string) (*argonHash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, errors.New("Unsupported password hash format")
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, errors.New("Unsupported argon2 version")
+	}
+
+	var h argonHash
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.iterations, &h.threads)
+	if err != nil {
+		return nil, errors.New("Password hash has invalid parameters")
+	}
+	if h.iterations < 1 || h.iterations > maxArgonTime || h.threads < 1 || h.memory < 8*uint32(h.threads) || h.memory > maxArgonMemory {
+		return nil, errors.New("Password hash parameters are out of range")
+	}
+
+	h.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(h.salt) == 0 {
+		return nil, errors.New("Password hash is malformed")
+	}
+	h.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(h.key) == 0 || len(h.key) > maxArgonKeyLen {
+		return nil, errors.New("Password hash is malformed")
+	}
+	return &h, nil
+}
+
+// Checks the hash is one verifyPassword can verify, i.e. when it's imported from another server
+func checkPasswordHash(hash string) error {
+	if !strings.HasPrefix(hash, "$") {
+		b, err := base64.URLEncoding.DecodeString(hash)
+		if err != nil || len(b) != sha256.Size {
+			return errors.New("Unsupported password hash format")
+		}
+		return nil
+	}
+
+	_, err := parseArgonHash(hash)
+	return err
+}
+
+// The legacy password hash, an unsalted SHA-256 encoded as url safe base 64
+func legacyHash(pass string) string {
+	h := sha256.Sum256([]byte(pass))
+	return base64.URLEncoding.EncodeToString(h[:])
+}
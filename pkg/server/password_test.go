@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"strings"
+	"testing"
+)
+
+// Encodes an argon2id hash of the password made with the parameters
+func argonTestHash(pass string, version int, m, t uint32, p uint8) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(pass), salt, t, m, p, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", version, m, t, p,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=3,p=4$") {
+		t.Errorf("hash = %s, want the current parameters", hash)
+	}
+	if err = checkPasswordHash(hash); err != nil {
+		t.Errorf("check: %s", err)
+	}
+
+	other, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == hash {
+		t.Error("hashes of the same password are equal, the salt isn't random")
+	}
+
+	ok, rehash, err := verifyPassword(hash, "correct horse")
+	if !ok || rehash || err != nil {
+		t.Errorf("verify = %v, %v, %v, want true, false, nil", ok, rehash, err)
+	}
+	ok, _, err = verifyPassword(hash, "wrong horse")
+	if ok || err != nil {
+		t.Errorf("verify wrong password = %v, %v, want false, nil", ok, err)
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	tests := []struct {
+		name    string
+		hash    string
+		pass    string
+		ok      bool
+		rehash  bool
+		wantErr bool
+	}{
+		{"legacy", legacyHash("secret"), "secret", true, true, false},
+		{"legacy wrong password", legacyHash("secret"), "other", false, false, false},
+		{"outdated parameters", argonTestHash("secret", argon2.Version, 64, 1, 1), "secret", true, true, false},
+		{"outdated parameters wrong password", argonTestHash("secret", argon2.Version, 64, 1, 1), "other", false, false, false},
+		{"zero rounds", "$argon2id$v=19$m=64,t=0,p=1$MDEyMzQ1Njc4OWFiY2RlZg$AAAA", "secret", false, false, true},
+		{"zero threads", "$argon2id$v=19$m=64,t=1,p=0$MDEyMzQ1Njc4OWFiY2RlZg$AAAA", "secret", false, false, true},
+		{"too many threads", "$argon2id$v=19$m=4096,t=1,p=256$MDEyMzQ1Njc4OWFiY2RlZg$AAAA", "secret", false, false, true},
+		{"too much memory", "$argon2id$v=19$m=4294967295,t=1,p=1$MDEyMzQ1Njc4OWFiY2RlZg$AAAA", "secret", false, false, true},
+		{"too many rounds", "$argon2id$v=19$m=64,t=4294967295,p=1$MDEyMzQ1Njc4OWFiY2RlZg$AAAA", "secret", false, false, true},
+		{"old version", argonTestHash("secret", 16, 64, 1, 1), "secret", false, false, true},
+		{"empty salt", "$argon2id$v=19$m=64,t=1,p=1$$AAAA", "secret", false, false, true},
+		{"empty key", "$argon2id$v=19$m=64,t=1,p=1$MDEyMzQ1Njc4OWFiY2RlZg$", "secret", false, false, true},
+		{"argon2i", "$argon2i$v=19$m=64,t=1,p=1$MDEyMzQ1Njc4OWFiY2RlZg$AAAA", "secret", false, false, true},
+		{"malformed", "$argon2id$v=19$m=64,t=1,p=1", "secret", false, false, true},
+	}
+	for _, tt := range tests {
+		ok, rehash, err := verifyPassword(tt.hash, tt.pass)
+		if ok != tt.ok || rehash != tt.rehash || (err != nil) != tt.wantErr {
+			t.Errorf("%s: verify = %v, %v, %v, want %v, %v, error %v", tt.name, ok, rehash, err, tt.ok, tt.rehash, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckPasswordHash(t *testing.T) {
+	tests := []struct {
+		name    string
+		hash    string
+		wantErr bool
+	}{
+		{"legacy", legacyHash("secret"), false},
+		{"argon2id", argonTestHash("secret", argon2.Version, 64, 1, 1), false},
+		{"legacy wrong length", base64.URLEncoding.EncodeToString([]byte("short")), true},
+		{"not base64", "not a hash", true},
+		{"zero rounds", "$argon2id$v=19$m=64,t=0,p=1$MDEyMzQ1Njc4OWFiY2RlZg$AAAA", true},
+		{"zero threads", "$argon2id$v=19$m=64,t=1,p=0$MDEyMzQ1Njc4OWFiY2RlZg$AAAA", true},
+		{"too much memory", "$argon2id$v=19$m=4294967295,t=1,p=1$MDEyMzQ1Njc4OWFiY2RlZg$AAAA", true},
+		{"old version", argonTestHash("secret", 16, 64, 1, 1), true},
+		{"empty salt", "$argon2id$v=19$m=64,t=1,p=1$$AAAA", true},
+		{"bad base64", "$argon2id$v=19$m=64,t=1,p=1$!!!$AAAA", true},
+	}
+	for _, tt := range tests {
+		err := checkPasswordHash(tt.hash)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: check = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
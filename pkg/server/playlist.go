@@ -0,0 +1,296 @@
+package server
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"github.com/gin-gonic/gin"
+	"github.com/zmb3/spotify"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Formats the play history can be exported as
+const (
+	playlistM3U  = "m3u"
+	playlistXSPF = "xspf"
+	playlistJSON = "json"
+)
+
+// Content types of the playlist formats
+var playlistContentTypes = map[string]string{
+	playlistM3U:  "audio/x-mpegurl",
+	playlistXSPF: "application/xspf+xml",
+	playlistJSON: "application/json",
+}
+
+// Scope needed to create playlists in a user's account, playlists are private so the public scope isn't needed
+const playlistScope = spotify.ScopePlaylistModifyPrivate
+
+// Most tracks spotify adds to a playlist in one request
+var playlistChunkSize = 100
+
+// XSPF playlist, see https://xspf.org/spec
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version string      `xml:"version,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Date    string      `xml:"date"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location   string `xml:"location"`
+	Identifier string `xml:"identifier"`
+	Title      string `xml:"title"`
+	Creator    string `xml:"creator,omitempty"`
+	Annotation string `xml:"annotation,omitempty"`
+}
+
+// Ensures the playlist format is one the history can be exported as
+func checkPlaylistFormat(format string) error {
+	if _, ok := playlistContentTypes[format]; !ok {
+		return errors.New("Format must be \"m3u\", \"xspf\" or \"json\"")
+	}
+	return nil
+}
+
+// Writes the tracks to the writer as a playlist in the format, the tracks should be in the order they were played
+func writePlaylist(w io.Writer, tracks []ws.HistoryEntry, format, title string) error {
+	switch format {
+	case playlistM3U:
+		_, err := fmt.Fprintf(w, "#EXTM3U\n#PLAYLIST:%s\n", title)
+		if err != nil {
+			return err
+		}
+		for _, t := range tracks {
+			// The duration isn't recorded so it's unknown (-1)
+			_, err = fmt.Fprintf(w, "#EXTINF:-1,%s\n%s\n", trackTitle(t), t.URI)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case playlistXSPF:
+		p := xspfPlaylist{Version: "1", Title: title, Date: ws.CurrentTime(), Tracks: make([]xspfTrack, 0, len(tracks))}
+		for _, t := range tracks {
+			p.Tracks = append(p.Tracks, xspfTrack{
+				Location:   t.URI,
+				Identifier: t.URI,
+				Title:      t.Name,
+				Creator:    strings.Join(t.Artists, ", "),
+				Annotation: fmt.Sprintf("Played in %s's session at %s", t.Session, t.StartedAt),
+			})
+		}
+		_, err := io.WriteString(w, xml.Header)
+		if err != nil {
+			return err
+		}
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		err = enc.Encode(p)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, "\n")
+		return err
+	case playlistJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(tracks)
+	default:
+		return checkPlaylistFormat(format)
+	}
+}
+
+// Returns "artists - name" for the track, or just its name if it has no artists
+func trackTitle(t ws.HistoryEntry) string {
+	if len(t.Artists) == 0 {
+		return t.Name
+	}
+	return strings.Join(t.Artists, ", ") + " - " + t.Name
+}
+
+// Returns the tracks matching the filter in the order they were played
+func dbPlaylistTracks(f historyFilter) ([]ws.HistoryEntry, error) {
+	f.Limit = 0
+	tracks, _, err := dbViewHistory(f)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(tracks)-1; i < j; i, j = i+1, j-1 {
+		tracks[i], tracks[j] = tracks[j], tracks[i]
+	}
+	return tracks, nil
+}
+
+// Route for exporting the play history as a playlist in the "format" (m3u, xspf or json). The tracks
+// can be filtered like the history by "session" and "user" and by the "since" and "until" RFC3339 times
+func exportHistory(c *gin.Context) {
+	format := c.DefaultQuery("format", playlistM3U)
+	err := checkPlaylistFormat(format)
+	if err != nil {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	f := historyFilter{Session: c.Query("session"), User: c.Query("user")}
+	f.Since, err = parseAuditTime(c.Query("since"))
+	if err != nil {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Since must be an RFC3339 time"})
+		return
+	}
+	f.Until, err = parseAuditTime(c.Query("until"))
+	if err != nil {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Until must be an RFC3339 time"})
+		return
+	}
+
+	tracks, err := dbPlaylistTracks(f)
+	if err != nil {
+		Log.Error().Err(err).Msg("Error exporting history")
+		c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error exporting history"})
+		return
+	}
+
+	title := "Spotify Sync history"
+	name := "history"
+	if usernameRegex.MatchString(f.Session) {
+		title = f.Session + "'s session"
+		name += "-" + f.Session
+	}
+	c.Header("Content-Type", playlistContentTypes[format])
+	c.Header("Content-Disposition", "attachment; filename=\""+name+"."+format+"\"")
+	c.Status(200)
+	err = writePlaylist(c.Writer, tracks, format, title)
+	if err != nil {
+		Log.Error().Err(err).Msg("Error writing history playlist")
+	}
+}
+
+// Whether the user's spotify token was granted the scope. Players provided to
+// the server aren't authorised through spotify so they have every scope
+func (u *user) hasSpotifyScope(scope string) bool {
+	if players != nil {
+		return true
+	}
+	e, err := dbViewUser(u.name)
+	if err != nil {
+		return false
+	}
+	for _, s := range strings.Fields(e.Scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether spotify refused the request because the token lacks a scope, spotify responds with 403
+// "Insufficient client scope". Other 403s, e.g. for accounts without premium or playlists the user
+// can't change, aren't fixed by authorising again so they're reported like any other error
+func isScopeError(err error) bool {
+	var se spotify.Error
+	return errors.As(err, &se) && se.Status == http.StatusForbidden &&
+		strings.Contains(strings.ToLower(se.Message), "insufficient client scope")
+}
+
+// Saves the tracks played in the user's current session to a new private playlist in their spotify
+// account, the body is the playlist's name. If the user's token wasn't granted the playlist scope
+// then they're asked to authorise spotify again and the playlist is saved once they have. On
+// success the server replies with a SAVE message whose args are the playlist's URI
+func (u *user) cmdSave(m *ws.Message) error {
+	if u.s == nil {
+		return u.sendInfo("Join a session to save the tracks played in it")
+	}
+	host, created := u.s.host.name, u.s.created
+
+	name := strings.TrimSpace(m.Body)
+	if name == "" {
+		name = fmt.Sprintf("%s's session %s", host, created.Local().Format("2006-01-02"))
+	}
+
+	if !u.hasSpotifyScope(playlistScope) {
+		u.upgradeScopes(name, host, created)
+		return nil
+	}
+	err := u.savePlaylist(name, host, created)
+	if isScopeError(err) {
+		u.upgradeScopes(name, host, created)
+		return nil
+	}
+	if err != nil {
+		Log.Warn().Err(err).Str("Username", u.name).Msg("Failed saving playlist")
+		return u.sendInfo("Failed saving playlist: " + err.Error())
+	}
+	return nil
+}
+
+// Asks the user to authorise spotify again so their token is granted the playlist scope, the
+// playlist is saved once they have. Saving is only retried once, if it fails again the error is
+// reported rather than asking again. If they're already authorising they're told to finish first
+func (u *user) upgradeScopes(name, host string, created time.Time) {
+	Log.Info().Str("Username", u.name).Msg("Asking user to authorise playlist access")
+	started := u.reauthorise("Saving playlists needs access to your spotify playlists, please authorise again", func() {
+		err := u.savePlaylist(name, host, created)
+		if isScopeError(err) {
+			Log.Warn().Err(err).Str("Username", u.name).Msg("Playlist access not granted after authorising")
+			_ = u.sendInfo("Failed saving playlist: access to your spotify playlists wasn't granted")
+		} else if err != nil {
+			Log.Warn().Err(err).Str("Username", u.name).Msg("Failed saving playlist")
+			_ = u.sendInfo("Failed saving playlist: " + err.Error())
+		}
+	})
+	if !started {
+		_ = u.sendInfo("Finish authorising spotify before saving a playlist")
+	}
+}
+
+// Creates the playlist from the tracks played in the session since it was created
+func (u *user) savePlaylist(name, host string, created time.Time) error {
+	tracks, err := dbPlaylistTracks(historyFilter{Session: host, Since: created})
+	if err != nil {
+		return err
+	}
+	var ids []spotify.ID
+	for _, t := range tracks {
+		if strings.HasPrefix(t.URI, "spotify:track:") {
+			ids = append(ids, spotify.ID(strings.TrimPrefix(t.URI, "spotify:track:")))
+		}
+	}
+	if len(ids) == 0 {
+		return u.sendInfo("No tracks have been played in this session yet")
+	}
+
+	me, err := u.spotifyClient.CurrentUser()
+	if err != nil {
+		return err
+	}
+	p, err := u.spotifyClient.CreatePlaylistForUser(me.ID, name, "Tracks played in "+host+"'s Spotify Sync session", false)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(ids); i += playlistChunkSize {
+		end := i + playlistChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		_, err = u.spotifyClient.AddTracksToPlaylist(p.ID, ids[i:end]...)
+		if err != nil {
+			return err
+		}
+	}
+
+	Log.Info().Str("Username", u.name).Str("Session", host).Int("Tracks", len(ids)).Msg("Saved playlist")
+	msg := &ws.Message{
+		Op:        "SAVE",
+		Args:      []string{string(p.URI)},
+		Body:      fmt.Sprintf("Saved %d tracks to the playlist %s", len(ids), name),
+		Timestamp: ws.CurrentTime(),
+	}
+	return u.WriteMessage(msg)
+}
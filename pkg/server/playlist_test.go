@@ -0,0 +1,29 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/zmb3/spotify"
+	"testing"
+)
+
+func TestIsScopeError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"insufficient scope", spotify.Error{Status: 403, Message: "Insufficient client scope"}, true},
+		{"wrapped", fmt.Errorf("saving: %w", spotify.Error{Status: 403, Message: "Insufficient client scope"}), true},
+		{"premium required", spotify.Error{Status: 403, Message: "Player command failed: Premium required"}, false},
+		{"not the owner", spotify.Error{Status: 403, Message: "You cannot add tracks to a playlist you don't own."}, false},
+		{"unauthorised", spotify.Error{Status: 401, Message: "Insufficient client scope"}, false},
+		{"other error", errors.New("Insufficient client scope"), false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		if got := isScopeError(tt.err); got != tt.want {
+			t.Errorf("%s: isScopeError = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
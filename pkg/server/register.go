@@ -0,0 +1,300 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"github.com/gin-gonic/gin"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long invite codes last if no expiry is given
+var defaultInviteExpiry = 7 * 24 * time.Hour
+
+// Shortest password users can register with
+var minPasswordLength = 8
+
+// Valid usernames, commas aren't allowed since they separate the login details
+var usernameRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+// Errors returned when redeeming invite codes
+var (
+	errInvalidInvite = errors.New("Invite code is invalid, used up or has expired")
+	errUserExists    = errors.New("Username is already taken")
+)
+
+// Invite code which lets new users register themselves. Like admin tokens only a hash of the
+// code is stored, codes are given out as "<id>.<secret>" so they can be looked up by ID
+type invite struct {
+	ID        string   `json:"id"`
+	Hash      string   `json:"hash,omitempty"`       // SHA-256 of the code
+	Uses      int      `json:"uses"`                 // How many users have registered with the code
+	MaxUses   int      `json:"max_uses"`             // How many users can register with the code, unlimited if 0
+	Created   string   `json:"created"`              // When the code was created
+	CreatedBy string   `json:"created_by,omitempty"` // Name of the admin token which created the code
+	Expires   string   `json:"expires"`              // When the code stops working
+	Users     []string `json:"users,omitempty"`      // Users who registered with the code
+}
+
+// Creates an invite code and returns the code which should be given to new users
+func dbCreateInvite(maxUses int, expires time.Duration, createdBy string) (string, error) {
+	b := make([]byte, 4)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	secret, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	code := id + "." + secret
+
+	i := invite{
+		ID:        id,
+		Hash:      hashToken(code),
+		MaxUses:   maxUses,
+		Created:   ws.CurrentTime(),
+		CreatedBy: createdBy,
+		Expires:   time.Now().Add(expires).UTC().Format(ws.TimeLayout),
+	}
+
+	err = db.Update(func(tx store.Tx) error {
+		b := tx.Bucket("invites")
+		if b.Get([]byte(id)) != nil {
+			return errors.New("Invite ID collision, try again")
+		}
+
+		v, err := json.Marshal(i)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), v)
+	})
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// Deletes an invite code so it can't be used anymore
+func dbRevokeInvite(id string) error {
+	return db.Update(func(tx store.Tx) error {
+		b := tx.Bucket("invites")
+		if b.Get([]byte(id)) == nil {
+			return errors.New("Invite does not exist")
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// Returns every invite code without their hashes, sorted by when they were created
+func dbViewInvites() ([]invite, error) {
+	invites := make([]invite, 0)
+	err := db.View(func(tx store.Tx) error {
+		return tx.Bucket("invites").ForEach(func(k, v []byte) error {
+			var i invite
+			err := json.Unmarshal(v, &i)
+			if err != nil {
+				return err
+			}
+			i.Hash = ""
+			invites = append(invites, i)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(invites, func(a, b int) bool { return invites[a].Created < invites[b].Created })
+	return invites, nil
+}
+
+// Uses an invite code to create the user's entry, both happen in the same transaction
+// so a code can't be used more times than allowed. Returns the ID of the code used
+func dbRedeemInvite(code string, e *entry) (string, error) {
+	id := code
+	if i := strings.Index(code, "."); i != -1 {
+		id = code[:i]
+	}
+	hash := []byte(hashToken(code))
+
+	err := db.Update(func(tx store.Tx) error {
+		ib := tx.Bucket("invites")
+		v := ib.Get([]byte(id))
+		if v == nil {
+			// Compare anyway so unknown IDs take as long as wrong secrets
+			subtle.ConstantTimeCompare(hash, []byte(hashToken("")))
+			return errInvalidInvite
+		}
+
+		var i invite
+		err := json.Unmarshal(v, &i)
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare(hash, []byte(i.Hash)) != 1 {
+			return errInvalidInvite
+		}
+		expiry, err := time.Parse(ws.TimeLayout, i.Expires)
+		if err != nil || time.Now().After(expiry) {
+			return errInvalidInvite
+		}
+		if i.MaxUses > 0 && i.Uses >= i.MaxUses {
+			return errInvalidInvite
+		}
+
+		// Create the user
+		ub := tx.Bucket("users")
+		if ub.Get([]byte(e.Name)) != nil {
+			return errUserExists
+		}
+		v, err = json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		err = ub.Put([]byte(e.Name), v)
+		if err != nil {
+			return err
+		}
+
+		// Record the use
+		i.Uses++
+		i.Users = append(i.Users, e.Name)
+		v, err = json.Marshal(i)
+		if err != nil {
+			return err
+		}
+		return ib.Put([]byte(id), v)
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Registers a new user from the "username,password,invite code" details they sent and returns their entry
+func (u *user) register(body string) (*entry, error) {
+	details := strings.Split(body, ",")
+	if len(details) != 3 {
+		u.loginFailed("", "malformed registration", false)
+		return nil, errors.New("No username, password or invite code")
+	}
+	username, password, code := details[0], details[1], details[2]
+	Log.Trace().Str("username", username).Msg("Retrieved registration details")
+
+	if !usernameRegex.MatchString(username) {
+		_ = u.sendInfo("Usernames must be 1-32 letters, numbers, dots, underscores or hyphens")
+		return nil, errors.New("Invalid username")
+	}
+	if len(password) < minPasswordLength {
+		_ = u.sendInfo("Passwords must be at least " + strconv.Itoa(minPasswordLength) + " characters long")
+		return nil, errors.New("Password too short")
+	}
+
+	// Invite codes are throttled like logins so they can't be guessed,
+	// the attempt counts as a failure until the user is registered
+	err := u.startAttempt(username)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		u.attemptFailed(username, "cannot hash password")
+		return nil, errors.New("Cannot hash password, " + err.Error())
+	}
+	e := &entry{Name: username, Password: hash}
+	id, err := dbRedeemInvite(code, e)
+	if err == errInvalidInvite {
+		u.attemptFailed(username, "invalid invite code")
+		_ = u.sendInfo(err.Error())
+		return nil, err
+	} else if err == errUserExists {
+		u.attemptFailed(username, "username taken")
+		_ = u.sendInfo(err.Error())
+		return nil, err
+	} else if err != nil {
+		u.attemptFailed(username, "cannot redeem invite")
+		return nil, errors.New("Failed registering user: " + err.Error())
+	}
+	u.attemptSucceeded(username)
+
+	Log.Info().Str("Username", username).Str("Invite", id).Msg("Registered user")
+	dbAudit(auditEntry{Action: "user.registered", Actor: username, Target: username, Remote: remoteIP(u.r), Detail: "invite " + id})
+	return e, nil
+}
+
+// Route for creating an invite code
+func createInvite(c *gin.Context) {
+	var r ws.InviteRequest
+	err := c.BindJSON(&r)
+	if err != nil {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Request incorrect"})
+		return
+	}
+	if r.MaxUses < 0 {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Max uses can't be negative"})
+		return
+	}
+
+	expires := defaultInviteExpiry
+	if r.Expires != "" {
+		expires, err = time.ParseDuration(r.Expires)
+		if err != nil || expires <= 0 {
+			c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Expiry must be a positive duration e.g. 72h"})
+			return
+		}
+	}
+
+	code, err := dbCreateInvite(r.MaxUses, expires, c.GetString("admin"))
+	if err != nil {
+		Log.Error().Err(err).Msg("Error creating invite")
+		c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error creating invite"})
+		return
+	}
+
+	Log.Info().Int("Max Uses", r.MaxUses).Str("Expires", expires.String()).Msg("Created invite")
+	adminAudit(c, "invite.create", code[:strings.Index(code, ".")], "max uses "+strconv.Itoa(r.MaxUses)+", expires in "+expires.String())
+	c.JSON(200, gin.H{"success": true, "error": "", "code": code})
+}
+
+// Route for revoking an invite code
+func revokeInvite(c *gin.Context) {
+	var r ws.InviteRequest
+	err := c.BindJSON(&r)
+	if err != nil {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Request incorrect"})
+		return
+	}
+
+	err = dbRevokeInvite(r.ID)
+	if err != nil {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	Log.Info().Str("ID", r.ID).Msg("Revoked invite")
+	adminAudit(c, "invite.revoke", r.ID, "")
+	c.JSON(200, ws.Response{Success: true, Error: ""})
+}
+
+// Route for listing the invite codes
+func viewInvites(c *gin.Context) {
+	invites, err := dbViewInvites()
+	if err != nil {
+		Log.Error().Err(err).Msg("Error viewing invites")
+		c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error viewing invites"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "error": "", "invites": invites})
+}
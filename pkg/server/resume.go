@@ -0,0 +1,178 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How long a user whose connection dropped keeps their place on the server (and in their session)
+var resumeGrace = 2 * time.Minute
+
+// Maps resume tokens to the user they can resume
+var resumeTokens = make(map[string]*user)
+
+// Locks access to the resume tokens map
+var resumeMtx sync.Mutex
+
+// Generates a cryptographically random url safe token
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Returns the user a resume token belongs to, nil if the token is not valid
+func lookupResumeToken(token string) *user {
+	resumeMtx.Lock()
+	defer resumeMtx.Unlock()
+
+	return resumeTokens[token]
+}
+
+// Returns the suspended user with the given name, nil if no such user exists
+func lookupSuspendedUser(name string) *user {
+	resumeMtx.Lock()
+	defer resumeMtx.Unlock()
+
+	for _, u := range resumeTokens {
+		if u.name == name && u.isSuspended() {
+			return u
+		}
+	}
+	return nil
+}
+
+// Issues a fresh resume token to the user, invalidating their old
+// one, and sends it to them along with the grace period in seconds
+func (u *user) issueResumeToken() error {
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	resumeMtx.Lock()
+	if u.resumeToken != "" {
+		delete(resumeTokens, u.resumeToken)
+	}
+	u.resumeToken = token
+	resumeTokens[token] = u
+	resumeMtx.Unlock()
+
+	msg := &ws.Message{
+		Op:        "RESUME",
+		Args:      []string{strconv.Itoa(int(resumeGrace.Seconds()))},
+		Body:      token,
+		Timestamp: ws.CurrentTime(),
+	}
+	return u.WriteMessage(msg)
+}
+
+// Invalidates the user's resume token so it can no longer be used
+func (u *user) revokeResumeToken() {
+	resumeMtx.Lock()
+	defer resumeMtx.Unlock()
+
+	if u.resumeToken != "" {
+		delete(resumeTokens, u.resumeToken)
+		u.resumeToken = ""
+	}
+}
+
+// Whether the user is waiting to be resumed
+func (u *user) isSuspended() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.suspended
+}
+
+// Called when the read pump fails, if the connection closed normally (or the user has no
+// resume token) then the user is disconnected, otherwise the user is suspended so they can resume
+func (u *user) connectionLost(conn *websocket.Conn, err error) {
+	resumeMtx.Lock()
+	resumable := u.resumeToken != ""
+	resumeMtx.Unlock()
+
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) || !resumable {
+		u.disconnect()
+		return
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	// If the connection has already been replaced (the user resumed) then there's nothing to do
+	if u.closed || u.conn != conn {
+		return
+	}
+
+	Log.Info().Str("Username", u.name).Dur("Grace", resumeGrace).Msg("Suspending user")
+	_ = u.conn.Close()
+	u.conn = nil
+	u.suspended = true
+
+	// Disconnect the user if they haven't resumed by the end of the grace period
+	u.graceTimer = time.AfterFunc(resumeGrace, func() {
+		if u.isSuspended() {
+			Log.Info().Str("Username", u.name).Msg("Grace period expired")
+			u.disconnect()
+		}
+	})
+}
+
+// Attaches a new connection and the request which opened it to the user, this either resumes
+// a suspended user or replaces the connection of a user whose old connection has not dropped yet
+func (u *user) resume(conn *websocket.Conn, r *http.Request) error {
+	u.mutex.Lock()
+	if u.closed {
+		u.mutex.Unlock()
+		return errors.New("User has already disconnected")
+	}
+	if u.graceTimer != nil {
+		u.graceTimer.Stop()
+		u.graceTimer = nil
+	}
+	old := u.conn
+	u.conn = conn
+	u.r = r
+	u.codec = ws.CodecFor(conn)
+	u.suspended = false
+	u.mutex.Unlock()
+
+	// Closing the old connection causes its read pump to exit
+	if old != nil {
+		_ = old.Close()
+	}
+	Log.Info().Str("Username", u.name).Msg("Resumed user")
+
+	err := u.issueResumeToken()
+	if err != nil {
+		return err
+	}
+
+	err = u.sendInfo("Connection resumed")
+	if err != nil {
+		return err
+	}
+
+	// Bring the client's user list up to date
+	if u.s != nil {
+		return u.WriteMessage(&ws.Message{
+			Op:        "USERS",
+			Args:      nil,
+			Body:      u.s.getUsers(),
+			Timestamp: ws.CurrentTime(),
+		})
+	}
+	return nil
+}
@@ -4,24 +4,27 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/fiwippi/spotify-sync/pkg/store"
 	"github.com/gin-gonic/gin"
-	bolt "go.etcd.io/bbolt"
+	"github.com/rs/zerolog"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 )
 
-// Admin key allows deeper access to server functions, i.e. deleting accounts, updating account data
+// Admin key used to bootstrap access to the server, it can only create and revoke the admin API tokens
+// which allow deeper access to server functions, i.e. deleting accounts, updating account data
 var adminKey string
 
-// Middleware to ensure an authenticator has been generated
+// Middleware to ensure an authenticator has been generated (or players are provided instead)
 func authGenerated() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if authCreated {
+		if authCreated || players != nil {
 			c.Next()
 		} else {
 			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"msg": "Cannot process requests currently"})
@@ -29,6 +32,93 @@ func authGenerated() gin.HandlerFunc {
 	}
 }
 
+// Options used to create a server which runs in-process, i.e. for the conformance suite
+type Options struct {
+	AdminKey string                       // Admin key used to authorise privileged requests
+	DBDriver string                       // Driver the database is stored with, bolt if blank
+	DBPath   string                       // Path of the database file, created if it doesn't exist
+	Refresh  time.Duration                // How often to sync the sessions
+	Players  func(username string) Player // Players given to users instead of authorising spotify
+}
+
+// Opens the database with the driver and guarantees the buckets exist
+func openDB(driver, path string) error {
+	var err error
+
+	// connect to the database
+	db, err = store.Open(driver, path, false)
+	if err != nil {
+		return err
+	}
+
+	// Guarantees the buckets exist
+	return db.Update(func(tx store.Tx) error {
+		for _, name := range []string{"meta", "users", "admin_tokens", "lockouts", "audit", "invites", "history", "stats"} {
+			_, err = tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return fmt.Errorf("create bucket: %s", err)
+			}
+		}
+		return nil
+	})
+}
+
+// Creates the router and adds the routes to it, the middleware is used by every route
+func newRouter(middleware ...gin.HandlerFunc) (*gin.Engine, error) {
+	router := gin.New()
+	router.Use(middleware...)
+	router.Use(authGenerated())
+
+	// Setup templating
+	tmpl, err := template.ParseFS(efs, "static/admin.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	router.SetHTMLTemplate(tmpl)
+
+	// Add routes
+	router.GET("/admin", admin)
+	router.GET("/favicon.ico", favicon)
+	router.GET("/spotify-callback", spotifyCallback)
+	router.GET("/shared", processIncomingUserWebsocket)
+	router.POST("/api/create-user", requireScope("users:write"), createUser)
+	router.POST("/api/delete-user", requireScope("users:write"), deleteUser)
+	router.POST("/api/update-user", requireScope("users:write"), updateUser)
+	router.GET("/api/users", requireScope("users:read"), viewUsers)
+	router.GET("/api/export-users", requireScope("users:read"), exportUsers)
+	router.POST("/api/import-users", requireScope("users:write"), importUsers)
+	router.GET("/api/invites", requireScope("users:read"), viewInvites)
+	router.POST("/api/create-invite", requireScope("users:write"), createInvite)
+	router.POST("/api/revoke-invite", requireScope("users:write"), revokeInvite)
+	router.GET("/api/lockouts", requireScope("users:read"), viewLockouts)
+	router.GET("/api/history", requireScope("users:read"), viewHistory)
+	router.GET("/api/export-history", requireScope("users:read"), exportHistory)
+	router.GET("/api/stats", requireScope("users:read"), viewStats)
+	router.POST("/api/clear-lockout", requireScope("users:write"), clearLockout)
+	router.GET("/api/sessions", requireScope("sessions:manage"), viewSessions)
+	router.POST("/api/end-session", requireScope("sessions:manage"), endSession)
+	router.POST("/api/view-db", requireScope("db:read"), viewDB)
+	router.GET("/api/backup", requireScope("db:backup"), backupDB)
+	router.GET("/api/audit", requireScope("audit:read"), viewAudit)
+
+	// Admin token routes, these are only authorised by the admin key
+	router.GET("/api/tokens", requireAdminKey(), viewAdminTokens)
+	router.POST("/api/create-token", requireAdminKey(), createAdminToken)
+	router.POST("/api/revoke-token", requireAdminKey(), revokeAdminToken)
+
+	return router, nil
+}
+
+// Goroutines serving users and sessions, shutting down waits for them to exit
+var serving sync.WaitGroup
+
+// Disconnects all users, which also closes the sessions they host
+func disconnectAll() {
+	for _, u := range listConnectedUsers() {
+		u.disconnect()
+	}
+}
+
 // Creates the server object
 func setupServer(aK, id, secret, redirect, port, logLevel string) (*http.Server, error) {
 	var err error
@@ -41,45 +131,39 @@ func setupServer(aK, id, secret, redirect, port, logLevel string) (*http.Server,
 
 	// Set the admin key
 	adminKey = aK
+	if tokenKeys == nil {
+		Log.Warn().Msg("No token keys loaded, spotify tokens are stored unencrypted")
+	}
 
 	// connect to the database
-	db, err = bolt.Open("data/spotify.db", 0666, nil)
+	dbPath := dbFilePath()
+	err = openDB(dbDriver, dbPath)
 	if err != nil {
 		return nil, err
 	}
+	Log.Info().Str("Driver", dbDriver).Str("Path", dbPath).Msg("Opened db")
 
-	// Guarantees main user bucket exists
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err = tx.CreateBucketIfNotExists([]byte("users"))
+	// Bring the database up to the current schema, the memory store has nothing to back up
+	var backupPath string
+	if migrateBackup && dbDriver != store.Memory {
+		backupPath, err = migrationBackupPath(dbPath)
 		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
+			return nil, err
 		}
-		return nil
-	})
+	}
+	results, err := migrateDB(false, backupPath)
 	if err != nil {
 		return nil, err
 	}
+	for _, r := range results {
+		Log.Info().Int("Version", r.Version).Int("Changed", r.Changed).Msg("Migrated db: " + r.Description)
+	}
 
-	// Generate the router
-	router := gin.Default() // Default router  includes logging and recovery middleware
-	router.Use(authGenerated())
-
-	// Setup templating
-	tmpl, err := template.ParseFS(efs, "static/admin.tmpl")
+	// Generate the router, includes logging and recovery middleware
+	router, err := newRouter(gin.Logger(), gin.Recovery())
 	if err != nil {
 		return nil, err
 	}
-	router.SetHTMLTemplate(tmpl)
-
-	// Add routes
-	router.GET("/admin", admin)
-	router.GET("/favicon.ico", favicon)
-	router.GET("/spotify-callback", spotifyCallback)
-	router.GET("/shared", processIncomingUserWebsocket)
-	router.POST("/api/create-user", createUser)
-	router.POST("/api/delete-user", deleteUser)
-	router.POST("/api/update-user", updateUser)
-	router.POST("/api/view-db", viewDB)
 
 	// Generate the spotify auth object
 	err = generateAuth(id, secret, redirect)
@@ -92,24 +176,56 @@ func setupServer(aK, id, secret, redirect, port, logLevel string) (*http.Server,
 		Addr:    ":" + port,
 		Handler: router,
 	}
+	srv.RegisterOnShutdown(disconnectAll)
 
-	srv.RegisterOnShutdown(func() {
-		// Close each session
-		for s := range sessions {
-			if sessions[s] != nil {
-				sessions[s].close()
-			}
-		}
-
-		// Disconnect all users
-		for u := range connectedUsers {
-			u.disconnect()
-		}
-	})
+	// Serve HTTPS/WSS directly if a certificate is loaded
+	if certs != nil {
+		srv.TLSConfig = certs.tlsConfig()
+		Log.Info().Str("Cert", certs.certFile).Msg("Serving over TLS")
+	}
 
 	return srv, nil
 }
 
+// Creates a server which runs in-process, its logs are discarded, gin runs in release mode and
+// users are given the provided players rather than authorising spotify. Only one server should
+// exist at a time since they share state, the returned function shuts the server down and
+// waits for the goroutines serving its users and sessions to exit so another can be created
+func NewHandler(opts Options) (http.Handler, func() error, error) {
+	Log = zerolog.Nop()
+	gin.SetMode(gin.ReleaseMode)
+	adminKey = opts.AdminKey
+	syncRefresh = opts.Refresh
+	players = opts.Players
+
+	err := SetDBDriver(opts.DBDriver)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = openDB(dbDriver, opts.DBPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = migrateDB(false, "")
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	router, err := newRouter(gin.Recovery())
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	shutdown := func() error {
+		disconnectAll()
+		serving.Wait()
+		return db.Close()
+	}
+	return router, shutdown, nil
+}
+
 // Run a server
 func Run(aK, id, secret, redirect, port, mode, logLevel string, refresh time.Duration) error {
 	// Set the refresh
@@ -127,13 +243,30 @@ func Run(aK, id, secret, redirect, port, mode, logLevel string, refresh time.Dur
 	}
 
 	go func() {
-		if err = srv.ListenAndServe(); err != nil {
+		if certs != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatal(err)
 		}
 	}()
 
+	// Renewed certificates are loaded on SIGHUP without restarting the server
+	if certs != nil {
+		go certs.reloadOnHangup()
+	}
+
+	// Snapshot the db periodically if enabled
+	if snapshotInterval > 0 && dbDriver == store.Memory {
+		Log.Warn().Msg("The db is kept in memory so it won't be snapshotted")
+	} else if snapshotInterval > 0 {
+		go runSnapshots()
+	}
+
 	// Wait for interrupt signal to gracefully shutdown the server with a timeout of 5 seconds.
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	Log.Warn().Msg("Shutting down server...")
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"os"
+	"strings"
+)
+
+// Prefix of encrypted tokens, these are stored as "enc:<key id>:<nonce and ciphertext>"
+// so tokens encrypted with an old key can still be decrypted after rotating keys
+const encryptedPrefix = "enc:"
+
+// Value shown instead of secrets when dumping the db
+const redacted = "[redacted]"
+
+// Keys used to encrypt the tokens stored in the db
+type keyring struct {
+	current string                 // ID of the key new tokens are encrypted with
+	aeads   map[string]cipher.AEAD // Keys by their ID
+}
+
+// The keyring of the server, if nil then tokens are stored unencrypted
+var tokenKeys *keyring
+
+// Loads the keys used to encrypt tokens. Keys are written as "<id>:<base64 key>", the keys
+// string separates them with commas and the key file has one per line. The first key is used
+// to encrypt new tokens while the others are only used to decrypt tokens encrypted with them.
+// Keys must be 32 bytes long (AES-256-GCM), if no keys are given tokens aren't encrypted
+func LoadTokenKeys(keys, keyFile string) error {
+	lines := strings.Split(keys, ",")
+
+	if keyFile != "" {
+		f, err := os.Open(keyFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	kr := &keyring{aeads: make(map[string]cipher.AEAD)}
+	for _, l := range lines {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(l, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return errors.New("Token keys must be in the form <id>:<base64 key>")
+		}
+		id := parts[0]
+		if _, ok := kr.aeads[id]; ok {
+			return fmt.Errorf("Token key %s is given more than once", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return fmt.Errorf("Token key %s is not valid base64: %s", id, err)
+		}
+		if len(key) != 32 {
+			return fmt.Errorf("Token key %s must be 32 bytes long", id)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		kr.aeads[id] = aead
+		if kr.current == "" {
+			kr.current = id
+		}
+	}
+
+	if kr.current == "" {
+		tokenKeys = nil
+	} else {
+		tokenKeys = kr
+	}
+	return nil
+}
+
+// Encrypts a token with the current key, if there are no keys the token is returned as it is
+func encryptToken(token string) (string, error) {
+	if tokenKeys == nil || token == "" {
+		return token, nil
+	}
+
+	aead := tokenKeys.aeads[tokenKeys.current]
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(token), []byte(tokenKeys.current))
+	return encryptedPrefix + tokenKeys.current + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypts a token with the key it was encrypted with, unencrypted tokens are returned as they are
+func decryptToken(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedPrefix) {
+		return stored, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(stored, encryptedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("Encrypted token is malformed")
+	}
+	if tokenKeys == nil {
+		return "", errors.New("Token is encrypted but no token keys are loaded")
+	}
+	aead, ok := tokenKeys.aeads[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("Token is encrypted with unknown key %s", parts[0])
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("Encrypted token is malformed")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(parts[0]))
+	if err != nil {
+		return "", errors.New("Cannot decrypt token: " + err.Error())
+	}
+	return string(plain), nil
+}
+
+// Re-encrypts every user's token with the current key (encrypting any unencrypted
+// tokens) and returns how many were changed. The server must not be running
+func Rekey(driver, dbPath string) (int, error) {
+	if tokenKeys == nil {
+		return 0, errors.New("No token keys are loaded")
+	}
+
+	var err error
+	db, err = store.Open(driver, dbPath, false)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var n int
+	err = db.Update(func(tx store.Tx) error {
+		b := tx.Bucket("users")
+		if b == nil {
+			return nil
+		}
+
+		// Collect the updated entries first since the bucket can't be changed while it's iterated
+		updated := make(map[string][]byte)
+		err := b.ForEach(func(k, v []byte) error {
+			var e entry
+			err := json.Unmarshal(v, &e)
+			if err != nil {
+				return fmt.Errorf("Cannot parse entry %s: %s", k, err)
+			}
+			if e.Token == "" {
+				return nil
+			}
+
+			token, err := decryptToken(e.Token)
+			if err != nil {
+				return fmt.Errorf("Cannot decrypt token of %s: %s", k, err)
+			}
+			e.Token, err = encryptToken(token)
+			if err != nil {
+				return err
+			}
+
+			updated[string(k)], err = json.Marshal(e)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		for k, v := range updated {
+			err = b.Put([]byte(k), v)
+			if err != nil {
+				return err
+			}
+		}
+		n = len(updated)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Returns the value stored in a bucket with its secrets redacted so it can be shown when
+// dumping the db, i.e. the password hashes and tokens of users and the admin token and invite hashes
+func RedactValue(bucket string, v []byte) []byte {
+	if bucket == "invites" {
+		var i invite
+		err := json.Unmarshal(v, &i)
+		if err != nil {
+			return []byte(redacted)
+		}
+		i.Hash = redacted
+		r, err := json.Marshal(i)
+		if err != nil {
+			return []byte(redacted)
+		}
+		return r
+	}
+	if bucket == "admin_tokens" {
+		var t adminToken
+		err := json.Unmarshal(v, &t)
+		if err != nil {
+			return []byte(redacted)
+		}
+		t.Hash = redacted
+		r, err := json.Marshal(t)
+		if err != nil {
+			return []byte(redacted)
+		}
+		return r
+	}
+	if bucket != "users" {
+		return v
+	}
+
+	var e entry
+	err := json.Unmarshal(v, &e)
+	if err != nil {
+		return []byte(redacted)
+	}
+	if e.Password != "" {
+		e.Password = redacted
+	}
+	if e.Token != "" {
+		e.Token = redacted
+	}
+	r, err := json.Marshal(e)
+	if err != nil {
+		return []byte(redacted)
+	}
+	return r
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// Returns a token key with the id in the form LoadTokenKeys takes
+func testTokenKey(id string, b byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+// Loads the token keys and unloads them when the test ends
+func loadTestTokenKeys(t *testing.T, keys ...string) {
+	t.Helper()
+	err := LoadTokenKeys(strings.Join(keys, ","), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tokenKeys = nil })
+}
+
+func TestEncryptToken(t *testing.T) {
+	loadTestTokenKeys(t, testTokenKey("old", 1))
+	oldEnc, err := encryptToken(`{"access_token":"a"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(oldEnc, "enc:old:") || strings.Contains(oldEnc, "access_token") {
+		t.Errorf("encrypted token = %s, want it encrypted with the old key", oldEnc)
+	}
+
+	// Rotating keys encrypts with the new key and still decrypts tokens encrypted with the old one
+	loadTestTokenKeys(t, testTokenKey("new", 2), testTokenKey("old", 1))
+	newEnc, err := encryptToken(`{"access_token":"b"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(newEnc, "enc:new:") {
+		t.Errorf("encrypted token = %s, want it encrypted with the new key", newEnc)
+	}
+
+	tampered := newEnc[:len(newEnc)-2] + "AA"
+	if tampered == newEnc {
+		tampered = newEnc[:len(newEnc)-2] + "BB"
+	}
+	tests := []struct {
+		name    string
+		stored  string
+		want    string
+		wantErr bool
+	}{
+		{"old key", oldEnc, `{"access_token":"a"}`, false},
+		{"new key", newEnc, `{"access_token":"b"}`, false},
+		{"unencrypted", `{"access_token":"c"}`, `{"access_token":"c"}`, false},
+		{"tampered", tampered, "", true},
+		{"wrong key id", strings.Replace(newEnc, "enc:new:", "enc:old:", 1), "", true},
+		{"unknown key", "enc:gone:" + strings.TrimPrefix(newEnc, "enc:new:"), "", true},
+		{"malformed", "enc:new", "", true},
+	}
+	for _, tt := range tests {
+		got, err := decryptToken(tt.stored)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("%s: decrypt = %q, %v, want %q, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	// Without keys tokens are stored as they are and encrypted ones can't be read
+	tokenKeys = nil
+	plain, err := encryptToken("token")
+	if plain != "token" || err != nil {
+		t.Errorf("encrypt without keys = %q, %v, want the token unchanged", plain, err)
+	}
+	if _, err = decryptToken(newEnc); err == nil {
+		t.Error("decrypting without keys succeeded")
+	}
+}
+
+func TestLoadTokenKeys(t *testing.T) {
+	t.Cleanup(func() { tokenKeys = nil })
+
+	tests := []struct {
+		name    string
+		keys    string
+		wantErr bool
+	}{
+		{"one key", testTokenKey("a", 1), false},
+		{"rotated keys", testTokenKey("b", 2) + "," + testTokenKey("a", 1), false},
+		{"no keys", "", false},
+		{"no id", ":" + base64.StdEncoding.EncodeToString(make([]byte, 32)), true},
+		{"no separator", "a", true},
+		{"not base64", "a:!!!", true},
+		{"short key", "a:" + base64.StdEncoding.EncodeToString(make([]byte, 16)), true},
+		{"duplicate id", testTokenKey("a", 1) + "," + testTokenKey("a", 2), true},
+	}
+	for _, tt := range tests {
+		err := LoadTokenKeys(tt.keys, "")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: load = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
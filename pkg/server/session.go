@@ -6,7 +6,9 @@ import (
 	ws "github.com/fiwippi/spotify-sync/pkg/shared"
 	"github.com/zmb3/spotify"
 	"log"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,13 +22,24 @@ var sessions = make(map[string]*session)
 
 // Session used to handleSync playback between a host and other clients
 type session struct {
+	mutex      sync.RWMutex   // Locks access to the clients, they're read outside of handleChannels()
 	clients    map[*user]bool // Registered clients.
 	register   chan *user     // Register requests from the clients.
 	unregister chan *user     // Unregister requests from clients.
 	done       chan error     // Signals session to stop running (stops the handleChannels() function)
-	broadcast  chan string    // Channel to receive string messages to send to other clients
+	broadcast  chan chatMsg   // Channel to receive chat messages to send to other clients
 	host       *user          // The user hosting the session
 	quit       chan struct{}  // Channel to tell the session to stop synchronising (stops the handleSync() function)
+	lastTrack  spotify.URI    // The host's track which was last recorded to the history
+	created    time.Time      // When the session was created
+	listening  time.Time      // When the host started playing the current track, zero if they aren't playing
+	listeners  []string       // Users in the session when the current track started, they're credited with the time listened
+}
+
+// Chat message broadcast to every client in a session
+type chatMsg struct {
+	from string // Name of the user who sent the message
+	text string // Text of the message
 }
 
 // Initialiases a new session
@@ -36,9 +49,10 @@ func newSession(host *user) *session {
 		unregister: make(chan *user),
 		done:       make(chan error),
 		quit:       make(chan struct{}),
-		broadcast:  make(chan string),
+		broadcast:  make(chan chatMsg),
 		clients:    make(map[*user]bool),
 		host:       host,
+		created:    time.Now(),
 	}
 	s.clients[host] = true
 	host.s = s
@@ -62,7 +76,7 @@ func unregisterChannelClosed(ch <-chan *user) bool {
 func (s *session) sendUserUpdate() error {
 	users := s.getUsers()
 
-	for client := range s.clients {
+	for _, client := range s.members() {
 		// Send the user list
 		msg := &ws.Message{
 			Op:        "USERS",
@@ -71,7 +85,7 @@ func (s *session) sendUserUpdate() error {
 			Timestamp: ws.CurrentTime(),
 		}
 
-		err := client.WriteJSON(msg)
+		err := client.WriteMessage(msg)
 		if err != nil {
 			return err
 		}
@@ -80,14 +94,28 @@ func (s *session) sendUserUpdate() error {
 	return nil
 }
 
-// Generates a string of all users within the session
-func (s *session) getUsers() string {
-	u := ""
+// Returns the clients in the session, the slice is a copy so it can be used while clients join and leave
+func (s *session) members() []*user {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	clients := make([]*user, 0, len(s.clients))
 	for client := range s.clients {
-		u += client.name + ","
+		clients = append(clients, client)
 	}
+	return clients
+}
 
-	return strings.TrimSuffix(u, ",")
+// Generates a string of all users within the session, sorted by name
+func (s *session) getUsers() string {
+	clients := s.members()
+	names := make([]string, 0, len(clients))
+	for _, client := range clients {
+		names = append(names, client.name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ",")
 }
 
 // Closes a session and deletes it from the session map
@@ -96,9 +124,10 @@ func (s *session) close() {
 	s.done <- errors.New("Closing session") // Stops the handleChannels() func
 
 	// Notifies that the session is closed for all clients
-	for client := range s.clients {
+	for _, client := range s.members() {
 		client.sendInfo("Session (" + s.host.name + ") closed")
 		client.clearUserList() // Tells the client no more users are in the session
+		client.s = nil
 	}
 
 	// No more clients can be registered/unregistered
@@ -109,22 +138,28 @@ func (s *session) close() {
 // Handles incoming/outgoing clients and
 // broadcasting messages between clients.
 func (s *session) handleChannels() {
+	defer serving.Done()
+
 	for {
 		select {
 		case _ = <-s.done:
 			close(s.quit) // Stops the handleSync() func
 			return
 		case client := <-s.register:
+			s.mutex.Lock()
 			s.clients[client] = true
+			s.mutex.Unlock()
 			_ = s.sendUserUpdate()
 		case client := <-s.unregister:
+			s.mutex.Lock()
 			if _, ok := s.clients[client]; ok {
 				delete(s.clients, client)
 			}
+			s.mutex.Unlock()
 			_ = s.sendUserUpdate()
-		case text := <-s.broadcast:
-			for client := range s.clients {
-				err := client.sendMsg(text)
+		case msg := <-s.broadcast:
+			for _, client := range s.members() {
+				err := client.sendMsg(msg.from, msg.text)
 				if err != nil {
 					log.Println(err)
 				}
@@ -136,6 +171,8 @@ func (s *session) handleChannels() {
 // Syncs all clients in the session to have the
 // same spotify playback as the host
 func (s *session) handleSync() {
+	defer serving.Done()
+
 	ticker := time.NewTicker(syncRefresh)
 	for {
 		select {
@@ -156,11 +193,14 @@ func (s *session) handleSync() {
 				continue
 			}
 
+			// Record the host's track to the history if it's a new one and the time spent listening
+			s.recordPlayback(hostState)
+
 			// Time to measure delay between checking the host and client progress to account for that
 			startTime := time.Now()
 
 			// Go through each client
-			for client := range s.clients {
+			for _, client := range s.members() {
 				// Avoid the host
 				if client != s.host {
 					// If the host is paused then pause the client
@@ -231,6 +271,7 @@ func (s *session) handleSync() {
 
 		case <-s.quit:
 			ticker.Stop()
+			s.creditListening()
 			return
 		}
 	}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"github.com/zmb3/spotify"
 	"golang.org/x/oauth2"
@@ -11,6 +12,35 @@ import (
 var authCreated bool = false
 // The spotify authenticator object used to create clients for each user
 var auth spotify.Authenticator
+// The oauth2 config matching the authenticator, used to refresh user tokens
+var oauthConfig *oauth2.Config
+
+// Controls a user's spotify playback, this is implemented by *spotify.Client
+// but other implementations can be used, i.e. fake players in the conformance suite
+type Player interface {
+	CurrentUser() (*spotify.PrivateUser, error)
+	PlayerState() (*spotify.PlayerState, error)
+	Pause() error
+	Seek(position int) error
+	PlayOpt(opt *spotify.PlayOptions) error
+	CreatePlaylistForUser(userID, playlistName, description string, public bool) (*spotify.FullPlaylist, error)
+	AddTracksToPlaylist(playlistID spotify.ID, trackIDs ...spotify.ID) (string, error)
+}
+
+// If set then users are given the player it returns instead of authorising spotify
+var players func(username string) Player
+
+// Creates a player which controls the spotify playback of the user
+// using their token, refreshed tokens are saved to the user's entry
+func (u *user) newPlayer(token *oauth2.Token) Player {
+	ts := newTokenSource(u, token)
+	u.mutex.Lock()
+	u.tokenSource = ts
+	u.mutex.Unlock()
+
+	client := spotify.NewClient(oauth2.NewClient(context.Background(), ts))
+	return &client
+}
 
 // Generates the authenticator for the router
 func generateAuth(id, secret, redirect string) error {
@@ -20,32 +50,19 @@ func generateAuth(id, secret, redirect string) error {
 	}
 
 	// Create the authenticator for the spotify session and generate its url
-	auth = spotify.NewAuthenticator(redirect, spotify.ScopeUserModifyPlaybackState, spotify.ScopeUserReadPlaybackState)
+	scopes := []string{spotify.ScopeUserModifyPlaybackState, spotify.ScopeUserReadPlaybackState, playlistScope}
+	auth = spotify.NewAuthenticator(redirect, scopes...)
 	auth.SetAuthInfo(id, secret)
+	oauthConfig = &oauth2.Config{
+		ClientID:     id,
+		ClientSecret: secret,
+		RedirectURL:  redirect,
+		Scopes:       scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  spotify.AuthURL,
+			TokenURL: spotify.TokenURL,
+		},
+	}
 	authCreated = true
 	return nil
 }
-
-// Checks if the channel used to send spotify clients generated in the
-// SpotifyCallback to the user handshake where the user is created, is closed
-func isSpotifyClientChanClosed(ch <-chan spotify.Client) bool {
-	select {
-	case <-ch:
-		return true
-	default:
-	}
-
-	return false
-}
-
-// Checks if the channel used to send the spotify oauth2.Token generated in the
-// SpotifyCallback to the user handshake where the user is created, is closed
-func isSpotifyTokenChanClosed(ch <-chan *oauth2.Token) bool {
-	select {
-	case <-ch:
-		return true
-	default:
-	}
-
-	return false
-}
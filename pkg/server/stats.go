@@ -0,0 +1,361 @@
+package server
+
+import (
+	"encoding/json"
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"github.com/gin-gonic/gin"
+	"github.com/zmb3/spotify"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// How many of a user's top artists, tracks and co-listeners are sent by the STATS opcode
+var topStatsCount = 5
+
+// Most users returned in each leaderboard by the admin api if no limit is given
+var defaultLeaderboardLimit = 10
+
+// Listening statistics of a user, they're updated as tracks are played rather than computed from the history
+type userStats struct {
+	Listened       int64                  `json:"listened_ms"`     // Time spent listening in sessions in milliseconds
+	SessionsHosted int                    `json:"sessions_hosted"` // Sessions the user created
+	SessionsJoined int                    `json:"sessions_joined"` // Sessions the user joined
+	Tracks         int                    `json:"tracks"`          // Tracks the user heard in sessions
+	Artists        map[string]int         `json:"artists"`         // How many tracks the user heard by each artist
+	TrackPlays     map[string]*trackPlays `json:"track_plays"`     // How many times the user heard each track by URI
+	CoListeners    map[string]int         `json:"co_listeners"`    // How many tracks the user heard with each other user
+}
+
+// How many times a track was heard
+type trackPlays struct {
+	Name  string `json:"name"` // Title of the track including its artists
+	Plays int    `json:"plays"`
+}
+
+// Position of a user in a leaderboard
+type leaderboardEntry struct {
+	Name  string `json:"name"`
+	Value int64  `json:"value"`
+}
+
+// Updates the stats of each user in the transaction, the stats are created if the user has none
+func updateStats(tx store.Tx, names []string, fn func(name string, s *userStats)) error {
+	b, err := tx.CreateBucketIfNotExists("stats")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		var s userStats
+		if v := b.Get([]byte(name)); v != nil {
+			err = json.Unmarshal(v, &s)
+			if err != nil {
+				return err
+			}
+		}
+		fn(name, &s)
+
+		v, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		err = b.Put([]byte(name), v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Updates the stats of the users in their own transaction, failures are logged rather than
+// returned so keeping stats never stops the action they're counting from happening
+func dbUpdateStats(names []string, fn func(name string, s *userStats)) {
+	err := db.Update(func(tx store.Tx) error {
+		return updateStats(tx, names, fn)
+	})
+	if err != nil {
+		Log.Error().Err(err).Strs("Users", names).Msg("Failed updating stats")
+	}
+}
+
+// Counts the track for every user who heard it, the artists and track are counted along with who they heard it with
+func addTrackStats(tx store.Tx, e ws.HistoryEntry) error {
+	return updateStats(tx, e.Members, func(name string, s *userStats) {
+		if s.Artists == nil {
+			s.Artists = make(map[string]int)
+		}
+		if s.TrackPlays == nil {
+			s.TrackPlays = make(map[string]*trackPlays)
+		}
+		if s.CoListeners == nil {
+			s.CoListeners = make(map[string]int)
+		}
+
+		s.Tracks++
+		for _, a := range e.Artists {
+			s.Artists[a]++
+		}
+		p, ok := s.TrackPlays[e.URI]
+		if !ok {
+			p = &trackPlays{}
+			s.TrackPlays[e.URI] = p
+		}
+		p.Name = trackTitle(e)
+		p.Plays++
+		for _, m := range e.Members {
+			if m != name {
+				s.CoListeners[m]++
+			}
+		}
+	})
+}
+
+// Credits the users with the time they spent listening
+func dbAddListened(names []string, d time.Duration) {
+	dbUpdateStats(names, func(name string, s *userStats) {
+		s.Listened += d.Milliseconds()
+	})
+}
+
+// Records the host's playback, new tracks are added to the history and the time spent listening
+// is credited to the users who were in the session when the track started once it stops playing
+func (s *session) recordPlayback(state *spotify.PlayerState) {
+	playing := state.Playing && state.Item != nil
+	if !s.listening.IsZero() && (!playing || state.Item.URI != s.lastTrack) {
+		s.creditListening()
+	}
+
+	if e := s.recordTrack(state); e != nil {
+		s.listeners = e.Members
+	}
+	if playing && s.listening.IsZero() {
+		s.listening = time.Now()
+	}
+}
+
+// Credits the listeners with the time since the host started playing, if they are
+func (s *session) creditListening() {
+	if s.listening.IsZero() {
+		return
+	}
+	dbAddListened(s.listeners, time.Since(s.listening))
+	s.listening = time.Time{}
+}
+
+// Returns the counts with the highest values, the names sort ties
+func topCounts(counts map[string]int, n int) []ws.StatsCount {
+	top := make([]ws.StatsCount, 0, len(counts))
+	for name, c := range counts {
+		top = append(top, ws.StatsCount{Name: name, Count: c})
+	}
+	sortCounts(top)
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// Sorts the counts from highest to lowest
+func sortCounts(counts []ws.StatsCount) {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Name < counts[j].Name
+	})
+}
+
+// Summarises the user's stats with their top n artists, tracks and co-listeners
+func (s *userStats) summary(name string, n int) ws.Stats {
+	tracks := make([]ws.StatsCount, 0, len(s.TrackPlays))
+	for uri, p := range s.TrackPlays {
+		tracks = append(tracks, ws.StatsCount{Name: p.Name, URI: uri, Count: p.Plays})
+	}
+	sortCounts(tracks)
+	if len(tracks) > n {
+		tracks = tracks[:n]
+	}
+
+	return ws.Stats{
+		User:           name,
+		Listened:       s.Listened,
+		SessionsHosted: s.SessionsHosted,
+		SessionsJoined: s.SessionsJoined,
+		Tracks:         s.Tracks,
+		TopArtists:     topCounts(s.Artists, n),
+		TopTracks:      tracks,
+		TopListeners:   topCounts(s.CoListeners, n),
+	}
+}
+
+// Returns the stats of the user, they're empty if the user has none yet
+func dbViewStats(name string) (*userStats, error) {
+	var s userStats
+	err := db.View(func(tx store.Tx) error {
+		v := tx.Bucket("stats").Get([]byte(name))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Sends the user their listening stats, the server replies with a STATS message whose body is them as JSON
+func (u *user) cmdStats(m *ws.Message) error {
+	s, err := dbViewStats(u.name)
+	if err != nil {
+		Log.Error().Err(err).Str("Username", u.name).Msg("Failed viewing stats")
+		return u.sendInfo("Failed retrieving stats")
+	}
+	body, err := json.Marshal(s.summary(u.name, topStatsCount))
+	if err != nil {
+		return err
+	}
+
+	msg := &ws.Message{
+		Op:        "STATS",
+		Args:      nil,
+		Body:      string(body),
+		Timestamp: ws.CurrentTime(),
+	}
+	return u.WriteMessage(msg)
+}
+
+// Returns the leaderboards of the users with the most time listened, sessions hosted and joined and
+// tracks heard, along with the server's top artists and tracks counted once for each user who heard them
+func dbLeaderboards(limit int) (gin.H, error) {
+	boards := map[string][]leaderboardEntry{"listened_ms": {}, "sessions_hosted": {}, "sessions_joined": {}, "tracks": {}}
+	artists := make(map[string]int)
+	tracks := make(map[string]*ws.StatsCount)
+
+	err := db.View(func(tx store.Tx) error {
+		return tx.Bucket("stats").ForEach(func(k, v []byte) error {
+			var s userStats
+			err := json.Unmarshal(v, &s)
+			if err != nil {
+				return err
+			}
+
+			name := string(k)
+			boards["listened_ms"] = append(boards["listened_ms"], leaderboardEntry{name, s.Listened})
+			boards["sessions_hosted"] = append(boards["sessions_hosted"], leaderboardEntry{name, int64(s.SessionsHosted)})
+			boards["sessions_joined"] = append(boards["sessions_joined"], leaderboardEntry{name, int64(s.SessionsJoined)})
+			boards["tracks"] = append(boards["tracks"], leaderboardEntry{name, int64(s.Tracks)})
+			for a, c := range s.Artists {
+				artists[a] += c
+			}
+			for uri, p := range s.TrackPlays {
+				t, ok := tracks[uri]
+				if !ok {
+					t = &ws.StatsCount{Name: p.Name, URI: uri}
+					tracks[uri] = t
+				}
+				t.Count += p.Plays
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := gin.H{}
+	for key, b := range boards {
+		sort.Slice(b, func(i, j int) bool {
+			if b[i].Value != b[j].Value {
+				return b[i].Value > b[j].Value
+			}
+			return b[i].Name < b[j].Name
+		})
+		if len(b) > limit {
+			b = b[:limit]
+		}
+		res[key] = b
+	}
+
+	topTracks := make([]ws.StatsCount, 0, len(tracks))
+	for _, t := range tracks {
+		topTracks = append(topTracks, *t)
+	}
+	sortCounts(topTracks)
+	if len(topTracks) > limit {
+		topTracks = topTracks[:limit]
+	}
+	res["top_artists"] = topCounts(artists, limit)
+	res["top_tracks"] = topTracks
+	return res, nil
+}
+
+// Route for the server's leaderboards, "limit" is how many users are in each one. If a
+// "user" is given then their stats are returned instead, with "limit" of their top entries
+func viewStats(c *gin.Context) {
+	limit := defaultLeaderboardLimit
+	if l := c.Query("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Limit must be a positive number"})
+			return
+		}
+	}
+
+	if name := c.Query("user"); name != "" {
+		s, err := dbViewStats(name)
+		if err != nil {
+			Log.Error().Err(err).Msg("Error viewing stats")
+			c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error viewing stats"})
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "error": "", "stats": s.summary(name, limit)})
+		return
+	}
+
+	boards, err := dbLeaderboards(limit)
+	if err != nil {
+		Log.Error().Err(err).Msg("Error viewing leaderboards")
+		c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error viewing leaderboards"})
+		return
+	}
+	c.JSON(200, gin.H{"success": true, "error": "", "leaderboards": boards})
+}
+
+// Moves the user's stats when they're renamed
+func moveStats(tx store.Tx, oldName, newName string) error {
+	b := tx.Bucket("stats")
+	v := b.Get([]byte(oldName))
+	if v == nil {
+		return nil
+	}
+	err := b.Put([]byte(newName), v)
+	if err != nil {
+		return err
+	}
+	return b.Delete([]byte(oldName))
+}
+
+// Counts the tracks in the play history recorded before stats were kept, the time
+// listened and sessions hosted and joined weren't recorded so they can't be counted
+func backfillStats(tx store.Tx) (int, error) {
+	b := tx.Bucket("history")
+	if b == nil {
+		return 0, nil
+	}
+
+	var n int
+	err := b.ForEach(func(k, v []byte) error {
+		var e ws.HistoryEntry
+		err := json.Unmarshal(v, &e)
+		if err != nil {
+			return err
+		}
+		n++
+		return addTrackStats(tx, e)
+	})
+	return n, err
+}
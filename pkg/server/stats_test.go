@@ -0,0 +1,63 @@
+package server
+
+import (
+	"github.com/zmb3/spotify"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Returns the state of a host playing the track
+func playingState(uri string) *spotify.PlayerState {
+	return &spotify.PlayerState{CurrentlyPlaying: spotify.CurrentlyPlaying{
+		Playing: true,
+		Item:    &spotify.FullTrack{SimpleTrack: spotify.SimpleTrack{Name: uri, URI: spotify.URI(uri)}},
+	}}
+}
+
+func TestRecordPlaybackWhileUsersJoin(t *testing.T) {
+	openTestDB(t)
+	s := newSession(&user{name: "alice"})
+	serving.Add(1)
+	go s.handleChannels()
+
+	// Another user joins and leaves while the host's tracks are recorded
+	left := make(chan struct{})
+	go func() {
+		defer close(left)
+		for i := 0; i < 50; i++ {
+			u := &user{name: "bob"}
+			s.register <- u
+			s.unregister <- u
+		}
+	}()
+
+	// History keys are the time in milliseconds so the tracks are recorded apart like syncs are
+	tracks := 50
+	for i := 0; i < tracks; i++ {
+		s.recordPlayback(playingState("spotify:track:" + strconv.Itoa(i)))
+		time.Sleep(2 * time.Millisecond)
+	}
+	<-left
+	s.creditListening()
+	s.done <- nil
+	<-s.quit
+
+	// The stats count the tracks the history says each user heard
+	for _, name := range []string{"alice", "bob"} {
+		entries, _, err := dbViewHistory(historyFilter{User: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats, err := dbViewStats(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "alice" && len(entries) != tracks {
+			t.Errorf("alice heard %d tracks, want %d", len(entries), tracks)
+		}
+		if stats.Tracks != len(entries) {
+			t.Errorf("%s: stats count %d tracks, history has %d", name, stats.Tracks, len(entries))
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"github.com/gin-gonic/gin"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Login throttling, each IP address and account can fail to login a few times freely after which
+// they're locked out for a period which doubles with every further failure. Failed attempts are
+// forgotten once the window passes without another failure, or for accounts when a login to them succeeds
+var (
+	throttleFreeAttempts = 5
+	throttleBaseLockout  = 30 * time.Second
+	throttleMaxLockout   = 1 * time.Hour
+	throttleWindow       = 24 * time.Hour
+)
+
+// Failed login attempts of an IP address or account
+type lockout struct {
+	Key         string `json:"key"`                    // "ip:<address>" or "user:<name>"
+	Failures    int    `json:"failures"`               // Failed attempts within the window
+	LastFailure string `json:"last_failure"`           // When the last attempt failed
+	LockedUntil string `json:"locked_until,omitempty"` // When logins are allowed again
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func accountKey(name string) string {
+	return "user:" + name
+}
+
+// Returns the IP address a request came from
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Whether the lockout's failures are old enough to be forgotten
+func (l *lockout) stale(now time.Time) bool {
+	last, err := time.Parse(ws.TimeLayout, l.LastFailure)
+	return err != nil || now.Sub(last) > throttleWindow
+}
+
+// Returns how long a key which has failed this many times is locked out for
+func lockoutDuration(failures int) time.Duration {
+	if failures <= throttleFreeAttempts {
+		return 0
+	}
+	if n := failures - throttleFreeAttempts - 1; n < 32 && throttleBaseLockout<<n < throttleMaxLockout {
+		return throttleBaseLockout << n
+	}
+	return throttleMaxLockout
+}
+
+// Returns the latest time any of the keys are locked out until in the transaction, zero if none are locked out
+func lockedUntil(tx store.Tx, now time.Time, keys ...string) (time.Time, error) {
+	var until time.Time
+	b := tx.Bucket("lockouts")
+	for _, k := range keys {
+		v := b.Get([]byte(k))
+		if v == nil {
+			continue
+		}
+
+		var l lockout
+		err := json.Unmarshal(v, &l)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if l.LockedUntil == "" {
+			continue
+		}
+		t, err := time.Parse(ws.TimeLayout, l.LockedUntil)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if t.After(until) {
+			until = t
+		}
+	}
+	if now.After(until) {
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+// Records a failed login for each key in the transaction, locking them out if they've failed too many times
+func recordFailures(tx store.Tx, now time.Time, keys ...string) error {
+	b := tx.Bucket("lockouts")
+	for _, k := range keys {
+		l := lockout{Key: k}
+		if v := b.Get([]byte(k)); v != nil {
+			err := json.Unmarshal(v, &l)
+			if err != nil {
+				return err
+			}
+			if l.stale(now) {
+				l = lockout{Key: k}
+			}
+		}
+
+		l.Failures++
+		l.LastFailure = now.UTC().Format(ws.TimeLayout)
+		if d := lockoutDuration(l.Failures); d > 0 {
+			l.LockedUntil = now.Add(d).UTC().Format(ws.TimeLayout)
+		}
+
+		v, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		err = b.Put([]byte(k), v)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Forget the failures which are too old to matter
+	var stale [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		var l lockout
+		if json.Unmarshal(v, &l) != nil || l.stale(now) {
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range stale {
+		err = b.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Records a failed login for each key, locking them out if they've failed too many times
+func dbRecordFailure(keys ...string) error {
+	return db.Update(func(tx store.Tx) error {
+		return recordFailures(tx, time.Now(), keys...)
+	})
+}
+
+// Starts a login attempt from the IP address to the account, the attempt is refused if either of them
+// are locked out. Otherwise it's counted as a failure until it succeeds, the check and the count are
+// done together so parallel attempts can't all pass the check before any of them fail. The account
+// is only counted if it exists so made up names aren't stored. Returns when the lockout ends if refused
+func dbStartAttempt(ip, username string) (time.Time, error) {
+	var until time.Time
+	err := db.Update(func(tx store.Tx) error {
+		now := time.Now()
+		var err error
+		until, err = lockedUntil(tx, now, ipKey(ip), accountKey(username))
+		if err != nil || !until.IsZero() {
+			return err
+		}
+
+		keys := []string{ipKey(ip)}
+		if username != "" && tx.Bucket("users").Get([]byte(username)) != nil {
+			keys = append(keys, accountKey(username))
+		}
+		return recordFailures(tx, now, keys...)
+	})
+	return until, err
+}
+
+// Records that the login attempt succeeded, the account's failed logins are forgotten and the
+// attempt is no longer counted against the IP address. The IP address's other failures are kept
+// so logging in to one account doesn't reset the lockout for guessing the passwords of others
+func dbAttemptSucceeded(ip, username string) error {
+	return db.Update(func(tx store.Tx) error {
+		b := tx.Bucket("lockouts")
+		err := b.Delete([]byte(accountKey(username)))
+		if err != nil {
+			return err
+		}
+
+		k := []byte(ipKey(ip))
+		v := b.Get(k)
+		if v == nil {
+			return nil
+		}
+		var l lockout
+		err = json.Unmarshal(v, &l)
+		if err != nil {
+			return err
+		}
+		l.Failures--
+		if l.Failures <= 0 {
+			return b.Delete(k)
+		}
+
+		l.LockedUntil = ""
+		if d := lockoutDuration(l.Failures); d > 0 {
+			last, err := time.Parse(ws.TimeLayout, l.LastFailure)
+			if err != nil {
+				return err
+			}
+			l.LockedUntil = last.Add(d).UTC().Format(ws.TimeLayout)
+		}
+		v, err = json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		return b.Put(k, v)
+	})
+}
+
+// Forgets the failed logins of each key
+func dbClearLockouts(keys ...string) error {
+	return db.Update(func(tx store.Tx) error {
+		b := tx.Bucket("lockouts")
+		for _, k := range keys {
+			err := b.Delete([]byte(k))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Returns the IP addresses and accounts with recent failed logins, sorted by key
+func dbViewLockouts() ([]lockout, error) {
+	now := time.Now()
+	lockouts := make([]lockout, 0)
+	err := db.View(func(tx store.Tx) error {
+		return tx.Bucket("lockouts").ForEach(func(k, v []byte) error {
+			var l lockout
+			err := json.Unmarshal(v, &l)
+			if err != nil {
+				return err
+			}
+			if !l.stale(now) {
+				lockouts = append(lockouts, l)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(lockouts, func(i, j int) bool { return lockouts[i].Key < lockouts[j].Key })
+	return lockouts, nil
+}
+
+// Records a failed login in the audit log and counts it towards the lockouts. Only
+// the IP address is counted if the account doesn't exist so made up names aren't stored
+func (u *user) loginFailed(username, reason string, accountExists bool) {
+	ip := remoteIP(u.r)
+	Log.Warn().Str("Username", username).Str("Remote", ip).Str("Reason", reason).Msg("Failed login")
+	dbAudit(auditEntry{Action: "login.failed", Target: username, Remote: ip, Detail: reason})
+
+	keys := []string{ipKey(ip)}
+	if accountExists {
+		keys = append(keys, accountKey(username))
+	}
+	err := dbRecordFailure(keys...)
+	if err != nil {
+		Log.Error().Err(err).Msg("Failed recording failed login")
+	}
+}
+
+// Starts an attempt to login to the account, it's counted as a failure until attemptSucceeded is called.
+// Fails if the user's IP address or the account they're logging in to is locked out
+func (u *user) startAttempt(username string) error {
+	until, err := dbStartAttempt(remoteIP(u.r), username)
+	if err != nil {
+		return err
+	}
+	return u.lockedOut(username, until)
+}
+
+// Records that the user's login attempt succeeded
+func (u *user) attemptSucceeded(username string) {
+	err := dbAttemptSucceeded(remoteIP(u.r), username)
+	if err != nil {
+		Log.Error().Err(err).Msg("Failed clearing lockouts")
+	}
+}
+
+// Records a failed login attempt in the audit log, it was already counted towards the lockouts when it started
+func (u *user) attemptFailed(username, reason string) {
+	ip := remoteIP(u.r)
+	Log.Warn().Str("Username", username).Str("Remote", ip).Str("Reason", reason).Msg("Failed login")
+	dbAudit(auditEntry{Action: "login.failed", Target: username, Remote: ip, Detail: reason})
+}
+
+// Tells the user they're locked out and fails if the lockout hasn't ended
+func (u *user) lockedOut(username string, until time.Time) error {
+	if until.IsZero() {
+		return nil
+	}
+
+	wait := time.Until(until).Round(time.Second)
+	ip := remoteIP(u.r)
+	Log.Warn().Str("Username", username).Str("Remote", ip).Msg("Login attempted while locked out")
+	dbAudit(auditEntry{Action: "login.failed", Target: username, Remote: ip, Detail: "locked out"})
+	_ = u.sendInfo("Too many failed logins, try again in " + wait.String())
+	return errors.New("Login locked out")
+}
+
+// Route for listing the IP addresses and accounts with recent failed logins
+func viewLockouts(c *gin.Context) {
+	lockouts, err := dbViewLockouts()
+	if err != nil {
+		Log.Error().Err(err).Msg("Error viewing lockouts")
+		c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error viewing lockouts"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "error": "", "lockouts": lockouts})
+}
+
+// Route for clearing the failed logins of an IP address or account, the
+// key is given as "ip:<address>" or "user:<name>" like in the lockout list
+func clearLockout(c *gin.Context) {
+	var r ws.LockoutRequest
+	err := c.BindJSON(&r)
+	if err != nil {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Request incorrect"})
+		return
+	}
+	if r.Key == "" {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: "Must include key"})
+		return
+	}
+
+	err = dbClearLockouts(r.Key)
+	if err != nil {
+		Log.Error().Err(err).Msg("Error clearing lockout")
+		c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error clearing lockout"})
+		return
+	}
+
+	Log.Info().Str("Key", r.Key).Msg("Cleared lockout")
+	adminAudit(c, "lockout.clear", r.Key, "")
+	c.JSON(200, ws.Response{Success: true, Error: ""})
+}
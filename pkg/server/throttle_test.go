@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Returns the lockout of the key, nil if it has no failures
+func testLockout(t *testing.T, key string) *lockout {
+	t.Helper()
+	v := getTestValue(t, "lockouts", key)
+	if v == nil {
+		return nil
+	}
+	var l lockout
+	err := json.Unmarshal(v, &l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &l
+}
+
+func TestLockoutDuration(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{5, 0},
+		{6, 30 * time.Second},
+		{7, time.Minute},
+		{12, 32 * time.Minute},
+		{13, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := lockoutDuration(tt.failures); got != tt.want {
+			t.Errorf("lockout after %d failures = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestStartAttempt(t *testing.T) {
+	openTestDB(t)
+	err := dbSaveUser(&entry{Name: "alice"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every attempt counts until it succeeds, so the one after the free attempts and the lockout is refused
+	for i := 1; i <= throttleFreeAttempts+2; i++ {
+		until, err := dbStartAttempt("10.0.0.1", "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked := !until.IsZero(); locked != (i > throttleFreeAttempts+1) {
+			t.Errorf("attempt %d locked out = %v", i, locked)
+		}
+	}
+	for _, k := range []string{ipKey("10.0.0.1"), accountKey("alice")} {
+		if l := testLockout(t, k); l == nil || l.Failures != throttleFreeAttempts+1 || l.LockedUntil == "" {
+			t.Errorf("%s = %+v, want %d failures and locked out", k, l, throttleFreeAttempts+1)
+		}
+	}
+
+	// Made up accounts aren't stored
+	_, err = dbStartAttempt("10.0.0.2", "ghost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := testLockout(t, accountKey("ghost")); l != nil {
+		t.Errorf("missing account was stored: %+v", l)
+	}
+	if l := testLockout(t, ipKey("10.0.0.2")); l == nil || l.Failures != 1 {
+		t.Errorf("ip = %+v, want 1 failure", l)
+	}
+}
+
+func TestAttemptSucceeded(t *testing.T) {
+	tests := []struct {
+		name       string
+		ipFailures int // Failures of the IP address before the attempt
+		want       int // Failures of the IP address after the attempt succeeds
+	}{
+		{"no failures", 0, 0},
+		{"failures kept", 2, 2},
+		{"lockout undone", throttleFreeAttempts, throttleFreeAttempts},
+	}
+	for _, tt := range tests {
+		openTestDB(t)
+		err := dbSaveUser(&entry{Name: "alice"}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < tt.ipFailures; i++ {
+			err = dbRecordFailure(ipKey("10.0.0.1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		until, err := dbStartAttempt("10.0.0.1", "alice")
+		if err != nil || !until.IsZero() {
+			t.Fatalf("%s: start = %v, %v", tt.name, until, err)
+		}
+		err = dbAttemptSucceeded("10.0.0.1", "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if l := testLockout(t, accountKey("alice")); l != nil {
+			t.Errorf("%s: account = %+v, want its failures forgotten", tt.name, l)
+		}
+		l := testLockout(t, ipKey("10.0.0.1"))
+		if tt.want == 0 && l != nil {
+			t.Errorf("%s: ip = %+v, want no failures", tt.name, l)
+		} else if tt.want > 0 && (l == nil || l.Failures != tt.want || l.LockedUntil != "") {
+			t.Errorf("%s: ip = %+v, want %d failures and not locked out", tt.name, l, tt.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Names of the files in the data dir where the self-signed development certificate
+// is kept so clients can keep trusting it across restarts
+var (
+	selfSignedCertFile = "dev-cert.pem"
+	selfSignedKeyFile  = "dev-key.pem"
+)
+
+// How long self-signed development certificates last
+var selfSignedValidity = 365 * 24 * time.Hour
+
+// Certificate served over TLS, if nil the server serves plain HTTP
+var certs *certReloader
+
+// Holds the certificate served over TLS, it's loaded from its files again
+// when reloaded so certificates can be renewed without restarting the server
+type certReloader struct {
+	mutex    sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+}
+
+// Loads the certificate and key the server serves HTTPS/WSS with. If selfSigned is true and no files
+// are given then a self-signed certificate for the hosts is generated for local development, it's
+// reused on later runs so clients only have to trust it once. Nothing is loaded if no files are given
+func LoadTLS(certFile, keyFile string, selfSigned bool, hosts ...string) error {
+	if certFile == "" && keyFile == "" {
+		if !selfSigned {
+			return nil
+		}
+		certFile, keyFile = dataPath(selfSignedCertFile), dataPath(selfSignedKeyFile)
+
+		// The data dir is created here if it's the first run, otherwise making the
+		// certificate's dir would leave it readable by everyone when the server runs
+		err := createDataDir()
+		if err != nil {
+			return err
+		}
+		_, err = os.Stat(certFile)
+		if os.IsNotExist(err) {
+			err = generateSelfSigned(certFile, keyFile, hosts)
+		}
+		if err != nil {
+			return errors.New("Cannot create self-signed certificate: " + err.Error())
+		}
+	} else if certFile == "" || keyFile == "" {
+		return errors.New("Both a TLS certificate and key file must be given")
+	}
+
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	err := r.reload()
+	if err != nil {
+		return err
+	}
+	certs = r
+	return nil
+}
+
+// Loads the certificate from its files, the current certificate is kept if they can't be loaded
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.New("Cannot load TLS certificate: " + err.Error())
+	}
+
+	r.mutex.Lock()
+	r.cert = &cert
+	r.mutex.Unlock()
+	return nil
+}
+
+// Returns the current certificate, used by the tls.Config so reloads apply to new connections
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.cert, nil
+}
+
+// Reloads the certificate whenever the server receives a SIGHUP
+func (r *certReloader) reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		err := r.reload()
+		if err != nil {
+			Log.Error().Err(err).Msg("Failed reloading TLS certificate, still serving the previous one")
+			continue
+		}
+		Log.Info().Str("Cert", r.certFile).Msg("Reloaded TLS certificate")
+	}
+}
+
+// Returns the TLS config the server uses with the loaded certificate
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// Generates a self-signed certificate for the hosts and writes it and its key to the files. The
+// certificate is also a CA so clients can trust it directly, i.e. with the client's CA file option
+func generateSelfSigned(certFile, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Spotify Sync Development"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	// Localhost is always included so the server can be reached locally
+	for _, h := range append([]string{"localhost", "127.0.0.1", "::1"}, hosts...) {
+		if host, _, err := net.SplitHostPort(h); err == nil {
+			h = host
+		}
+		if h == "" {
+			continue
+		}
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(certFile), 0700)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(keyFile), 0700)
+	if err != nil {
+		return err
+	}
+	err = writePEM(certFile, "CERTIFICATE", der, 0644)
+	if err != nil {
+		return err
+	}
+	return writePEM(keyFile, "PRIVATE KEY", keyBytes, 0600)
+}
+
+// Writes a single PEM block to the file
+func writePEM(path, blockType string, b []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	err = pem.Encode(f, &pem.Block{Type: blockType, Bytes: b})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"golang.org/x/oauth2"
+	"strings"
+	"sync"
+)
+
+// Wraps a user's oauth2 token source so whenever spotify issues a new access token
+// (or rotates the refresh token) it is saved to the user's entry, this means the
+// client recreated from the db on the next login doesn't start with a stale token
+type persistingTokenSource struct {
+	mutex   sync.Mutex
+	u       *user              // User who owns the token
+	base    oauth2.TokenSource // Source which refreshes the token when it expires
+	last    *oauth2.Token      // The token which was last saved
+	stopped bool               // Whether the source was stopped, it no longer returns or saves tokens
+}
+
+// Creates a token source for the user which refreshes the token when needed and persists it
+func newTokenSource(u *user, token *oauth2.Token) *persistingTokenSource {
+	return &persistingTokenSource{
+		u:    u,
+		base: oauthConfig.TokenSource(context.Background(), token),
+		last: token,
+	}
+}
+
+// Returns a valid token, saving it to the db if it was refreshed. If the refresh
+// token has been revoked or expired then the user is asked to authorise again
+func (s *persistingTokenSource) Token() (*oauth2.Token, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopped || s.u.isUnlinked() {
+		return nil, errors.New("Spotify unlinked")
+	}
+
+	t, err := s.base.Token()
+	if err != nil {
+		if isTokenRevoked(err) {
+			s.u.tokenRevoked(err)
+		}
+		return nil, err
+	}
+
+	if s.last == nil || t.AccessToken != s.last.AccessToken || t.RefreshToken != s.last.RefreshToken {
+		err = dbSaveToken(s.u.name, t)
+		if err != nil {
+			// The refreshed token can still be used even if it couldn't be saved
+			Log.Error().Err(err).Str("Username", s.u.name).Msg("Failed saving refreshed token to db")
+		} else {
+			Log.Debug().Str("Username", s.u.name).Msg("Saved refreshed token to db")
+		}
+		s.last = t
+		s.u.token = t
+	}
+	return t, nil
+}
+
+// Stops the source from returning or saving tokens, it waits for a token which is being
+// refreshed to be saved first so nothing is written to the db once it returns
+func (s *persistingTokenSource) stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.stopped = true
+}
+
+// Whether the error means the refresh token can no longer be used, spotify
+// responds with an "invalid_grant" error if it's been revoked or has expired
+func isTokenRevoked(err error) bool {
+	var re *oauth2.RetrieveError
+	if !errors.As(err, &re) {
+		return false
+	}
+	return strings.Contains(string(re.Body), "invalid_grant")
+}
+
+// Saves a user's oauth2 token to their entry, encrypted if token keys are loaded. The scopes
+// spotify granted are saved too if it sent them, otherwise the previous scopes are kept
+func dbSaveToken(name string, token *oauth2.Token) error {
+	tokenBytes, err := json.Marshal(token)
+	if err != nil {
+		return errors.New("Cannot encode json token into byte string: " + err.Error())
+	}
+
+	enc, err := encryptToken(string(tokenBytes))
+	if err != nil {
+		return errors.New("Cannot encrypt token: " + err.Error())
+	}
+	return dbModifyUser(name, func(e *entry) error {
+		e.Token = enc
+		if scopes, ok := token.Extra("scope").(string); ok && scopes != "" {
+			e.Scopes = scopes
+		}
+		return nil
+	})
+}
+
+// Returns a user's oauth2 token from their entry, nil if they don't have one
+func (e *entry) oauthToken() (*oauth2.Token, error) {
+	plain, err := decryptToken(e.Token)
+	if err != nil {
+		return nil, err
+	}
+	if plain == "" || plain == "null" {
+		return nil, nil
+	}
+
+	var tkn *oauth2.Token
+	err = json.Unmarshal([]byte(plain), &tkn)
+	if err != nil {
+		return nil, errors.New("Cannot parse token from db: " + err.Error())
+	}
+	return tkn, nil
+}
@@ -1,9 +1,7 @@
 package server
 
 import (
-	"encoding/json"
 	"errors"
-	"fmt"
 	sets "github.com/fiwippi/spotify-sync/pkg/set"
 	ws "github.com/fiwippi/spotify-sync/pkg/shared"
 	"github.com/gorilla/websocket"
@@ -22,25 +20,72 @@ var ids = sets.NewSet()
 // Keeps track of all the connected users (the user objects)
 var connectedUsers = make(map[*user]bool)
 
-// Channel used to send the spotify.Client created in the SpotifyCallback route
-// which is then sent to the user handshake where it is assigned to the user
-var clientChans = make(map[string]chan spotify.Client, 1)
+// Locks access to the connected usernames and users
+var connectedMtx sync.Mutex
 
-// Channel used to send the oauth2.Token created in the SpotifyCallback route
-// which is then sent to the user handshake where it is assigned to the user
-var tokenChans = make(map[string]chan *oauth2.Token, 1)
+// Starts keeping track of the user under the name, returns false if a user with the name is already connected
+func addConnectedUser(u *user, name string) bool {
+	connectedMtx.Lock()
+	defer connectedMtx.Unlock()
+
+	if ids.Has(name) {
+		return false
+	}
+	u.name = name
+	ids.Add(name)
+	connectedUsers[u] = true
+	return true
+}
+
+// Stops keeping track of the user
+func removeConnectedUser(u *user) {
+	connectedMtx.Lock()
+	defer connectedMtx.Unlock()
+
+	ids.Remove(u.name)
+	delete(connectedUsers, u)
+}
+
+// Whether a user with the name is connected
+func isConnected(name string) bool {
+	connectedMtx.Lock()
+	defer connectedMtx.Unlock()
+
+	return ids.Has(name)
+}
+
+// Returns the connected users, the slice is a copy so users can disconnect while it's used
+func listConnectedUsers() []*user {
+	connectedMtx.Lock()
+	defer connectedMtx.Unlock()
+
+	users := make([]*user, 0, len(connectedUsers))
+	for u := range connectedUsers {
+		users = append(users, u)
+	}
+	return users
+}
 
 // Active users connected to the server
 type user struct {
-	mutex         sync.Mutex           // Locks writing to websocket conn
-	name          string               // Identifies the user in the database
-	r             *http.Request        // Request used to upgrade the user connection
-	w             http.ResponseWriter  // Response writer used to upgrade the user connection
-	conn          *websocket.Conn      // Servers shared connection to the user client
-	spotifyClient spotify.Client       // The spotify client used to control the user's spotify
-	spotifyData   *spotify.PrivateUser // Holds data about the user
-	s             *session             // The current session the user is connected to
-	token         *oauth2.Token        // Token used to refresh access to the client
+	mutex         sync.Mutex             // Locks writing to websocket conn
+	name          string                 // Identifies the user in the database
+	r             *http.Request          // Request used to upgrade the user connection
+	w             http.ResponseWriter    // Response writer used to upgrade the user connection
+	conn          *websocket.Conn        // Servers shared connection to the user client
+	codec         ws.Codec               // Encodes messages in the format negotiated with the user client
+	spotifyClient Player                 // The spotify client used to control the user's spotify
+	spotifyData   *spotify.PrivateUser   // Holds data about the user
+	s             *session               // The current session the user is connected to
+	token         *oauth2.Token          // Token used to refresh access to the client
+	resumeToken   string                 // Token the user can use to resume their connection if it drops
+	suspended     bool                   // Whether the user's connection dropped and they are waiting to resume
+	graceTimer    *time.Timer            // Disconnects the user if they don't resume in time
+	closed        bool                   // Whether the user has been disconnected
+	served        bool                   // Whether the handshake finished and the user is being served
+	authorising   bool                   // Whether the user is being asked to authorise spotify again
+	unlinked      bool                   // Whether the user unlinked spotify, their token is no longer used
+	tokenSource   *persistingTokenSource // Refreshes the user's token and saves it to the db
 }
 
 // Upgrades user to shared connection (websocket) from a http connection
@@ -56,28 +101,41 @@ func (u *user) upgrade() error {
 		return err
 	}
 
+	// Messages larger than the limit close the connection
+	if maxMessageSize > 0 {
+		conn.SetReadLimit(maxMessageSize)
+	}
+
 	u.conn = conn
+	u.codec = ws.CodecFor(conn)
 	return nil
 }
 
 // Disconnects a user from the server
 func (u *user) disconnect() {
-	u.mutex.Lock() //  Ensures only one disconnect function runs at once and stops further reading from websocket
+	// Ensures only one disconnect function runs for the user
+	u.mutex.Lock()
+	if u.closed {
+		u.mutex.Unlock()
+		return
+	}
+	u.closed = true
+	u.suspended = false
+	if u.graceTimer != nil {
+		u.graceTimer.Stop()
+		u.graceTimer = nil
+	}
+	u.mutex.Unlock()
 	Log.Info().Str("Username", u.name).Msg("Disconnecting user")
 
+	// The user can no longer resume
+	u.revokeResumeToken()
+
 	// Stop keeping track of the user
-	ids.Remove(u.name)
-	delete(connectedUsers, u)
+	removeConnectedUser(u)
 
-	// Close relevant channels
-	clientChan := clientChans[u.name]
-	if clientChan != nil && !isSpotifyClientChanClosed(clientChan) {
-		close(clientChan)
-	}
-	tokenChan := tokenChans[u.name]
-	if tokenChan != nil && !isSpotifyTokenChanClosed(tokenChan) {
-		close(tokenChan)
-	}
+	// Stop waiting for the user to authorise spotify
+	u.cancelPendingAuths()
 
 	// Determine if user is connected to session
 	if u.s != nil {
@@ -104,151 +162,302 @@ func (u *user) disconnect() {
 		// Inform user they are being disconnected
 		_ = u.sendInfo("Disconnection occurring")
 
-		// Close the shared connection
+		// Close the shared connection, this also stops further reading from the websocket
+		u.mutex.Lock()
 		err := u.conn.Close()
+		u.mutex.Unlock()
 		if err != nil {
 			log.Error().Err(err).Str("Username", u.name).Msg("Error closing websocket conn")
 		}
 	}
 }
 
-// Performs the handshake procedure
-func (u *user) handshake() error {
-	// Ask the user to send login credentials
-	Log.Trace().Msg("Performing handshake")
+// Reads a single message from the user's connection, failing if it takes longer than the timeout
+func (u *user) readReply(timeout time.Duration) (*ws.Message, error) {
+	var msg ws.Message
+
+	err := u.conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+	err = u.codec.ReadMessage(u.conn, &msg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Clear the deadline so later reads are unaffected
+	err = u.conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Asks the user to send their login credentials (or a resume token)
+func (u *user) requestLogin() error {
 	msg := &ws.Message{
 		Op:        "LOGIN",
 		Args:      nil,
 		Body:      "",
 		Timestamp: ws.CurrentTime(),
 	}
-	err := u.WriteJSON(msg)
+	return u.WriteMessage(msg)
+}
+
+// Performs the handshake procedure. If the user resumes a previous
+// connection then the user they resumed is returned, otherwise the
+// user the handshake was performed on is returned
+func (u *user) handshake() (*user, error) {
+	// Ask the user to send login credentials
+	Log.Trace().Msg("Performing handshake")
+	err := u.requestLogin()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	Log.Trace().Msg("Sent LOGIN opcode")
 
-	// Read the username and password
-	var username, password string
-	errChan := make(chan error)
-	go func() {
-		err = u.conn.ReadJSON(msg)
-		errChan <- err
-	}()
-	select {
-	case err = <-errChan:
-		reply := strings.Split(msg.Body, ",")
-		if len(reply) != 2 {
-			return errors.New("No username or password")
+	// Read the username and password, if the user instead sends a resume token then
+	// attempt to resume, if the token is invalid they're asked to login once more
+	var reply *ws.Message
+	for attempt := 0; ; attempt++ {
+		reply, err = u.readReply(1 * time.Minute)
+		if err != nil {
+			return nil, errors.New("Failed reading login details from client: " + err.Error())
+		}
+		if reply.Op != "RESUME" {
+			break
+		}
+
+		if resumed := lookupResumeToken(reply.Body); resumed != nil {
+			Log.Trace().Str("username", resumed.name).Msg("Resuming user")
+			return resumed, resumed.resume(u.conn, u.r)
+		}
+		if attempt > 0 {
+			return nil, errors.New("Invalid resume token")
+		}
+
+		Log.Trace().Msg("Invalid resume token, asking for login")
+		err = u.sendInfo("Could not resume connection, logging in again")
+		if err != nil {
+			return nil, err
+		}
+		err = u.requestLogin()
+		if err != nil {
+			return nil, err
 		}
-		username, password = reply[0], reply[1]
-		Log.Trace().Str("username", username).Str("password", password).Msg("Retrieved username, password")
-	case <-time.After(1 * time.Minute):
-		close(errChan)
-		return errors.New("Timeout for authorising access to account (client)")
 	}
 
-	// Verify the credentials exist
-	e, err := dbViewUser(username)
-	if err != nil {
-		return errors.New("User not retrieved successfully from database, " + err.Error())
+	// New users register with an invite code, everyone else logs in
+	var e *entry
+	if reply.Op == "REGISTER" {
+		e, err = u.register(reply.Body)
+	} else {
+		e, err = u.login(reply.Body)
 	}
-	if e.Password != ws.HashPassword(password) {
-		return errors.New("Password incorrect")
+	if err != nil {
+		return nil, err
 	}
-	Log.Trace().Str("user", fmt.Sprintf("%+v", e)).Msg("Password verified")
+	username := e.Name
 
-	// Disconnect if user is already connected
-	u.name = username
-	if ids.Has(u.name) {
-		return errors.New("User already connected")
+	// If the user is waiting to resume then their new connection takes over,
+	// otherwise disconnect if the user is already connected
+	if suspended := lookupSuspendedUser(username); suspended != nil {
+		Log.Trace().Str("username", username).Msg("Resuming user through login")
+		return suspended, suspended.resume(u.conn, u.r)
+	}
+	if !addConnectedUser(u, username) {
+		return nil, errors.New("User already connected")
 	}
-	ids.Add(u.name)
-	connectedUsers[u] = true
 	Log.Trace().Msg("User not already connected")
 
-	// Try and recreate client
-	if e.Token != "" && e.Token != "null" {
-		var tkn *oauth2.Token
-		err := json.Unmarshal([]byte(e.Token), &tkn)
-		if err != nil {
-			return errors.New("Cannot parse token from db: " + err.Error())
-		}
-
+	// Use the provided player if there is one, otherwise try and recreate the client
+	// If the saved token can't be loaded (i.e. its key is missing) then the user authorises again
+	tkn, err := e.oauthToken()
+	if err != nil {
+		Log.Warn().Err(err).Str("Username", u.name).Msg("Cannot load token from db")
+	}
+	if players != nil {
+		u.spotifyClient = players(u.name)
+		Log.Trace().Msg("Using provided player")
+	} else if tkn != nil {
 		u.token = tkn
-		u.spotifyClient = auth.NewClient(u.token)
+		u.spotifyClient = u.newPlayer(u.token)
 		Log.Trace().Msg("Recreated token from db")
 	} else {
-		clientChans[u.name] = make(chan spotify.Client, 1)
-		tokenChans[u.name] = make(chan *oauth2.Token, 1)
-
-		// Tell user to authenticate via auth URL sent to them
-		Log.Trace().Msg("Sending AUTH message")
-		msg = &ws.Message{
-			Op:        "AUTH",
-			Args:      nil,
-			Body:      auth.AuthURL(u.name),
-			Timestamp: ws.CurrentTime(),
-		}
-		err = u.WriteJSON(msg)
+		err = u.authorise()
 		if err != nil {
-			return err
+			return nil, err
 		}
+	}
 
-		// First we receive the token from the spotify callback function
-		select {
-		case t := <-tokenChans[u.name]:
-			Log.Trace().Msg("Received spotify token")
-			u.token = t
-		case <-time.After(5 * time.Minute):
-			return errors.New("Timeout for authorising access to account (client)")
-		}
+	// Inform user of successful handshake
+	err = u.sendInfo("Spotify client authorised, handshake successful!")
+	if err != nil {
+		return nil, err
+	}
 
-		// Second we receive the spotify client from the spotify callback function
-		select {
-		case sc := <-clientChans[u.name]:
-			Log.Trace().Msg("Received spotify client")
-			u.spotifyClient = sc
-		case <-time.After(5 * time.Second):
-			return errors.New("Timeout for authorising access to account (token)")
-		}
+	// Allow the user to resume their connection if it drops
+	err = u.issueResumeToken()
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
 
-		// Save the created token to the db so the spotify client can be recreated for the user on connection
-		tokenBytes, err := json.Marshal(u.token)
-		if err != nil {
-			return errors.New("Cannot encode json token into byte string: " + err.Error())
-		}
+// Verifies the "username,password" credentials sent by the user and returns their entry
+func (u *user) login(body string) (*entry, error) {
+	var username, password string
+	creds := strings.Split(body, ",")
+	if len(creds) != 2 {
+		u.loginFailed("", "malformed credentials", false)
+		return nil, errors.New("No username or password")
+	}
+	username, password = creds[0], creds[1]
+	Log.Trace().Str("username", username).Msg("Retrieved username, password")
 
-		e = &entry{
-			Name:     u.name,
-			Password: ws.HashPassword(password),
-			Token:    string(tokenBytes),
-		}
+	// Stop brute forcing by refusing logins from locked out IP addresses and to locked out accounts,
+	// the attempt counts as a failure until the password is verified
+	err := u.startAttempt(username)
+	if err != nil {
+		return nil, err
+	}
 
-		err = dbSaveUser(e, true)
+	// Verify the credentials exist
+	e, err := dbViewUser(username)
+	if err != nil {
+		u.attemptFailed(username, "unknown user")
+		return nil, errors.New("User not retrieved successfully from database, " + err.Error())
+	}
+	ok, rehash, err := verifyPassword(e.Password, password)
+	if err != nil {
+		u.attemptFailed(username, "cannot verify password")
+		return nil, errors.New("Cannot verify password, " + err.Error())
+	}
+	if !ok {
+		u.attemptFailed(username, "wrong password")
+		return nil, errors.New("Password incorrect")
+	}
+	Log.Trace().Str("Username", username).Msg("Password verified")
+
+	// Forget the account's failed logins now the login has succeeded
+	u.attemptSucceeded(username)
+
+	// Upgrade legacy or outdated password hashes now the password is known
+	if rehash {
+		e.Password, err = hashPassword(password)
+		if err != nil {
+			return nil, errors.New("Cannot rehash password, " + err.Error())
+		}
+		err = dbUpdateUser(&entry{Name: e.Name, Password: e.Password})
 		if err != nil {
-			return errors.New("Failed saving token to db: " + err.Error())
+			return nil, errors.New("Failed saving rehashed password to db: " + err.Error())
 		}
-		Log.Trace().Msg("Entry saved to db")
+		Log.Debug().Str("Username", username).Msg("Rehashed password")
 	}
 
-	// Inform user of successful handshake
-	err = u.sendInfo("Spotify client authorised, handshake successful!")
+	return e, nil
+}
+
+// Tells the user to authenticate via an auth URL sent to them, once they have the
+// player is created from the new token and the token is saved to the db
+func (u *user) authorise() error {
+	url, p, err := u.newPendingAuth()
+	if err != nil {
+		return err
+	}
+
+	Log.Trace().Msg("Sending AUTH message")
+	msg := &ws.Message{
+		Op:        "AUTH",
+		Args:      nil,
+		Body:      url,
+		Timestamp: ws.CurrentTime(),
+	}
+	err = u.WriteMessage(msg)
 	if err != nil {
 		return err
 	}
+
+	// Receive the token from the spotify callback function
+	select {
+	case t := <-p.token:
+		if t == nil {
+			return errors.New("Failed authorising access to account")
+		}
+		Log.Trace().Msg("Received spotify token")
+		u.token = t
+	case <-p.cancel:
+		return errors.New("User disconnected while authorising access to account")
+	case <-time.After(authTimeout):
+		return errors.New("Timeout for authorising access to account")
+	}
+	u.spotifyClient = u.newPlayer(u.token)
+
+	// Save the created token to the db so the spotify client can be recreated for the user on connection
+	err = dbSaveToken(u.name, u.token)
+	if err != nil {
+		return errors.New("Failed saving token to db: " + err.Error())
+	}
+	Log.Trace().Msg("Entry saved to db")
 	return nil
 }
 
+// Called when the user's refresh token has been revoked or expired, the user is asked to authorise spotify again
+func (u *user) tokenRevoked(err error) {
+	if u.reauthorise("Spotify access expired, please authorise again", nil) {
+		Log.Info().Err(err).Str("Username", u.name).Msg("Spotify token revoked, asking user to authorise again")
+	}
+}
+
+// Asks the user to authorise spotify again in the background so their websocket stays connected, the
+// reason is sent to them first. Once they've authorised the function is called if it isn't nil. Returns
+// false if the user can't authorise, i.e. they're disconnected or are already authorising
+func (u *user) reauthorise(reason string, then func()) bool {
+	u.mutex.Lock()
+	if !u.served || u.closed || u.authorising {
+		u.mutex.Unlock()
+		return false
+	}
+	u.authorising = true
+	u.mutex.Unlock()
+
+	serving.Add(1)
+	go func() {
+		defer serving.Done()
+
+		_ = u.sendInfo(reason)
+		err := u.authorise()
+		if err != nil {
+			Log.Debug().Err(err).Str("Username", u.name).Msg("Failed to authorise user again")
+		} else {
+			_ = u.sendInfo("Spotify client authorised again")
+			if then != nil {
+				then()
+			}
+		}
+
+		u.mutex.Lock()
+		u.authorising = false
+		u.mutex.Unlock()
+	}()
+	return true
+}
+
 // Reads messages from the connection and processes them
 func (u *user) readPump() {
+	defer serving.Done()
+
 	var msg ws.Message
+	conn, codec, r := u.conn, u.codec, u.r
 	for {
 		// Retrieve the ws.Message struct from the connection
-		err := u.conn.ReadJSON(&msg)
+		err := codec.ReadMessage(conn, &msg)
 		if err != nil {
+			if err == websocket.ErrReadLimit {
+				Log.Warn().Str("Username", u.name).Str("Remote", remoteIP(r)).Str("Reason", "message too large").Msg("Closing websocket connection")
+			}
 			Log.Debug().Err(err).Str("Username", u.name).Msg("Read error")
-			u.disconnect()
+			u.connectionLost(conn, err)
 			return
 		}
 
@@ -270,7 +479,7 @@ func (u *user) clearUserList() {
 		Timestamp: ws.CurrentTime(),
 	}
 
-	_ = u.WriteJSON(msg)
+	_ = u.WriteMessage(msg)
 }
 
 // Processes messages and calls the relevant function
@@ -281,7 +490,12 @@ func (u *user) processMsg(m ws.Message) error {
 		return errors.New("Opcode doesn't exist")
 	}
 
-	Log.Info().Str("OPCODE", m.Op).Str("Username", u.name).Msg(m.Body)
+	// Passwords shouldn't end up in the logs
+	body := m.Body
+	if m.Op == "PASSWD" {
+		body = redacted
+	}
+	Log.Info().Str("OPCODE", m.Op).Str("Username", u.name).Msg(body)
 
 	switch cmd := m.Op; cmd {
 	case "CREATE":
@@ -292,12 +506,26 @@ func (u *user) processMsg(m ws.Message) error {
 		err = u.cmdJoin(&m)
 	case "DISCONNECT":
 		err = u.cmdDisconnect(&m)
-	case "QUIT":
+	case "EXIT", "QUIT":
 		u.disconnect()
 	case "MSG":
 		err = u.cmdMsg(&m)
 	case "HELP":
 		err = u.cmdHelp(&m)
+	case "TIME":
+		err = u.cmdTime(&m)
+	case "HISTORY":
+		err = u.cmdHistory(&m)
+	case "SAVE":
+		err = u.cmdSave(&m)
+	case "STATS":
+		err = u.cmdStats(&m)
+	case "PASSWD":
+		err = u.cmdPasswd(&m)
+	case "UNLINK":
+		err = u.cmdUnlink(&m)
+	case "WHOAMI":
+		err = u.cmdWhoami(&m)
 	default:
 		Log.Warn().Str("OPCODE", m.Op).Msg("Could not process message")
 	}
@@ -308,18 +536,17 @@ func (u *user) processMsg(m ws.Message) error {
 	return nil
 }
 
-// Sends a message and avoids concurrent writes
-func (u *user) WriteJSON(m *ws.Message) error {
-	if u.conn != nil {
-		u.mutex.Lock()
-		Log.Trace().Interface("msg", m).Msg("Sending Message")
-		err := u.conn.WriteJSON(m)
-		u.mutex.Unlock()
-		if err != nil {
-			return err
-		}
+// Sends a message encoded with the user's codec and avoids concurrent writes,
+// messages to users without a connection (i.e. suspended users) are dropped
+func (u *user) WriteMessage(m *ws.Message) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.conn == nil {
+		return nil
 	}
-	return nil
+	Log.Trace().Interface("msg", m).Msg("Sending Message")
+	return u.codec.WriteMessage(u.conn, m)
 }
 
 // Sends an INFO message to the user (message from server)
@@ -331,7 +558,7 @@ func (u *user) sendInfo(text string) error {
 		Timestamp: ws.CurrentTime(),
 	}
 
-	err := u.WriteJSON(msg)
+	err := u.WriteMessage(msg)
 	if err != nil {
 		return err
 	}
@@ -339,15 +566,15 @@ func (u *user) sendInfo(text string) error {
 }
 
 // Sends a MSG message to the user (message from other clients)
-func (u *user) sendMsg(text string) error {
+func (u *user) sendMsg(from, text string) error {
 	msg := &ws.Message{
 		Op:        "MSG",
-		Args:      []string{u.name},
+		Args:      []string{from},
 		Body:      text,
 		Timestamp: ws.CurrentTime(),
 	}
 
-	err := u.WriteJSON(msg)
+	err := u.WriteMessage(msg)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,471 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
+	"github.com/fiwippi/spotify-sync/pkg/store"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Formats users are imported and exported in
+const (
+	formatJSON = "json"
+	formatCSV  = "csv"
+)
+
+// What happens when an imported user already exists
+const (
+	conflictSkip      = "skip"      // The existing user is kept
+	conflictOverwrite = "overwrite" // The existing user is replaced, keeping their token if the import doesn't have one
+	conflictFail      = "fail"      // Nothing is imported
+)
+
+// Largest file of users the admin api imports
+const maxImportSize = 10 << 20
+
+// Returned when an import has invalid users so nothing was imported
+var errInvalidImport = errors.New("Some users are invalid, nothing was imported")
+
+// User as imported or exported. Imported users have either a password, which is hashed,
+// or the password hash exported from another server. Exported users only have their
+// password hash and token if they're asked for
+type userRecord struct {
+	Name         string `json:"name"`
+	Password     string `json:"password,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	Token        string `json:"token,omitempty"` // oauth2 token as stored, encrypted if token keys are loaded
+}
+
+// What importing a user did, or would do when dry running
+type ImportResult struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`          // "create", "overwrite", "skip" or "invalid"
+	Error  string `json:"error,omitempty"` // Why the user is invalid
+}
+
+// Report of an import
+type ImportReport struct {
+	DryRun      bool           `json:"dry_run"`
+	Created     int            `json:"created"`
+	Overwritten int            `json:"overwritten"`
+	Skipped     int            `json:"skipped"`
+	Invalid     int            `json:"invalid"`
+	Results     []ImportResult `json:"results"`
+}
+
+func (r *ImportReport) String() string {
+	return fmt.Sprintf("%d created, %d overwritten, %d skipped, %d invalid", r.Created, r.Overwritten, r.Skipped, r.Invalid)
+}
+
+// Adds the result to the report
+func (r *ImportReport) add(name, action, reason string) {
+	switch action {
+	case "create":
+		r.Created++
+	case "overwrite":
+		r.Overwritten++
+	case "skip":
+		r.Skipped++
+	case "invalid":
+		r.Invalid++
+	}
+	r.Results = append(r.Results, ImportResult{Name: name, Action: action, Error: reason})
+}
+
+// Checks the format is one users can be imported or exported in, blank is JSON
+func checkFormat(format string) (string, error) {
+	switch strings.ToLower(format) {
+	case "", formatJSON:
+		return formatJSON, nil
+	case formatCSV:
+		return formatCSV, nil
+	default:
+		return "", errors.New("Format must be \"json\" or \"csv\"")
+	}
+}
+
+// Checks the policy for users which already exist is valid
+func checkConflict(conflict string) error {
+	if conflict != conflictSkip && conflict != conflictOverwrite && conflict != conflictFail {
+		return errors.New("Conflict policy must be \"skip\", \"overwrite\" or \"fail\"")
+	}
+	return nil
+}
+
+// Reads the users from JSON, an array of users, or CSV, whose header names the columns
+// from "name", "password", "password_hash" and "token" in any order
+func readUserRecords(r io.Reader, format string) ([]userRecord, error) {
+	var records []userRecord
+	if format == formatJSON {
+		err := json.NewDecoder(r).Decode(&records)
+		if err != nil {
+			return nil, errors.New("Cannot parse JSON: " + err.Error())
+		}
+		return records, nil
+	}
+
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, errors.New("Cannot parse CSV: " + err.Error())
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("CSV has no header")
+	}
+	columns := make(map[string]int)
+	for i, c := range rows[0] {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if c != "name" && c != "password" && c != "password_hash" && c != "token" {
+			return nil, errors.New("Unknown CSV column " + strconv.Quote(c))
+		}
+		columns[c] = i
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, errors.New("CSV has no name column")
+	}
+
+	get := func(row []string, column string) string {
+		i, ok := columns[column]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return row[i]
+	}
+	for _, row := range rows[1:] {
+		records = append(records, userRecord{
+			Name:         get(row, "name"),
+			Password:     get(row, "password"),
+			PasswordHash: get(row, "password_hash"),
+			Token:        get(row, "token"),
+		})
+	}
+	return records, nil
+}
+
+// Writes the users as JSON or CSV, the CSV only has the columns for the fields asked for
+func writeUserRecords(w io.Writer, format string, records []userRecord, hashes, tokens bool) error {
+	if format == formatJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	}
+
+	cw := csv.NewWriter(w)
+	header := []string{"name"}
+	if hashes {
+		header = append(header, "password_hash")
+	}
+	if tokens {
+		header = append(header, "token")
+	}
+	err := cw.Write(header)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		row := []string{r.Name}
+		if hashes {
+			row = append(row, r.PasswordHash)
+		}
+		if tokens {
+			row = append(row, r.Token)
+		}
+		err = cw.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Returns every user to be exported, password hashes and tokens are only included if asked for
+func dbExportUsers(hashes, tokens bool) ([]userRecord, error) {
+	entries, err := dbViewUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]userRecord, 0, len(entries))
+	for _, e := range entries {
+		r := userRecord{Name: e.Name}
+		if hashes {
+			r.PasswordHash = e.Password
+		}
+		if tokens {
+			r.Token = e.Token
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// Checks the imported user is valid, returning why it isn't
+func validateUserRecord(r *userRecord) error {
+	if !usernameRegex.MatchString(r.Name) {
+		return errors.New("Usernames must be 1-32 letters, numbers, dots, underscores or hyphens")
+	}
+	if (r.Password == "") == (r.PasswordHash == "") {
+		return errors.New("Must have either a password or a password hash")
+	}
+	if r.Password != "" && len(r.Password) < minPasswordLength {
+		return errors.New("Passwords must be at least " + strconv.Itoa(minPasswordLength) + " characters long")
+	}
+	if r.PasswordHash != "" {
+		err := checkPasswordHash(r.PasswordHash)
+		if err != nil {
+			return err
+		}
+	}
+	if r.Token != "" {
+		_, err := decryptToken(r.Token)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Imports the users, existing users are handled by the conflict policy. Nothing is imported if any
+// user is invalid or, with the fail policy, already exists. When dry running the report shows what
+// would happen without anything being imported, passwords aren't hashed so it's quick
+func dbImportUsers(records []userRecord, conflict string, dryRun bool) (*ImportReport, error) {
+	err := checkConflict(conflict)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate and hash the passwords first so the db isn't held while hashing
+	invalid := make(map[int]string)
+	seen := make(map[string]bool)
+	for i := range records {
+		r := &records[i]
+		err := validateUserRecord(r)
+		if err == nil && seen[r.Name] {
+			err = errors.New("User appears more than once")
+		}
+		if err != nil {
+			invalid[i] = err.Error()
+			continue
+		}
+		seen[r.Name] = true
+
+		if r.Password != "" && !dryRun {
+			r.PasswordHash, err = hashPassword(r.Password)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var report *ImportReport
+	err = db.Update(func(tx store.Tx) error {
+		report = &ImportReport{DryRun: dryRun, Results: make([]ImportResult, 0, len(records))}
+		b := tx.Bucket("users")
+
+		for i, r := range records {
+			if reason, ok := invalid[i]; ok {
+				report.add(r.Name, "invalid", reason)
+				continue
+			}
+
+			e := &entry{Name: r.Name, Password: r.PasswordHash, Token: r.Token}
+			action := "create"
+			if v := b.Get([]byte(r.Name)); v != nil {
+				switch conflict {
+				case conflictSkip:
+					report.add(r.Name, "skip", "")
+					continue
+				case conflictFail:
+					report.add(r.Name, "invalid", "User already exists")
+					continue
+				}
+
+				// Users keep their token unless the import replaces it
+				action = "overwrite"
+				if e.Token == "" {
+					var old entry
+					err := json.Unmarshal(v, &old)
+					if err != nil {
+						return err
+					}
+					e.Token = old.Token
+					e.Scopes = old.Scopes
+				}
+			}
+			report.add(r.Name, action, "")
+
+			if dryRun {
+				continue
+			}
+			v, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			err = b.Put([]byte(e.Name), v)
+			if err != nil {
+				return err
+			}
+		}
+
+		if report.Invalid > 0 && !dryRun {
+			return errInvalidImport
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errInvalidImport {
+		return report, err
+	}
+	if err != nil && err != errDryRun {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Writes every user to the writer as JSON or CSV, the db is opened read only from its path
+// so the server must not be running unless the driver allows it. Returns how many were written
+func ExportUsers(driver, dbPath string, w io.Writer, format string, hashes, tokens bool) (int, error) {
+	format, err := checkFormat(format)
+	if err != nil {
+		return 0, err
+	}
+
+	db, err = store.Open(driver, dbPath, true)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	err = db.View(func(tx store.Tx) error {
+		if tx.Bucket("users") == nil {
+			return errors.New("The db has no users")
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	records, err := dbExportUsers(hashes, tokens)
+	if err != nil {
+		return 0, err
+	}
+	return len(records), writeUserRecords(w, format, records, hashes, tokens)
+}
+
+// Imports the users read from JSON or CSV into the db at the path, which is created if
+// it doesn't exist, see dbImportUsers. The server must not be running
+func ImportUsers(driver, dbPath string, r io.Reader, format, conflict string, dryRun bool) (*ImportReport, error) {
+	format, err := checkFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	records, err := readUserRecords(r, format)
+	if err != nil {
+		return nil, err
+	}
+
+	err = openDB(driver, dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	return dbImportUsers(records, conflict, dryRun)
+}
+
+// Route for exporting the users as JSON or CSV, the body can be imported as it is. Password
+// hashes and tokens are only included if asked for and the token has the db:backup scope
+func exportUsers(c *gin.Context) {
+	format, err := checkFormat(c.Query("format"))
+	if err != nil {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: err.Error()})
+		return
+	}
+	hashes, tokens := c.Query("hashes") == "true", c.Query("tokens") == "true"
+	if (hashes || tokens) && !requestHasScope(c, "db:backup") {
+		adminAudit(c, "admin.denied", c.Request.URL.Path, "missing scope db:backup to export secrets")
+		c.AbortWithStatusJSON(403, ws.Response{Success: false, Error: "Exporting password hashes or tokens needs the db:backup scope"})
+		return
+	}
+
+	records, err := dbExportUsers(hashes, tokens)
+	if err != nil {
+		Log.Error().Err(err).Msg("Error exporting users")
+		c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error exporting users"})
+		return
+	}
+
+	detail := strconv.Itoa(len(records)) + " users"
+	if hashes {
+		detail += ", with password hashes"
+	}
+	if tokens {
+		detail += ", with tokens"
+	}
+	adminAudit(c, "user.export", "", detail)
+
+	contentType := "application/json"
+	if format == formatCSV {
+		contentType = "text/csv"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", `attachment; filename="users.`+format+`"`)
+	c.Status(200)
+	err = writeUserRecords(c.Writer, format, records, hashes, tokens)
+	if err != nil {
+		Log.Error().Err(err).Msg("Error writing exported users")
+	}
+}
+
+// Route for importing users from the JSON or CSV body, the format is given by the format
+// query or the content type. The conflict and dry_run queries are used like the CLI's flags
+func importUsers(c *gin.Context) {
+	format := c.Query("format")
+	if format == "" && strings.Contains(c.ContentType(), "csv") {
+		format = formatCSV
+	}
+	format, err := checkFormat(format)
+	if err != nil {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: err.Error()})
+		return
+	}
+	conflict := c.DefaultQuery("conflict", conflictSkip)
+	err = checkConflict(conflict)
+	if err != nil {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: err.Error()})
+		return
+	}
+	dryRun := c.Query("dry_run") == "true"
+
+	records, err := readUserRecords(http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize), format)
+	if err != nil {
+		c.AbortWithStatusJSON(400, ws.Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	report, err := dbImportUsers(records, conflict, dryRun)
+	if err == errInvalidImport {
+		c.AbortWithStatusJSON(400, gin.H{"success": false, "error": err.Error(), "report": report})
+		return
+	} else if err != nil {
+		Log.Error().Err(err).Msg("Error importing users")
+		c.AbortWithStatusJSON(500, ws.Response{Success: false, Error: "Error importing users"})
+		return
+	}
+
+	if !dryRun {
+		Log.Info().Str("Admin", c.GetString("admin")).Str("Report", report.String()).Msg("Imported users")
+		adminAudit(c, "user.import", "", report.String()+", conflicts "+conflict)
+	}
+	c.JSON(200, gin.H{"success": true, "error": "", "report": report})
+}
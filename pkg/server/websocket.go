@@ -1,11 +1,152 @@
 package server
 
 import (
+	"bufio"
+	"errors"
+	ws "github.com/fiwippi/spotify-sync/pkg/shared"
 	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 )
 
-// Upgrades the http connection to a websocket connection
+// Upgrades the http connection to a websocket connection, permessage-deflate compression is
+// negotiated if the client supports it and the message encoding is selected via subprotocol
 var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
\ No newline at end of file
+	ReadBufferSize:    4096,
+	WriteBufferSize:   4096,
+	EnableCompression: true,
+	Subprotocols:      ws.Subprotocols,
+	CheckOrigin:       checkOrigin,
+}
+
+// Websocket limits which stop the server from being flooded, a limit of 0 means unlimited
+var (
+	allowedOrigins []string         // Origins browsers can connect from, if empty only the server's own host is allowed
+	maxMessageSize int64    = 16384 // Largest message in bytes a client can send, larger ones close the connection
+	maxConnsPerIP           = 10    // Most connections a single IP address can have open at once
+	maxConns                = 1000  // Most connections the server has open at once
+)
+
+// Connections currently open, in total and for each IP address
+var conns = struct {
+	sync.Mutex
+	total int
+	perIP map[string]int
+}{perIP: make(map[string]int)}
+
+// Sets the websocket limits. Origins are separated by commas, e.g. "https://site.net,http://localhost:8096",
+// or "*" allows any origin. Clients which aren't browsers don't send an origin so they're always allowed
+func SetWebsocketLimits(origins string, messageSize int64, perIP, total int) error {
+	allowedOrigins = nil
+	for _, o := range strings.Split(origins, ",") {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+		if o != "*" {
+			u, err := url.Parse(o)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return errors.New("Invalid origin " + strconv.Quote(o) + ", must be a scheme and host e.g. https://site.net")
+			}
+		}
+		allowedOrigins = append(allowedOrigins, strings.TrimSuffix(o, "/"))
+	}
+	if messageSize < 0 || perIP < 0 || total < 0 {
+		return errors.New("Websocket limits can't be negative")
+	}
+
+	maxMessageSize = messageSize
+	maxConnsPerIP = perIP
+	maxConns = total
+	return nil
+}
+
+// Whether the request's origin is allowed to open a websocket, requests without an origin aren't from
+// browsers so they're allowed. If no origins are configured then the origin must match the host
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if len(allowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		if err == nil && strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+	} else {
+		for _, o := range allowedOrigins {
+			if o == "*" || strings.EqualFold(o, origin) {
+				return true
+			}
+		}
+	}
+
+	Log.Warn().Str("Remote", remoteIP(r)).Str("Origin", origin).Str("Reason", "origin not allowed").Msg("Rejected websocket connection")
+	return false
+}
+
+// Reserves a connection for the IP address, if the IP address or server has too
+// many connections open then the reason is returned. The release function must
+// be called once the connection closes, it's safe to call more than once
+func acquireConn(ip string) (release func(), reason string) {
+	conns.Lock()
+	defer conns.Unlock()
+
+	if maxConns > 0 && conns.total >= maxConns {
+		return nil, "server connection limit reached"
+	}
+	if maxConnsPerIP > 0 && conns.perIP[ip] >= maxConnsPerIP {
+		return nil, "ip connection limit reached"
+	}
+	conns.total++
+	conns.perIP[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			conns.Lock()
+			defer conns.Unlock()
+
+			conns.total--
+			conns.perIP[ip]--
+			if conns.perIP[ip] <= 0 {
+				delete(conns.perIP, ip)
+			}
+		})
+	}, ""
+}
+
+// Response writer whose hijacked connection releases its reserved
+// connection when closed, so websockets are counted until they close
+type limitedWriter struct {
+	http.ResponseWriter
+	release func()
+}
+
+func (w *limitedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer can't be hijacked")
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &limitedConn{Conn: conn, release: w.release}, brw, nil
+}
+
+// Connection which releases its reserved connection when closed
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
@@ -0,0 +1,75 @@
+package ws
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/ugorji/go/codec"
+)
+
+// Websocket subprotocols which select how messages are encoded on the connection
+const (
+	ProtocolMsgpack = "spotify-sync.msgpack"
+	ProtocolCBOR    = "spotify-sync.cbor"
+	ProtocolJSON    = "spotify-sync.json"
+)
+
+// Every supported subprotocol in order of preference, the compact binary encodings
+// are preferred since they shrink large payloads i.e. user lists
+var Subprotocols = []string{ProtocolMsgpack, ProtocolCBOR, ProtocolJSON}
+
+// Encodes and decodes messages sent over a websocket connection
+type Codec interface {
+	WriteMessage(conn *websocket.Conn, m *Message) error
+	ReadMessage(conn *websocket.Conn, m *Message) error
+}
+
+// Returns the codec for the subprotocol negotiated on the connection,
+// connections which didn't negotiate one (i.e. older clients) use JSON
+func CodecFor(conn *websocket.Conn) Codec {
+	switch conn.Subprotocol() {
+	case ProtocolMsgpack:
+		return binaryCodec{h: &codec.MsgpackHandle{}}
+	case ProtocolCBOR:
+		return binaryCodec{h: &codec.CborHandle{}}
+	default:
+		return jsonCodec{}
+	}
+}
+
+// Sends messages as JSON text frames
+type jsonCodec struct{}
+
+func (jsonCodec) WriteMessage(conn *websocket.Conn, m *Message) error {
+	return conn.WriteJSON(m)
+}
+
+func (jsonCodec) ReadMessage(conn *websocket.Conn, m *Message) error {
+	*m = Message{}
+	return conn.ReadJSON(m)
+}
+
+// Sends messages as binary frames, fields are named using their json tags
+type binaryCodec struct {
+	h codec.Handle
+}
+
+func (c binaryCodec) WriteMessage(conn *websocket.Conn, m *Message) error {
+	w, err := conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	err = codec.NewEncoder(w, c.h).Encode(m)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (c binaryCodec) ReadMessage(conn *websocket.Conn, m *Message) error {
+	_, r, err := conn.NextReader()
+	if err != nil {
+		return err
+	}
+	*m = Message{}
+	return codec.NewDecoder(r, c.h).Decode(m)
+}
@@ -1,11 +1,19 @@
 package ws
 
-// Http Request which the client can send to the server to perform admin duties (account editing)
+// Http Request which the client can send to the server to perform admin duties (account editing),
+// these are authorised by an admin API token sent in the Authorization header as a Bearer token
 type Request struct {
 	CurrentName string `json:"current_name"` // Name of the user to act upon
 	NewName     string `json:"new_name"`     // Name of new user or name to change username to
 	NewPassword string `json:"new_password"` // Password of new user or password to change user's pass to
-	AdminKey    string `json:"admin_key"`    // Server key to authorise privileged requests
+}
+
+// Http Request which creates or revokes an admin API token, these requests must be
+// authorised with the server's admin key while other admin requests use the tokens
+type TokenRequest struct {
+	Name    string   `json:"name"`    // Name of the token
+	Scopes  []string `json:"scopes"`  // Scopes of the token, one or more of "users:read", "users:write", "sessions:manage", "db:read", "db:backup" and "audit:read"
+	Expires string   `json:"expires"` // How long until the token expires e.g. "720h", it never expires if empty
 }
 
 // Http Response which the server sends to the client in response to a request
@@ -13,3 +21,15 @@ type Response struct {
 	Success bool   `json:"success"` // Whether the request was a success
 	Error   string `json:"error"`   // The error msg if the request failed
 }
+
+// Http Request which clears the failed logins of an IP address or account
+type LockoutRequest struct {
+	Key string `json:"key"` // "ip:<address>" or "user:<name>"
+}
+
+// Http Request which creates or revokes an invite code
+type InviteRequest struct {
+	ID      string `json:"id"`       // ID of the invite code to revoke, the part of the code before the "."
+	MaxUses int    `json:"max_uses"` // How many users can register with the code, unlimited if 0
+	Expires string `json:"expires"`  // How long until the code expires e.g. "72h", defaults to a week if empty
+}
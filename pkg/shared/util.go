@@ -1,26 +1,41 @@
 package ws
 
 import (
-	"crypto/sha256"
-	"encoding/base64"
 	"time"
 )
 
-// Function returns the current time as a string in the format hh:mm:ss
+// Layout of message timestamps, RFC3339 in UTC with millisecond precision
+const TimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// Function returns the current time as an RFC3339 timestamp in UTC
 func CurrentTime() string {
-	return time.Now().Format("15:04:05")
+	return time.Now().UTC().Format(TimeLayout)
+}
+
+// Returns the number of milliseconds elapsed since the unix epoch
+func EpochMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
 }
 
-// Hashes a string and returns its string
-func HashPassword(pass string) string {
-	h := sha256.New()
-	h.Write([]byte(pass))
-	return base64Hash(h.Sum(nil))
+// Converts milliseconds since the unix epoch into a time
+func FromEpochMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
 }
 
-// Encodes a hash as a Base 64 string
-func base64Hash(h []byte) string {
-	return base64.URLEncoding.EncodeToString(h)
+// Formats a message timestamp as hh:mm:ss in the local timezone, the date is also
+// included if the timestamp isn't from today. Timestamps which can't be parsed,
+// i.e. those sent by older servers, are returned unchanged
+func LocalTime(timestamp string) string {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return timestamp
+	}
+
+	t = t.Local()
+	if t.Format("2006-01-02") == time.Now().Format("2006-01-02") {
+		return t.Format("15:04:05")
+	}
+	return t.Format("2006-01-02 15:04:05")
 }
 
 // Absolute function for ints
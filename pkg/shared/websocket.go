@@ -12,7 +12,36 @@ type Message struct {
 	Op        string   `json:"op"`        // Name of the command
 	Args      []string `json:"args"`      // Extra Args for the command, supplied if needed e.g. MSG opcode
 	Body      string   `json:"body"`      // Body of the command
-	Timestamp string   `json:"timestamp"` // Timestamp of the message
+	Timestamp string   `json:"timestamp"` // Timestamp of the message, RFC3339 in UTC
+}
+
+// Track played in a session, the HISTORY opcode's body is a JSON array of these
+type HistoryEntry struct {
+	Session   string   `json:"session"`    // Name of the host of the session
+	URI       string   `json:"uri"`        // Spotify URI of the track
+	Name      string   `json:"name"`       // Name of the track
+	Artists   []string `json:"artists"`    // Names of the track's artists
+	StartedAt string   `json:"started_at"` // When the host started playing the track, RFC3339 in UTC
+	Members   []string `json:"members"`    // Users in the session when the track started, sorted by name
+}
+
+// Listening statistics of a user, the STATS opcode's body is one of these as JSON
+type Stats struct {
+	User           string       `json:"user"`
+	Listened       int64        `json:"listened_ms"`      // Time spent listening in sessions in milliseconds
+	SessionsHosted int          `json:"sessions_hosted"`  // Sessions the user created
+	SessionsJoined int          `json:"sessions_joined"`  // Sessions the user joined
+	Tracks         int          `json:"tracks"`           // Tracks the user heard in sessions
+	TopArtists     []StatsCount `json:"top_artists"`      // Artists the user heard the most tracks by
+	TopTracks      []StatsCount `json:"top_tracks"`       // Tracks the user heard the most
+	TopListeners   []StatsCount `json:"top_co_listeners"` // Users the user heard the most tracks with
+}
+
+// Number of times something was counted, i.e. how many times a track was heard
+type StatsCount struct {
+	Name  string `json:"name"`
+	URI   string `json:"uri,omitempty"` // Spotify URI of tracks
+	Count int    `json:"count"`
 }
 
 // Function to create all the opcodes
@@ -20,9 +49,11 @@ func generateOpcodesSet() *sets.Set {
 	op := sets.NewSet()
 
 	// Opcodes used by the server/client internally
-	op.Add("AUTH", "INFO", "LOGIN", "USERS")
+	op.Add("AUTH", "INFO", "LOGIN", "REGISTER", "RESUME", "USERS")
 	// End-user opcodes
-	op.Add("CREATE", "JOIN", "DISCONNECT", "ID", "MSG", "HELP", "EXIT", "QUIT")
+	op.Add("CREATE", "JOIN", "DISCONNECT", "ID", "MSG", "HELP", "EXIT", "QUIT", "TIME", "HISTORY", "SAVE", "STATS")
+	// End-user account opcodes
+	op.Add("PASSWD", "UNLINK", "WHOAMI")
 
 	return op
 }
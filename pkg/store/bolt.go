@@ -0,0 +1,125 @@
+package store
+
+import (
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"time"
+)
+
+// Store kept in a bbolt file
+type boltStore struct {
+	db *bolt.DB
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+type boltBucket struct {
+	b *bolt.Bucket
+}
+
+// Opens the bbolt file, giving up if another process has it open for longer than a second
+func openBolt(path string, readOnly bool) (Store, error) {
+	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) View(fn func(tx Tx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (s *boltStore) Update(fn func(tx Tx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (s *boltStore) Backup(path string) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(path, 0600)
+	})
+}
+
+func (s *boltStore) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+func (t *boltTx) Bucket(name string) Bucket {
+	b := t.tx.Bucket([]byte(name))
+	if b == nil {
+		return nil
+	}
+	return &boltBucket{b: b}
+}
+
+func (t *boltTx) CreateBucketIfNotExists(name string) (Bucket, error) {
+	if !t.tx.Writable() {
+		return nil, ErrTxNotWritable
+	}
+	b, err := t.tx.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return nil, err
+	}
+	return &boltBucket{b: b}, nil
+}
+
+func (t *boltTx) ForEach(fn func(name string, b Bucket) error) error {
+	return t.tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		return fn(string(name), &boltBucket{b: b})
+	})
+}
+
+func (b *boltBucket) Get(key []byte) []byte {
+	return b.b.Get(key)
+}
+
+func (b *boltBucket) Put(key, value []byte) error {
+	return b.b.Put(key, value)
+}
+
+func (b *boltBucket) Delete(key []byte) error {
+	return b.b.Delete(key)
+}
+
+func (b *boltBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.b.ForEach(fn)
+}
+
+func (b *boltBucket) ForEachReverse(fn func(k, v []byte) error) error {
+	c := b.b.Cursor()
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		err := fn(k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *boltBucket) NextSequence() (uint64, error) {
+	return b.b.NextSequence()
+}
+
+func (b *boltBucket) Sequence() uint64 {
+	return b.b.Sequence()
+}
+
+func (b *boltBucket) SetSequence(v uint64) error {
+	return b.b.SetSequence(v)
+}
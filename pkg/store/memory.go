@@ -0,0 +1,190 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Store kept in memory, nothing is saved once it's closed. Update transactions work on a copy
+// of the data which replaces it once they succeed, so failed transactions change nothing
+type memoryStore struct {
+	mutex   sync.RWMutex
+	buckets map[string]*memoryBucket
+}
+
+type memoryTx struct {
+	buckets  map[string]*memoryBucket
+	writable bool
+}
+
+type memoryBucket struct {
+	values   map[string][]byte
+	sequence uint64
+	writable bool
+}
+
+// Creates an empty in-memory store
+func NewMemory() Store {
+	return &memoryStore{buckets: make(map[string]*memoryBucket)}
+}
+
+func (s *memoryStore) View(fn func(tx Tx) error) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return fn(&memoryTx{buckets: s.buckets})
+}
+
+func (s *memoryStore) Update(fn func(tx Tx) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Copy the buckets so they can be thrown away if the transaction fails
+	buckets := make(map[string]*memoryBucket, len(s.buckets))
+	for name, b := range s.buckets {
+		values := make(map[string][]byte, len(b.values))
+		for k, v := range b.values {
+			values[k] = v
+		}
+		buckets[name] = &memoryBucket{values: values, sequence: b.sequence, writable: true}
+	}
+
+	err := fn(&memoryTx{buckets: buckets, writable: true})
+	if err != nil {
+		return err
+	}
+	for _, b := range buckets {
+		b.writable = false
+	}
+	s.buckets = buckets
+	return nil
+}
+
+func (s *memoryStore) Backup(path string) error {
+	return ErrNoBackup
+}
+
+func (s *memoryStore) WriteTo(w io.Writer) (int64, error) {
+	return 0, ErrNoBackup
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (t *memoryTx) Bucket(name string) Bucket {
+	b, ok := t.buckets[name]
+	if !ok {
+		return nil
+	}
+	return b
+}
+
+func (t *memoryTx) CreateBucketIfNotExists(name string) (Bucket, error) {
+	if !t.writable {
+		return nil, ErrTxNotWritable
+	}
+	if name == "" {
+		return nil, errors.New("store: bucket name required")
+	}
+	b, ok := t.buckets[name]
+	if !ok {
+		b = &memoryBucket{values: make(map[string][]byte), writable: true}
+		t.buckets[name] = b
+	}
+	return b, nil
+}
+
+func (t *memoryTx) ForEach(fn func(name string, b Bucket) error) error {
+	names := make([]string, 0, len(t.buckets))
+	for name := range t.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		err := fn(name, t.buckets[name])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memoryBucket) Get(key []byte) []byte {
+	return b.values[string(key)]
+}
+
+// Values are copied since the caller may reuse the slice
+func (b *memoryBucket) Put(key, value []byte) error {
+	if !b.writable {
+		return ErrTxNotWritable
+	}
+	if len(key) == 0 {
+		return errors.New("store: key required")
+	}
+	b.values[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (b *memoryBucket) Delete(key []byte) error {
+	if !b.writable {
+		return ErrTxNotWritable
+	}
+	delete(b.values, string(key))
+	return nil
+}
+
+// Returns the keys in byte order
+func (b *memoryBucket) keys() [][]byte {
+	keys := make([][]byte, 0, len(b.values))
+	for k := range b.values {
+		keys = append(keys, []byte(k))
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	return keys
+}
+
+func (b *memoryBucket) ForEach(fn func(k, v []byte) error) error {
+	for _, k := range b.keys() {
+		err := fn(k, b.values[string(k)])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memoryBucket) ForEachReverse(fn func(k, v []byte) error) error {
+	keys := b.keys()
+	for i := len(keys) - 1; i >= 0; i-- {
+		err := fn(keys[i], b.values[string(keys[i])])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memoryBucket) NextSequence() (uint64, error) {
+	if !b.writable {
+		return 0, ErrTxNotWritable
+	}
+	b.sequence++
+	return b.sequence, nil
+}
+
+func (b *memoryBucket) Sequence() uint64 {
+	return b.sequence
+}
+
+func (b *memoryBucket) SetSequence(v uint64) error {
+	if !b.writable {
+		return ErrTxNotWritable
+	}
+	b.sequence = v
+	return nil
+}
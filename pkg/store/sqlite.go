@@ -0,0 +1,332 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"io/ioutil"
+	_ "modernc.org/sqlite"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// How long a transaction waits for another process to release the file, in milliseconds
+const sqliteBusyTimeout = 5000
+
+// Tables which hold the buckets and their values
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS buckets (
+	name TEXT PRIMARY KEY,
+	seq  INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS kv (
+	bucket TEXT NOT NULL,
+	key    BLOB NOT NULL,
+	value  BLOB NOT NULL,
+	PRIMARY KEY (bucket, key)
+) WITHOUT ROWID;`
+
+// Store kept in a SQLite file. The file uses write-ahead logging so other processes,
+// i.e. the view command, can read it while the server is writing to it
+type sqliteStore struct {
+	db       *sql.DB
+	mutex    sync.Mutex // Only one update runs at once, like bbolt
+	readOnly bool
+}
+
+type sqliteTx struct {
+	tx       *sql.Tx
+	writable bool
+	err      error // First error from a method which can't return one, it fails the transaction
+}
+
+type sqliteBucket struct {
+	tx   *sqliteTx
+	name string
+}
+
+// Opens the SQLite file, it's created along with its tables if it doesn't exist unless opened read only
+func openSQLite(path string, readOnly bool) (Store, error) {
+	dsn := "file:" + (&url.URL{Path: path}).EscapedPath()
+	if readOnly {
+		dsn += "?mode=ro"
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &sqliteStore{db: db, readOnly: readOnly}
+	if !readOnly {
+		_, err = db.Exec("PRAGMA journal_mode = WAL")
+		if err == nil {
+			_, err = db.Exec(sqliteSchema)
+		}
+	} else {
+		err = db.Ping()
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Begins a transaction which waits for other processes rather than failing straight away
+func (s *sqliteStore) begin(writable bool) (*sqliteTx, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("PRAGMA busy_timeout = " + strconv.Itoa(sqliteBusyTimeout))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return &sqliteTx{tx: tx, writable: writable}, nil
+}
+
+func (s *sqliteStore) View(fn func(tx Tx) error) error {
+	t, err := s.begin(false)
+	if err != nil {
+		return err
+	}
+	defer t.tx.Rollback()
+
+	err = fn(t)
+	if err == nil {
+		err = t.err
+	}
+	return err
+}
+
+func (s *sqliteStore) Update(fn func(tx Tx) error) error {
+	if s.readOnly {
+		return ErrTxNotWritable
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	t, err := s.begin(true)
+	if err != nil {
+		return err
+	}
+	err = fn(t)
+	if err == nil {
+		err = t.err
+	}
+	if err != nil {
+		t.tx.Rollback()
+		return err
+	}
+	return t.tx.Commit()
+}
+
+// Backs up the store with VACUUM INTO, which replaces any file already at the path
+func (s *sqliteStore) Backup(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	_, err = s.db.Exec("VACUUM INTO ?", path)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(path, 0600)
+}
+
+// Writes the snapshot by backing up to a temporary file and copying it, SQLite can't write one to a stream
+func (s *sqliteStore) WriteTo(w io.Writer) (int64, error) {
+	dir, err := ioutil.TempDir("", "spotify-sync-snapshot")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapshot.sqlite")
+	err = s.Backup(path)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return io.Copy(w, f)
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+// Records an error from a method which can't return one, only the first is kept since later ones usually follow from it
+func (t *sqliteTx) fail(err error) {
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+// Returns the bucket, nil if it doesn't exist. If the query fails the error fails the transaction and
+// the bucket is still returned, its methods fail too so callers don't mistake the error for a missing bucket
+func (t *sqliteTx) Bucket(name string) Bucket {
+	var n string
+	err := t.tx.QueryRow("SELECT name FROM buckets WHERE name = ?", name).Scan(&n)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		t.fail(err)
+	}
+	return &sqliteBucket{tx: t, name: name}
+}
+
+func (t *sqliteTx) CreateBucketIfNotExists(name string) (Bucket, error) {
+	if !t.writable {
+		return nil, ErrTxNotWritable
+	}
+	if name == "" {
+		return nil, errors.New("store: bucket name required")
+	}
+	_, err := t.tx.Exec("INSERT OR IGNORE INTO buckets (name) VALUES (?)", name)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteBucket{tx: t, name: name}, nil
+}
+
+func (t *sqliteTx) ForEach(fn func(name string, b Bucket) error) error {
+	// The names are read first so the function can query the buckets
+	rows, err := t.tx.Query("SELECT name FROM buckets ORDER BY name")
+	if err != nil {
+		return err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		err = fn(name, &sqliteBucket{tx: t, name: name})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the value, values which exist are never nil so they can be told apart from missing ones.
+// Errors other than the key missing fail the transaction so they aren't mistaken for a missing key
+func (b *sqliteBucket) Get(key []byte) []byte {
+	var v []byte
+	err := b.tx.tx.QueryRow("SELECT value FROM kv WHERE bucket = ? AND key = ?", b.name, key).Scan(&v)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			b.tx.fail(err)
+		}
+		return nil
+	}
+	if v == nil {
+		v = []byte{}
+	}
+	return v
+}
+
+func (b *sqliteBucket) Put(key, value []byte) error {
+	if !b.tx.writable {
+		return ErrTxNotWritable
+	}
+	if len(key) == 0 {
+		return errors.New("store: key required")
+	}
+	// Empty values are bound as NULL so they're stored as an empty blob instead
+	_, err := b.tx.tx.Exec("INSERT OR REPLACE INTO kv (bucket, key, value) VALUES (?, ?, COALESCE(?, X''))", b.name, key, value)
+	return err
+}
+
+func (b *sqliteBucket) Delete(key []byte) error {
+	if !b.tx.writable {
+		return ErrTxNotWritable
+	}
+	_, err := b.tx.tx.Exec("DELETE FROM kv WHERE bucket = ? AND key = ?", b.name, key)
+	return err
+}
+
+// Calls the function for every row the query returns, the rows are streamed so
+// iterating can stop early without reading the rest of a large bucket
+func (b *sqliteBucket) forEach(query string, fn func(k, v []byte) error) error {
+	rows, err := b.tx.tx.Query(query, b.name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var k, v []byte
+		err = rows.Scan(&k, &v)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			v = []byte{}
+		}
+		err = fn(k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (b *sqliteBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.forEach("SELECT key, value FROM kv WHERE bucket = ? ORDER BY key", fn)
+}
+
+func (b *sqliteBucket) ForEachReverse(fn func(k, v []byte) error) error {
+	return b.forEach("SELECT key, value FROM kv WHERE bucket = ? ORDER BY key DESC", fn)
+}
+
+func (b *sqliteBucket) NextSequence() (uint64, error) {
+	if !b.tx.writable {
+		return 0, ErrTxNotWritable
+	}
+	_, err := b.tx.tx.Exec("UPDATE buckets SET seq = seq + 1 WHERE name = ?", b.name)
+	if err != nil {
+		return 0, err
+	}
+	return b.Sequence(), nil
+}
+
+func (b *sqliteBucket) Sequence() uint64 {
+	var seq int64
+	err := b.tx.tx.QueryRow("SELECT seq FROM buckets WHERE name = ?", b.name).Scan(&seq)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			b.tx.fail(err)
+		}
+		return 0
+	}
+	return uint64(seq)
+}
+
+func (b *sqliteBucket) SetSequence(v uint64) error {
+	if !b.tx.writable {
+		return ErrTxNotWritable
+	}
+	_, err := b.tx.tx.Exec("UPDATE buckets SET seq = ? WHERE name = ?", int64(v), b.name)
+	return err
+}
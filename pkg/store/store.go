@@ -0,0 +1,108 @@
+// Package store holds the server's data as values in named buckets, like bbolt does, so the
+// server can keep its data in bbolt, in memory (i.e. for tests) or in SQLite. Every read and
+// write happens within a transaction, changes made by a failed transaction are discarded
+package store
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Drivers which stores can be opened with
+const (
+	Bolt   = "bolt"   // Single file which only one process can open at once, the default
+	Memory = "memory" // Nothing is saved, used for tests
+	SQLite = "sqlite" // Single file which other processes can read while the server runs
+)
+
+// Errors returned by the stores
+var (
+	ErrTxNotWritable = errors.New("store: tx not writable")
+	ErrUnknownDriver = errors.New("store: unknown driver, must be \"bolt\", \"sqlite\" or \"memory\"")
+	ErrNoBackup      = errors.New("store: the memory store can't be backed up")
+)
+
+// Holds the data in buckets of keys and values
+type Store interface {
+	View(fn func(tx Tx) error) error    // Runs the function within a read only transaction
+	Update(fn func(tx Tx) error) error  // Runs the function within a read-write transaction, which is committed if it returns nil
+	Backup(path string) error           // Copies a consistent snapshot of the store to a file which the same driver can open
+	WriteTo(w io.Writer) (int64, error) // Writes a consistent snapshot of the store to the writer, in the same format as Backup
+	Close() error
+}
+
+// Transaction over the store, it must not be used after the function it was given to returns
+type Tx interface {
+	Bucket(name string) Bucket                           // Returns the bucket, nil if it doesn't exist
+	CreateBucketIfNotExists(name string) (Bucket, error) // Returns the bucket, creating it if needed
+	ForEach(fn func(name string, b Bucket) error) error  // Calls the function for every bucket in order of their names
+}
+
+// Bucket of keys and values, values are only valid until the transaction ends
+type Bucket interface {
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	ForEach(fn func(k, v []byte) error) error        // Calls the function for every key in order, stopping if it returns an error
+	ForEachReverse(fn func(k, v []byte) error) error // Like ForEach, but starting from the last key
+	NextSequence() (uint64, error)                   // Returns an autoincrementing integer for the bucket
+	Sequence() uint64                                // Returns the bucket's current sequence without incrementing it
+	SetSequence(v uint64) error
+}
+
+// Opens the store with the driver, the path of the file is ignored by the memory driver.
+// Read only stores can be opened while another process writes to them if the driver allows
+func Open(driver, path string, readOnly bool) (Store, error) {
+	// Read only files can't be created, bbolt would leave an empty file behind
+	if readOnly && driver != Memory {
+		_, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch driver {
+	case Bolt, "":
+		return openBolt(path, readOnly)
+	case SQLite:
+		return openSQLite(path, readOnly)
+	case Memory:
+		return NewMemory(), nil
+	default:
+		return nil, ErrUnknownDriver
+	}
+}
+
+// Returns the path of the file the driver stores its data in within the directory
+func Path(driver, dir string) string {
+	if driver == SQLite {
+		return filepath.Join(dir, "spotify.sqlite")
+	}
+	return filepath.Join(dir, "spotify.db")
+}
+
+// Copies every bucket from one store to another, the destination's buckets are created if needed
+// and existing keys are overwritten. This is used to move from one driver to another
+func Copy(dst, src Store) error {
+	return src.View(func(stx Tx) error {
+		return dst.Update(func(dtx Tx) error {
+			return stx.ForEach(func(name string, sb Bucket) error {
+				db, err := dtx.CreateBucketIfNotExists(name)
+				if err != nil {
+					return err
+				}
+				if sb.Sequence() > db.Sequence() {
+					err = db.SetSequence(sb.Sequence())
+					if err != nil {
+						return err
+					}
+				}
+				return sb.ForEach(func(k, v []byte) error {
+					return db.Put(k, v)
+				})
+			})
+		})
+	})
+}
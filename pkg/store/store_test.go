@@ -0,0 +1,375 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+var drivers = []string{Memory, Bolt, SQLite}
+
+// Opens an empty store with the driver which is closed when the test ends
+func openTest(t *testing.T, driver string) Store {
+	t.Helper()
+	s, err := Open(driver, Path(driver, t.TempDir()), false)
+	if err != nil {
+		t.Fatalf("open %s: %s", driver, err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// Runs the test against a store opened with each driver
+func forEachDriver(t *testing.T, fn func(t *testing.T, s Store)) {
+	for _, d := range drivers {
+		d := d
+		t.Run(d, func(t *testing.T) {
+			fn(t, openTest(t, d))
+		})
+	}
+}
+
+// Puts the values into the bucket, creating it if needed
+func put(t *testing.T, s Store, bucket string, kv ...string) {
+	t.Helper()
+	err := s.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(kv); i += 2 {
+			err = b.Put([]byte(kv[i]), []byte(kv[i+1]))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("put: %s", err)
+	}
+}
+
+// Returns the value of the key, nil if the key or bucket is missing
+func get(t *testing.T, s Store, bucket, key string) []byte {
+	t.Helper()
+	var v []byte
+	err := s.View(func(tx Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		if got := b.Get([]byte(key)); got != nil {
+			v = append([]byte{}, got...)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	return v
+}
+
+func TestBuckets(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, s Store) {
+		err := s.View(func(tx Tx) error {
+			if tx.Bucket("users") != nil {
+				t.Error("missing bucket isn't nil")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		put(t, s, "users", "alice", "1", "bob", "")
+		put(t, s, "audit")
+
+		var names []string
+		err = s.View(func(tx Tx) error {
+			return tx.ForEach(func(name string, b Bucket) error {
+				names = append(names, name)
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != 2 || names[0] != "audit" || names[1] != "users" {
+			t.Errorf("buckets = %v, want [audit users]", names)
+		}
+	})
+}
+
+func TestGetPutDelete(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, s Store) {
+		put(t, s, "users", "alice", "1", "empty", "")
+
+		tests := []struct {
+			key  string
+			want []byte
+		}{
+			{"alice", []byte("1")},
+			{"empty", []byte{}},
+			{"missing", nil},
+		}
+		for _, tt := range tests {
+			got := get(t, s, "users", tt.key)
+			if !bytes.Equal(got, tt.want) || (got == nil) != (tt.want == nil) {
+				t.Errorf("get %q = %q, want %q", tt.key, got, tt.want)
+			}
+		}
+
+		err := s.Update(func(tx Tx) error {
+			return tx.Bucket("users").Delete([]byte("alice"))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := get(t, s, "users", "alice"); v != nil {
+			t.Errorf("deleted key = %q, want nil", v)
+		}
+	})
+}
+
+func TestForEachOrder(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, s Store) {
+		put(t, s, "history", "b", "2", "c", "3", "a", "1")
+
+		tests := []struct {
+			name    string
+			reverse bool
+			stop    string
+			want    string
+		}{
+			{"forward", false, "", "abc"},
+			{"reverse", true, "", "cba"},
+			{"forward stopped", false, "b", "ab"},
+			{"reverse stopped", true, "b", "cb"},
+		}
+		errStop := errors.New("stop")
+		for _, tt := range tests {
+			var got string
+			err := s.View(func(tx Tx) error {
+				fn := func(k, v []byte) error {
+					got += string(k)
+					if string(k) == tt.stop {
+						return errStop
+					}
+					return nil
+				}
+				if tt.reverse {
+					return tx.Bucket("history").ForEachReverse(fn)
+				}
+				return tx.Bucket("history").ForEach(fn)
+			})
+			if tt.stop != "" && err != errStop {
+				t.Errorf("%s: err = %v, want the stop error", tt.name, err)
+			} else if tt.stop == "" && err != nil {
+				t.Errorf("%s: %s", tt.name, err)
+			}
+			if got != tt.want {
+				t.Errorf("%s: keys = %q, want %q", tt.name, got, tt.want)
+			}
+		}
+	})
+}
+
+func TestFailedUpdateRollsBack(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, s Store) {
+		put(t, s, "users", "alice", "1")
+
+		failed := errors.New("failed")
+		err := s.Update(func(tx Tx) error {
+			b := tx.Bucket("users")
+			if err := b.Put([]byte("alice"), []byte("2")); err != nil {
+				return err
+			}
+			if err := b.Put([]byte("bob"), []byte("1")); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucketIfNotExists("audit"); err != nil {
+				return err
+			}
+			return failed
+		})
+		if err != failed {
+			t.Fatalf("err = %v, want %v", err, failed)
+		}
+
+		if v := get(t, s, "users", "alice"); string(v) != "1" {
+			t.Errorf("alice = %q, want \"1\"", v)
+		}
+		if v := get(t, s, "users", "bob"); v != nil {
+			t.Errorf("bob = %q, want nil", v)
+		}
+		err = s.View(func(tx Tx) error {
+			if tx.Bucket("audit") != nil {
+				t.Error("bucket created by failed update exists")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestViewIsReadOnly(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, s Store) {
+		put(t, s, "users", "alice", "1")
+
+		err := s.View(func(tx Tx) error {
+			b := tx.Bucket("users")
+			if b.Put([]byte("bob"), []byte("1")) == nil {
+				t.Error("put in view succeeded")
+			}
+			if b.Delete([]byte("alice")) == nil {
+				t.Error("delete in view succeeded")
+			}
+			if _, err := tx.CreateBucketIfNotExists("audit"); err == nil {
+				t.Error("creating bucket in view succeeded")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestSequence(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, s Store) {
+		err := s.Update(func(tx Tx) error {
+			b, err := tx.CreateBucketIfNotExists("audit")
+			if err != nil {
+				return err
+			}
+			for want := uint64(1); want <= 3; want++ {
+				n, err := b.NextSequence()
+				if err != nil {
+					return err
+				}
+				if n != want {
+					t.Errorf("next sequence = %d, want %d", n, want)
+				}
+			}
+			return b.SetSequence(10)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.View(func(tx Tx) error {
+			if n := tx.Bucket("audit").Sequence(); n != 10 {
+				t.Errorf("sequence = %d, want 10", n)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestCopy(t *testing.T) {
+	for _, src := range drivers {
+		for _, dst := range drivers {
+			src, dst := src, dst
+			t.Run(src+" to "+dst, func(t *testing.T) {
+				s := openTest(t, src)
+				put(t, s, "users", "alice", "1", "bob", "2")
+				err := s.Update(func(tx Tx) error {
+					return tx.Bucket("users").SetSequence(7)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				d := openTest(t, dst)
+				put(t, d, "users", "alice", "old", "carol", "3")
+				err = Copy(d, s)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for k, want := range map[string]string{"alice": "1", "bob": "2", "carol": "3"} {
+					if v := get(t, d, "users", k); string(v) != want {
+						t.Errorf("%s = %q, want %q", k, v, want)
+					}
+				}
+				err = d.View(func(tx Tx) error {
+					if n := tx.Bucket("users").Sequence(); n != 7 {
+						t.Errorf("sequence = %d, want 7", n)
+					}
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+func TestBackup(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, s Store) {
+		put(t, s, "users", "alice", "1")
+
+		driver := SQLite
+		if _, ok := s.(*boltStore); ok {
+			driver = Bolt
+		}
+		path := filepath.Join(t.TempDir(), "backup")
+		err := s.Backup(path)
+		if _, ok := s.(*memoryStore); ok {
+			if err != ErrNoBackup {
+				t.Errorf("err = %v, want %v", err, ErrNoBackup)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := Open(driver, path, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		if v := get(t, b, "users", "alice"); string(v) != "1" {
+			t.Errorf("alice = %q, want \"1\"", v)
+		}
+	})
+}
+
+func TestSQLiteQueryErrorsFailTx(t *testing.T) {
+	s := openTest(t, SQLite)
+	put(t, s, "users", "alice", "1")
+
+	tests := []struct {
+		name string
+		fn   func(tx Tx, b Bucket)
+	}{
+		{"bucket", func(tx Tx, b Bucket) {
+			if tx.Bucket("users") == nil {
+				t.Error("bucket is nil after a query error")
+			}
+		}},
+		{"get", func(tx Tx, b Bucket) { b.Get([]byte("alice")) }},
+		{"sequence", func(tx Tx, b Bucket) { b.Sequence() }},
+	}
+	for _, tt := range tests {
+		err := s.Update(func(tx Tx) error {
+			b := tx.Bucket("users")
+			// Closing the underlying transaction makes every query fail
+			tx.(*sqliteTx).tx.Rollback()
+			tt.fn(tx, b)
+			return nil
+		})
+		if err == nil {
+			t.Errorf("%s: update succeeded after a query error", tt.name)
+		}
+	}
+}